@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/internal/retryafter"
 	"golang.org/x/net/http2"
 )
 
@@ -61,6 +62,7 @@ func (ac *Client) Send(n Notification) ([]Result, error) {
 			APNsID:     res.Header.Get("apns-id"),
 			StatusCode: res.StatusCode,
 			Token:      n.Token,
+			RetryAfter: retryafter.Parse(res.Header, time.Now()),
 		},
 	}
 
@@ -71,6 +73,7 @@ func (ac *Client) Send(n Notification) ([]Result, error) {
 			ret[0].Reason = err.Error()
 		} else {
 			ret[0].Reason = er.Reason
+			ret[0].Timestamp = er.Timestamp
 		}
 	}
 
@@ -110,6 +113,9 @@ func (ac *Client) NewRequest(token string, h *Header, payload Payload) (*http.Re
 		if h.ApnsPushType != "" {
 			nreq.Header.Set("apns-push-type", h.ApnsPushType)
 		}
+		if h.ApnsCollapseID != "" {
+			nreq.Header.Set("apns-collapse-id", h.ApnsCollapseID)
+		}
 	}
 
 	// APNs provider token authenticaton
@@ -6,12 +6,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"io"
-	"math/big"
 )
 
 // https://developer.apple.com/library/content/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/CommunicatingwithAPNs.html#//apple_ref/doc/uid/TP40008194-CH11-SW1
@@ -28,19 +27,39 @@ type jwtClaim struct {
 	Iat int64  `json:"iat"`
 }
 
-type ecdsaSignature struct {
-	R, S *big.Int
-}
-
+// CreateJWT creates a provider authentication token of APNs.
 func CreateJWT(key []byte, kid string, teamID string, unixtime int64) (string, error) {
-	var b bytes.Buffer
-	b.Grow(jwtDefaultGrowSize)
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return "", errors.New("invalid PEM key")
+	}
+	p8key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	ecKey, ok := p8key.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", errors.New("key is not an ECDSA private key")
+	}
 
 	header := jwtHeader{
 		Alg: "ES256",
 		Kid: kid,
 	}
-	headerJSON, err := json.Marshal(&header)
+	claim := jwtClaim{
+		Iss: teamID,
+		Iat: unixtime,
+	}
+	return SignES256(ecKey, header, claim)
+}
+
+// SignES256 creates a JWT which has the header and the claim, signed by ES256.
+// The header must have "alg":"ES256". The signature is R || S as JWS defines.
+func SignES256(key *ecdsa.PrivateKey, header, claim interface{}) (string, error) {
+	var b bytes.Buffer
+	b.Grow(jwtDefaultGrowSize)
+
+	headerJSON, err := json.Marshal(header)
 	if err != nil {
 		return "", err
 	}
@@ -49,11 +68,7 @@ func CreateJWT(key []byte, kid string, teamID string, unixtime int64) (string, e
 	}
 	b.WriteByte(byte('.'))
 
-	claim := jwtClaim{
-		Iss: teamID,
-		Iat: unixtime,
-	}
-	claimJSON, err := json.Marshal(&claim)
+	claimJSON, err := json.Marshal(claim)
 	if err != nil {
 		return "", err
 	}
@@ -84,28 +99,21 @@ func writeAsBase64(w io.Writer, byt []byte) error {
 	return nil
 }
 
-func createSignature(payload []byte, key []byte) ([]byte, error) {
+func createSignature(payload []byte, key *ecdsa.PrivateKey) ([]byte, error) {
 	h := crypto.SHA256.New()
 	if _, err := h.Write(payload); err != nil {
 		return nil, err
 	}
 	msg := h.Sum(nil)
 
-	block, _ := pem.Decode(key)
-	p8key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	r, s, err := ecdsa.Sign(rand.Reader, p8key.(*ecdsa.PrivateKey), msg)
-	if err != nil {
-		return nil, err
-	}
-
-	sig, err := asn1.Marshal(ecdsaSignature{r, s})
+	r, s, err := ecdsa.Sign(rand.Reader, key, msg)
 	if err != nil {
 		return nil, err
 	}
 
+	// R and S are padded to 32 bytes
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
 	return sig, nil
 }
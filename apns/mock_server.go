@@ -67,6 +67,9 @@ func StartAPNSMockServer(cert, key string) {
 			w.Header().Set("apns-id", "apns-id")
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, createErrorResponse(BadDeviceToken, http.StatusBadRequest))
+		} else if len(r.Header.Get("apns-collapse-id")) > MaxCollapseIDSize {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, createErrorResponse(BadCollapseId, http.StatusBadRequest))
 		} else if token == "missingtopic" {
 			// MissingDeviceToken
 			w.WriteHeader(http.StatusBadRequest)
@@ -101,7 +104,7 @@ func createErrorResponse(ermsg ErrorResponseCode, status int) string {
 	if status == http.StatusGone {
 		er = ErrorResponse{
 			Reason:    ermsg.String(),
-			Timestamp: time.Now().Unix(),
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
 		}
 	} else {
 		er = ErrorResponse{
@@ -1,7 +1,13 @@
 package apns
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Request for a http2 client
@@ -9,6 +15,7 @@ type Notification struct {
 	Header  Header  `json:"header,omitempty"`
 	Token   string  `json:"token"`
 	Payload Payload `json:"payload"`
+	App     string  `json:"app,omitempty"` // name of the app which sends the notification
 }
 
 // Header for apns request
@@ -18,6 +25,85 @@ type Header struct {
 	ApnsPriority   string `json:"apns-priority,omitempty"`
 	ApnsTopic      string `json:"apns-topic,omitempty"`
 	ApnsPushType   string `json:"apns-push-type,omitempty"`
+	ApnsCollapseID string `json:"apns-collapse-id,omitempty"`
+}
+
+// MaxCollapseIDSize is the max byte size of apns-collapse-id.
+const MaxCollapseIDSize = 64
+
+// Push types
+const (
+	PushTypeAlert        = "alert"
+	PushTypeBackground   = "background"
+	PushTypeLocation     = "location"
+	PushTypeVoIP         = "voip"
+	PushTypeComplication = "complication"
+	PushTypeFileProvider = "fileprovider"
+	PushTypeMDM          = "mdm"
+	PushTypeLiveActivity = "liveactivity"
+	PushTypePushToTalk   = "pushtotalk"
+	PushTypeWidgets      = "widgets"
+)
+
+// pushTypeTopicSuffixes are suffixes of apns-topic which push types require.
+var pushTypeTopicSuffixes = map[string]string{
+	PushTypeAlert:        "",
+	PushTypeBackground:   "",
+	PushTypeLocation:     ".location-query",
+	PushTypeVoIP:         ".voip",
+	PushTypeComplication: ".complication",
+	PushTypeFileProvider: ".pushkit.fileprovider",
+	PushTypeMDM:          "",
+	PushTypeLiveActivity: ".push-type.liveactivity",
+	PushTypePushToTalk:   ".voip-ptt",
+	PushTypeWidgets:      ".push-type.widgets",
+}
+
+// BundleID returns the bundle ID of the app from apns-topic, which may have a suffix of push types.
+func BundleID(topic string) string {
+	for _, suffix := range pushTypeTopicSuffixes {
+		if suffix != "" && strings.HasSuffix(topic, suffix) {
+			return strings.TrimSuffix(topic, suffix)
+		}
+	}
+	return topic
+}
+
+var apnsIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Validate validates values of the header.
+func (h Header) Validate() error {
+	if h.ApnsID != "" && !apnsIDRegexp.MatchString(h.ApnsID) {
+		return fmt.Errorf("apns-id must be a UUID: %s", h.ApnsID)
+	}
+	if h.ApnsExpiration != "" {
+		if _, err := strconv.ParseInt(h.ApnsExpiration, 10, 64); err != nil {
+			return fmt.Errorf("apns-expiration must be a UNIX epoch: %s", h.ApnsExpiration)
+		}
+	}
+	switch h.ApnsPriority {
+	case "", "10", "5", "1":
+	default:
+		return fmt.Errorf("apns-priority must be 10, 5 or 1: %s", h.ApnsPriority)
+	}
+	if len(h.ApnsCollapseID) > MaxCollapseIDSize {
+		return fmt.Errorf("apns-collapse-id must not exceed %d bytes", MaxCollapseIDSize)
+	}
+
+	if h.ApnsPushType == "" {
+		return nil
+	}
+	suffix, ok := pushTypeTopicSuffixes[h.ApnsPushType]
+	if !ok {
+		return fmt.Errorf("apns-push-type is invalid: %s", h.ApnsPushType)
+	}
+	if suffix != "" && !strings.HasSuffix(h.ApnsTopic, suffix) {
+		return fmt.Errorf("apns-topic must end with %s for apns-push-type %s", suffix, h.ApnsPushType)
+	}
+	if h.ApnsPushType == PushTypeBackground && h.ApnsPriority == "10" {
+		return fmt.Errorf("apns-priority must be 5 or 1 for apns-push-type background")
+	}
+	return nil
 }
 
 // Payload is Notification Payload
@@ -27,29 +113,77 @@ type Payload struct {
 }
 
 // APS is a part of Payload
+// https://developer.apple.com/documentation/usernotifications/generating-a-remote-notification
 type APS struct {
-	Alert            interface{} `json:"alert,omitempty"`
-	Badge            int         `json:"badge,omitempty"`
-	Sound            string      `json:"sound,omitempty"`
-	ContentAvailable int         `json:"content-available,omitempty"`
-	Category         string      `json:"category,omitempty"`
-	ThreadID         string      `json:"thread-id,omitempty"`
-	MutableContent   int         `json:"mutable-content,omitempty"`
-	TargetContentID  string      `json:"target-content-id,omitempty"`
+	Alert             interface{} `json:"alert,omitempty"` // string or Alert
+	Badge             *int        `json:"badge,omitempty"` // 0 removes the badge
+	Sound             interface{} `json:"sound,omitempty"` // string or Sound
+	ThreadID          string      `json:"thread-id,omitempty"`
+	Category          string      `json:"category,omitempty"`
+	ContentAvailable  int         `json:"content-available,omitempty"`
+	MutableContent    int         `json:"mutable-content,omitempty"`
+	TargetContentID   string      `json:"target-content-id,omitempty"`
+	InterruptionLevel string      `json:"interruption-level,omitempty"`
+	RelevanceScore    *float64    `json:"relevance-score,omitempty"`
+	FilterCriteria    string      `json:"filter-criteria,omitempty"`
+
+	// Live Activity
+	StaleDate      int64           `json:"stale-date,omitempty"`
+	ContentState   json.RawMessage `json:"content-state,omitempty"`
+	Timestamp      int64           `json:"timestamp,omitempty"`
+	Event          string          `json:"event,omitempty"`
+	DismissalDate  int64           `json:"dismissal-date,omitempty"`
+	AttributesType string          `json:"attributes-type,omitempty"`
+	Attributes     json.RawMessage `json:"attributes,omitempty"`
+
+	// Extra holds keys which are not modeled above (e.g. url-args for Safari), and they are sent as is.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Badge returns a pointer to n for APS.Badge. (e.g. APS{Badge: apns.Badge(1)})
+func Badge(n int) *int {
+	return &n
 }
 
 // Alert is a part of APS
 type Alert struct {
-	Title        string   `json:"title,omitempty"`
-	Body         string   `json:"body,omitempty"`
-	TitleLocKey  string   `json:"title-loc-key,omitempty"`
-	TitleLocArgs []string `json:"title-loc-args,omitempty"`
-	ActionLocKey string   `json:"action-loc-key,omitempty"`
-	LocKey       string   `json:"loc-key,omitempty"`
-	LocArgs      []string `json:"loc-args,omitempty"`
-	LaunchImage  string   `json:"launch-image,omitempty"`
+	Title           string   `json:"title,omitempty"`
+	Subtitle        string   `json:"subtitle,omitempty"`
+	Body            string   `json:"body,omitempty"`
+	LaunchImage     string   `json:"launch-image,omitempty"`
+	TitleLocKey     string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs    []string `json:"title-loc-args,omitempty"`
+	SubtitleLocKey  string   `json:"subtitle-loc-key,omitempty"`
+	SubtitleLocArgs []string `json:"subtitle-loc-args,omitempty"`
+	ActionLocKey    string   `json:"action-loc-key,omitempty"`
+	LocKey          string   `json:"loc-key,omitempty"`
+	LocArgs         []string `json:"loc-args,omitempty"`
+	SummaryArg      string   `json:"summary-arg,omitempty"`
+	SummaryArgCount int      `json:"summary-arg-count,omitempty"`
+}
+
+// Sound is a part of APS for critical alerts
+type Sound struct {
+	Critical int      `json:"critical,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Volume   *float64 `json:"volume,omitempty"`
 }
 
+// Interruption levels
+const (
+	InterruptionLevelPassive       = "passive"
+	InterruptionLevelActive        = "active"
+	InterruptionLevelTimeSensitive = "time-sensitive"
+	InterruptionLevelCritical      = "critical"
+)
+
+// Live Activity events
+const (
+	EventStart  = "start"
+	EventUpdate = "update"
+	EventEnd    = "end"
+)
+
 // MarshalJSON for Payload struct.
 func (p Payload) MarshalJSON() ([]byte, error) {
 	payloadMap := make(map[string]interface{})
@@ -64,36 +198,244 @@ func (p Payload) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON for Payload struct.
 func (p *Payload) UnmarshalJSON(data []byte) error {
-	var payloadMap map[string]interface{}
-	p.APS = &APS{}
+	var payloadMap map[string]json.RawMessage
+	p.APS = nil
 	p.Optional = make(map[string]interface{})
 
 	if err := json.Unmarshal(data, &payloadMap); err != nil {
 		return err
 	}
 
-	apsMap := payloadMap["aps"].(map[string]interface{})
+	for k, v := range payloadMap {
+		if k == "aps" {
+			if bytes.Equal(v, []byte("null")) {
+				continue
+			}
+			p.APS = &APS{}
+			if err := json.Unmarshal(v, p.APS); err != nil {
+				return err
+			}
+			continue
+		}
+		var opt interface{}
+		if err := decodeJSON(v, &opt, false); err != nil {
+			return err
+		}
+		p.Optional[k] = opt
+	}
 
-	for k, v := range apsMap {
-		switch k {
-		case "alert":
-			p.APS.Alert = v
-		case "badge":
-			p.APS.Badge = int(v.(float64))
-		case "sound":
-			p.APS.Sound = v.(string)
-		case "category":
-			p.APS.Category = v.(string)
-		case "content-available":
-			p.APS.ContentAvailable = int(v.(float64))
+	return nil
+}
+
+// apsKeys are keys of aps which APS models.
+var apsKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(APS{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			keys[name] = true
 		}
 	}
+	return keys
+}()
 
-	for k, v := range payloadMap {
-		if k != "aps" {
-			p.Optional[k] = v
+// MarshalJSON for APS struct. Extra keys are added to modeled keys.
+func (a APS) MarshalJSON() ([]byte, error) {
+	type aps APS
+	b, err := json.Marshal(aps(a))
+	if err != nil || len(a.Extra) == 0 {
+		return b, err
+	}
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range a.Extra {
+		if !apsKeys[k] {
+			m[k] = v
+		}
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON for APS struct. Keys which are not modeled are kept in Extra so that no fields are dropped silently.
+func (a *APS) UnmarshalJSON(data []byte) error {
+	type aps APS
+	v := struct {
+		Alert json.RawMessage `json:"alert"`
+		Sound json.RawMessage `json:"sound"`
+		*aps
+	}{aps: (*aps)(a)}
+	if err := decodeJSON(data, &v, false); err != nil {
+		return fmt.Errorf("aps: %s", err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("aps: %s", err)
+	}
+	a.Extra = nil
+	for k, raw := range m {
+		if apsKeys[k] {
+			continue
+		}
+		if a.Extra == nil {
+			a.Extra = make(map[string]json.RawMessage)
 		}
+		a.Extra[k] = raw
+	}
+
+	a.Alert, a.Sound = nil, nil
+	switch kindOf(v.Alert) {
+	case '"':
+		var s string
+		if err := json.Unmarshal(v.Alert, &s); err != nil {
+			return err
+		}
+		a.Alert = s
+	case '{':
+		var alert Alert
+		if err := decodeJSON(v.Alert, &alert, true); err != nil {
+			return fmt.Errorf("aps.alert: %s", err)
+		}
+		a.Alert = alert
+	case 0:
+	default:
+		return fmt.Errorf("aps.alert must be a string or a dictionary")
+	}
+
+	switch kindOf(v.Sound) {
+	case '"':
+		var s string
+		if err := json.Unmarshal(v.Sound, &s); err != nil {
+			return err
+		}
+		a.Sound = s
+	case '{':
+		var sound Sound
+		if err := decodeJSON(v.Sound, &sound, true); err != nil {
+			return fmt.Errorf("aps.sound: %s", err)
+		}
+		a.Sound = sound
+	case 0:
+	default:
+		return fmt.Errorf("aps.sound must be a string or a dictionary")
 	}
 
 	return nil
 }
+
+// Validate validates the structure of the payload.
+func (p Payload) Validate() error {
+	if p.APS == nil {
+		return fmt.Errorf("aps is required")
+	}
+	return p.APS.Validate()
+}
+
+// Validate validates the structure of aps.
+func (a *APS) Validate() error {
+	switch a.Alert.(type) {
+	case nil, string, Alert, *Alert:
+	default:
+		return fmt.Errorf("aps.alert must be a string or a dictionary")
+	}
+
+	switch s := a.Sound.(type) {
+	case nil, string:
+	case Sound:
+		if err := s.validate(); err != nil {
+			return err
+		}
+	case *Sound:
+		if err := s.validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("aps.sound must be a string or a dictionary")
+	}
+
+	if a.ContentAvailable != 0 && a.ContentAvailable != 1 {
+		return fmt.Errorf("aps.content-available must be 0 or 1: %d", a.ContentAvailable)
+	}
+	if a.MutableContent != 0 && a.MutableContent != 1 {
+		return fmt.Errorf("aps.mutable-content must be 0 or 1: %d", a.MutableContent)
+	}
+
+	switch a.InterruptionLevel {
+	case "", InterruptionLevelPassive, InterruptionLevelActive, InterruptionLevelTimeSensitive, InterruptionLevelCritical:
+	default:
+		return fmt.Errorf("aps.interruption-level is invalid: %s", a.InterruptionLevel)
+	}
+	// Live Activities accept any relevance scores to sort them
+	if r := a.RelevanceScore; r != nil && a.Event == "" && (*r < 0 || *r > 1) {
+		return fmt.Errorf("aps.relevance-score must be between 0 and 1: %g", *r)
+	}
+
+	return a.validateLiveActivity()
+}
+
+func (a *APS) validateLiveActivity() error {
+	switch a.Event {
+	case "":
+		if len(a.ContentState) > 0 || a.AttributesType != "" || len(a.Attributes) > 0 ||
+			a.StaleDate != 0 || a.DismissalDate != 0 {
+			return fmt.Errorf("aps.event is required for Live Activity fields")
+		}
+		return nil
+	case EventStart:
+		if a.AttributesType == "" || len(a.Attributes) == 0 {
+			return fmt.Errorf("aps.attributes-type and aps.attributes are required for the start event")
+		}
+	case EventUpdate, EventEnd:
+		if a.AttributesType != "" || len(a.Attributes) > 0 {
+			return fmt.Errorf("aps.attributes-type and aps.attributes are allowed only for the start event")
+		}
+	default:
+		return fmt.Errorf("aps.event is invalid: %s", a.Event)
+	}
+
+	if a.Timestamp == 0 {
+		return fmt.Errorf("aps.timestamp is required for Live Activity")
+	}
+	if kindOf(a.ContentState) != '{' {
+		if a.Event != EventEnd || len(a.ContentState) > 0 {
+			return fmt.Errorf("aps.content-state must be a dictionary")
+		}
+	}
+	if kind := kindOf(a.Attributes); kind != 0 && kind != '{' {
+		return fmt.Errorf("aps.attributes must be a dictionary")
+	}
+	if a.DismissalDate != 0 && a.Event != EventEnd {
+		return fmt.Errorf("aps.dismissal-date is allowed only for the end event")
+	}
+	return nil
+}
+
+func (s Sound) validate() error {
+	if s.Critical != 0 && s.Critical != 1 {
+		return fmt.Errorf("aps.sound.critical must be 0 or 1: %d", s.Critical)
+	}
+	if v := s.Volume; v != nil && (*v < 0 || *v > 1) {
+		return fmt.Errorf("aps.sound.volume must be between 0 and 1: %g", *v)
+	}
+	return nil
+}
+
+// decodeJSON decodes data with keeping numbers as json.Number.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// kindOf returns the first character of the JSON value, or 0 for an empty value or null.
+func kindOf(data json.RawMessage) byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return 0
+	}
+	return data[0]
+}
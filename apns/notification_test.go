@@ -2,6 +2,8 @@ package apns
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +28,109 @@ func TestUnmarshal(t *testing.T) {
 		t.Errorf("Expected %s, but got %s", jstr, pjson)
 	}
 }
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		`{"aps":{"alert":{"title":"t","subtitle":"s","body":"b","title-loc-args":["a"],"summary-arg":"x","summary-arg-count":2},"badge":0,"sound":{"critical":1,"name":"alarm.aiff","volume":0},"thread-id":"th","category":"c","content-available":1,"mutable-content":1,"target-content-id":"tc","interruption-level":"time-sensitive","relevance-score":0,"filter-criteria":"work"},"id":12345678901234567890}`,
+		`{"aps":{"timestamp":1700000000,"event":"start","content-state":{"score":{"home":1,"away":0}},"attributes-type":"MatchAttributes","attributes":{"team":"A"},"stale-date":1700003600,"alert":{"title":"Kick off"}}}`,
+		`{"aps":{"timestamp":1700000100,"event":"end","content-state":{"score":{"home":2,"away":1}},"dismissal-date":1700007200}}`,
+		`{"aps":{"timestamp":1700000000,"event":"update","content-state":{},"relevance-score":75}}`,
+		`{"aps":{"alert":{"title":"t"},"url-args":["a","b"]}}`,
+		`{"aps":{"event":"start","timestamp":1700000000,"content-state":{},"attributes-type":"A","attributes":{},"input-push-channel":"ch","input-push-token":1}}`,
+	} {
+		var payload Payload
+		if err := json.Unmarshal([]byte(s), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := payload.Validate(); err != nil {
+			t.Errorf("unexpected validation error: %s", err)
+		}
+		b, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expected, got interface{}
+		json.Unmarshal([]byte(s), &expected)
+		json.Unmarshal(b, &got)
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected %s, but got %s", s, b)
+		}
+	}
+}
+
+func TestBadge(t *testing.T) {
+	payload := Payload{APS: &APS{Alert: "hoge", Badge: Badge(0), Sound: "default"}}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := `{"aps":{"alert":"hoge","badge":0,"sound":"default"}}`; string(b) != s {
+		t.Errorf("Expected %s, but got %s", s, b)
+	}
+}
+
+func TestUnmarshalUnknownKey(t *testing.T) {
+	for _, s := range []string{
+		`{"aps":{"alert":{"title":"hoge","unknown":1}}}`,
+		`{"aps":{"alert":1}}`,
+	} {
+		var payload Payload
+		if err := json.Unmarshal([]byte(s), &payload); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []string{
+		`{}`,
+		`{"aps":{"interruption-level":"urgent"}}`,
+		`{"aps":{"relevance-score":1.5}}`,
+		`{"aps":{"sound":{"critical":1,"name":"alarm.aiff","volume":2}}}`,
+		`{"aps":{"content-available":2}}`,
+		`{"aps":{"content-state":{"score":1}}}`,
+		`{"aps":{"event":"begin","timestamp":1700000000,"content-state":{}}}`,
+		`{"aps":{"event":"start","timestamp":1700000000,"content-state":{}}}`,
+		`{"aps":{"event":"update","content-state":{}}}`,
+		`{"aps":{"event":"update","timestamp":1700000000}}`,
+		`{"aps":{"event":"update","timestamp":1700000000,"content-state":{},"dismissal-date":1700000000}}`,
+	} {
+		var payload Payload
+		if err := json.Unmarshal([]byte(s), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := payload.Validate(); err == nil {
+			t.Errorf("expected validation error for %s", s)
+		}
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	testTable := []struct {
+		header Header
+		valid  bool
+	}{
+		{Header{ApnsCollapseID: "score-update"}, true},
+		{Header{ApnsCollapseID: strings.Repeat("x", 65)}, false},
+		{Header{ApnsPriority: "5"}, true},
+		{Header{ApnsPriority: "3"}, false},
+		{Header{ApnsID: "123e4567-e89b-12d3-a456-42665544000"}, false},
+		{Header{ApnsID: "123e4567-e89b-12d3-a456-426655440000"}, true},
+		{Header{ApnsExpiration: "tomorrow"}, false},
+		{Header{ApnsPushType: "unknown"}, false},
+		{Header{ApnsPushType: PushTypeVoIP, ApnsTopic: "com.example.app"}, false},
+		{Header{ApnsPushType: PushTypeVoIP, ApnsTopic: "com.example.app.voip"}, true},
+		{Header{ApnsPushType: PushTypeLiveActivity, ApnsTopic: "com.example.app.push-type.liveactivity"}, true},
+		{Header{ApnsPushType: PushTypeBackground, ApnsPriority: "10"}, false},
+	}
+	for _, tt := range testTable {
+		err := tt.header.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("unexpected error for %#v: %s", tt.header, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("expected error for %#v", tt.header)
+		}
+	}
+}
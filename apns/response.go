@@ -3,6 +3,7 @@ package apns
 import (
 	"encoding/json"
 	"errors"
+	"time"
 )
 
 const Provider = "apns"
@@ -13,6 +14,9 @@ type Result struct {
 	StatusCode int    `json:"status"`
 	Token      string `json:"token"`
 	Reason     string `json:"reason"`
+	App        string `json:"app,omitempty"`
+	RetryAfter int64  `json:"retry_after,omitempty"` // seconds of Retry-After header
+	Timestamp  int64  `json:"timestamp,omitempty"`   // milliseconds when APNs confirmed that the token was no longer valid
 }
 
 func (r Result) Err() error {
@@ -22,12 +26,25 @@ func (r Result) Err() error {
 	return errors.New(r.Reason)
 }
 
+// Backoff returns the time which APNs requested to wait before sending again.
+func (r Result) Backoff() time.Duration {
+	return time.Duration(r.RetryAfter) * time.Second
+}
+
+// InvalidatedAt returns the time when APNs confirmed that the token was no longer valid.
+func (r Result) InvalidatedAt() time.Time {
+	if r.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.Timestamp*int64(time.Millisecond))
+}
+
 func (r Result) RecipientIdentifier() string {
 	return r.Token
 }
 
 func (r Result) ExtraKeys() []string {
-	return []string{"apns-id", "reason"}
+	return []string{"apns-id", "reason", "app"}
 }
 
 func (r Result) ExtraValue(key string) string {
@@ -36,6 +53,8 @@ func (r Result) ExtraValue(key string) string {
 		return r.APNsID
 	case "reason":
 		return r.Reason
+	case "app":
+		return r.App
 	}
 	return ""
 }
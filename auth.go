@@ -0,0 +1,235 @@
+package gunfish
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Request headers of HMAC signed requests
+const (
+	KeyNameHeader   = "X-Gunfish-Key-Name"
+	TimestampHeader = "X-Gunfish-Timestamp"
+	SignatureHeader = "X-Gunfish-Signature"
+)
+
+type callerKey struct{}
+
+// errBodyTooLarge is returned when the body of a signed request exceeds max_body_size.
+var errBodyTooLarge = errors.New("request body is too large")
+
+// CallerName returns the name of the authenticated caller of the request.
+func CallerName(ctx context.Context) string {
+	if name, ok := ctx.Value(callerKey{}).(string); ok {
+		return name
+	}
+	return ""
+}
+
+// authenticator verifies callers by static API keys or HMAC signatures.
+type authenticator struct {
+	apiKeys  []config.APIKey
+	hmacKeys map[string][]byte
+	maxSkew  time.Duration
+	maxBody  int64
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signatures which were used until the time
+	lastSweep time.Time
+}
+
+func newAuthenticator(conf config.SectionAuth) *authenticator {
+	if !conf.Enabled() {
+		return nil
+	}
+	a := &authenticator{
+		apiKeys:  conf.APIKeys,
+		hmacKeys: make(map[string][]byte, len(conf.HMACKeys)),
+		maxSkew:  conf.MaxClockSkew.Duration,
+		maxBody:  conf.MaxBodySize,
+		seen:     make(map[string]time.Time),
+	}
+	if a.maxSkew == 0 {
+		a.maxSkew = config.DefaultMaxClockSkew
+	}
+	if a.maxBody == 0 {
+		a.maxBody = config.DefaultMaxBodySize
+	}
+	for _, k := range conf.HMACKeys {
+		a.hmacKeys[k.Name] = []byte(k.Secret)
+	}
+	return a
+}
+
+// authenticate returns the key name of the caller.
+func (a *authenticator) authenticate(res http.ResponseWriter, req *http.Request, now time.Time) (string, error) {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return a.authenticateAPIKey(auth)
+	}
+	if req.Header.Get(SignatureHeader) != "" {
+		return a.authenticateHMAC(res, req, now)
+	}
+	return "", errors.New("credentials are required")
+}
+
+func (a *authenticator) authenticateAPIKey(auth string) (string, error) {
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+		return "", errors.New("invalid authorization scheme")
+	}
+	key := []byte(auth[len(prefix):])
+	name := ""
+	for _, k := range a.apiKeys {
+		if subtle.ConstantTimeCompare(key, []byte(k.Key)) == 1 {
+			name = k.Name
+		}
+	}
+	if name == "" {
+		return "", errors.New("invalid api key")
+	}
+	return name, nil
+}
+
+func (a *authenticator) authenticateHMAC(res http.ResponseWriter, req *http.Request, now time.Time) (string, error) {
+	name := req.Header.Get(KeyNameHeader)
+	secret, ok := a.hmacKeys[name]
+	if !ok {
+		return "", fmt.Errorf("unknown key name: %s", name)
+	}
+
+	ts := req.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp: %s", ts)
+	}
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-a.maxSkew)) || signedAt.After(now.Add(a.maxSkew)) {
+		return "", fmt.Errorf("timestamp is out of range: %s", ts)
+	}
+
+	// the body is read before the caller is verified, so that the size is limited
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, a.maxBody))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return "", errBodyTooLarge
+		}
+		return "", err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	sig, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil {
+		return "", errors.New("invalid signature format")
+	}
+	if !hmac.Equal(sig, SignRequest(secret, ts, req.Method, req.URL.RequestURI(), body)) {
+		return "", errors.New("signature mismatch")
+	}
+
+	// replay protection
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) > a.maxSkew {
+		for s, until := range a.seen {
+			if until.Before(now) {
+				delete(a.seen, s)
+			}
+		}
+		a.lastSweep = now
+	}
+	key := hex.EncodeToString(sig)
+	if _, ok := a.seen[key]; ok {
+		return "", errors.New("signature was already used")
+	}
+	a.seen[key] = signedAt.Add(a.maxSkew)
+
+	return name, nil
+}
+
+// SignRequest returns HMAC-SHA256 signature of the request.
+// The message is the timestamp, method, request URI and body joined with a newline.
+func SignRequest(secret []byte, timestamp, method, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp+"\n"+method+"\n"+uri+"\n")
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// AdminHandler authenticates callers of endpoints which change the state of Gunfish.
+// They are refused when authentication is not configured, for example after it was removed on reloading.
+func (prov *Provider) AdminHandler(h http.HandlerFunc) http.HandlerFunc {
+	authh := prov.AuthHandler(h)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if prov.current().auth == nil {
+			writeReason(res, http.StatusForbidden, "authentication is not configured")
+			return
+		}
+		authh(res, req)
+	})
+}
+
+// AuthHandler authenticates callers before calling h if authentication is configured.
+// Without authentication, callers can name themselves by the X-Gunfish-Caller header
+// with names in [[provider.quota.callers]]. Other names are ignored, so they are limited as one caller.
+func (prov *Provider) AuthHandler(h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		auth := prov.current().auth
+		if auth == nil {
+			name := req.Header.Get(CallerHeader)
+			if name != "" && !quotas.known(name) {
+				LogWithFields(logrus.Fields{
+					"type":   "provider",
+					"path":   req.URL.Path,
+					"remote": req.RemoteAddr,
+				}).Debugf("Ignored unknown caller name: %s", name)
+				name = ""
+			}
+			if name == "" {
+				h(res, req)
+				return
+			}
+			atomic.AddInt64(&(callerStats.get(name).RequestCount), 1)
+			h(res, req.WithContext(context.WithValue(req.Context(), callerKey{}, name)))
+			return
+		}
+		name, err := auth.authenticate(res, req, time.Now())
+		if err == errBodyTooLarge {
+			LogWithFields(logrus.Fields{
+				"type":   "provider",
+				"path":   req.URL.Path,
+				"remote": req.RemoteAddr,
+			}).Warnf("Authentication failed: %s", err)
+			writeReason(res, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&(srvStats.AuthFailureCount), 1)
+			LogWithFields(logrus.Fields{
+				"type":   "provider",
+				"path":   req.URL.Path,
+				"remote": req.RemoteAddr,
+			}).Warnf("Authentication failed: %s", err)
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			writeReason(res, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		atomic.AddInt64(&(callerStats.get(name).RequestCount), 1)
+		h(res, req.WithContext(context.WithValue(req.Context(), callerKey{}, name)))
+	})
+}
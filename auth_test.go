@@ -0,0 +1,190 @@
+package gunfish_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestAuthHandler(t *testing.T) {
+	c := conf
+	c.Provider.Auth = config.SectionAuth{
+		APIKeys:      []config.APIKey{{Name: "app", Key: "app-secret-key"}},
+		HMACKeys:     []config.HMACKey{{Name: "batch", Secret: "batch-secret"}},
+		MaxClockSkew: config.Duration{Duration: time.Minute},
+		MaxBodySize:  1024,
+	}
+	prov := gunfish.NewProvider(nil, c)
+
+	var caller string
+	handler := prov.AuthHandler(func(res http.ResponseWriter, req *http.Request) {
+		caller = gunfish.CallerName(req.Context())
+		res.WriteHeader(http.StatusOK)
+	})
+
+	signed := func(ts int64, secret string) *http.Request {
+		r, _ := http.NewRequest("POST", "/push/apns", nil)
+		r.Body = http.NoBody
+		timestamp := fmt.Sprintf("%d", ts)
+		sig := gunfish.SignRequest([]byte(secret), timestamp, "POST", "/push/apns", []byte{})
+		r.Header.Set(gunfish.KeyNameHeader, "batch")
+		r.Header.Set(gunfish.TimestampHeader, timestamp)
+		r.Header.Set(gunfish.SignatureHeader, hex.EncodeToString(sig))
+		return r
+	}
+
+	now := time.Now().Unix()
+	first := signed(now, "batch-secret")
+	testTable := []struct {
+		name   string
+		req    func() *http.Request
+		code   int
+		caller string
+	}{
+		{
+			name: "no credentials",
+			req: func() *http.Request {
+				r, _ := http.NewRequest("POST", "/push/apns", nil)
+				return r
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "valid api key",
+			req: func() *http.Request {
+				r, _ := http.NewRequest("POST", "/push/apns", nil)
+				r.Header.Set("Authorization", "Bearer app-secret-key")
+				return r
+			},
+			code:   http.StatusOK,
+			caller: "app",
+		},
+		{
+			name: "invalid api key",
+			req: func() *http.Request {
+				r, _ := http.NewRequest("POST", "/push/apns", nil)
+				r.Header.Set("Authorization", "Bearer wrong-key")
+				return r
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:   "valid signature",
+			req:    func() *http.Request { return first },
+			code:   http.StatusOK,
+			caller: "batch",
+		},
+		{
+			name: "replayed signature",
+			req:  func() *http.Request { return signed(now, "batch-secret") },
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid signature",
+			req:  func() *http.Request { return signed(now, "wrong-secret") },
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "expired timestamp",
+			req:  func() *http.Request { return signed(now-3600, "batch-secret") },
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "too large body",
+			req: func() *http.Request {
+				r := signed(now+1, "batch-secret")
+				r.Body = io.NopCloser(strings.NewReader(strings.Repeat("x", 2048)))
+				return r
+			},
+			code: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range testTable {
+		caller = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tt.req())
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status code is %d but got %d", tt.name, tt.code, w.Code)
+		}
+		if caller != tt.caller {
+			t.Errorf("%s: expected caller is %s but got %s", tt.name, tt.caller, caller)
+		}
+	}
+}
+
+func TestCallerHeader(t *testing.T) {
+	c := conf
+	c.Provider.Quota = config.SectionQuota{
+		Callers: []config.CallerQuota{{Name: "campaign", Weight: 2}},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := gunfish.NewProvider(sup, c)
+
+	var caller string
+	handler := prov.AuthHandler(func(res http.ResponseWriter, req *http.Request) {
+		caller = gunfish.CallerName(req.Context())
+		res.WriteHeader(http.StatusOK)
+	})
+	for name, expected := range map[string]string{
+		"campaign": "campaign",
+		"unknown":  "", // not configured
+		"":         "",
+	} {
+		caller = "-"
+		r, _ := http.NewRequest("POST", "/push/apns", nil)
+		r.Header.Set(gunfish.CallerHeader, name)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status code is 200 but got %d", name, w.Code)
+		}
+		if caller != expected {
+			t.Errorf("%s: expected caller is %q but got %q", name, expected, caller)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	handler := func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}
+
+	// refused without authentication
+	prov := gunfish.NewProvider(nil, conf)
+	r, _ := http.NewRequest("POST", "/admin/reload", nil)
+	w := httptest.NewRecorder()
+	prov.AdminHandler(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code is 403 but got %d", w.Code)
+	}
+
+	c := conf
+	c.Provider.Auth = config.SectionAuth{
+		APIKeys: []config.APIKey{{Name: "admin", Key: "admin-key"}},
+	}
+	prov = gunfish.NewProvider(nil, c)
+	w = httptest.NewRecorder()
+	prov.AdminHandler(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code is 401 but got %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer admin-key")
+	w = httptest.NewRecorder()
+	prov.AdminHandler(handler).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+package gunfish
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// drainRate estimates the rate of notifications taken from the supervisor's queues.
+type drainRate struct {
+	mu    sync.Mutex
+	rate  float64 // notifications per second, exponentially weighted
+	count int     // notifications taken in the current interval
+	start time.Time
+}
+
+func newDrainRate() *drainRate {
+	return &drainRate{start: time.Now()}
+}
+
+// add counts n notifications taken at now.
+func (d *drainRate) add(n int, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.update(now)
+	d.count += n
+}
+
+// get returns the estimated rate at now.
+func (d *drainRate) get(now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.update(now)
+	return d.rate
+}
+
+// update folds counts of finished intervals into the rate.
+func (d *drainRate) update(now time.Time) {
+	elapsed := now.Sub(d.start)
+	if elapsed < DrainRateInterval {
+		return
+	}
+	current := float64(d.count) / elapsed.Seconds()
+	// weights of past intervals decay by half in each interval
+	w := math.Pow(0.5, float64(elapsed/DrainRateInterval))
+	d.rate = d.rate*w + current*(1-w)
+	d.count = 0
+	d.start = now
+}
+
+// drainWait returns the time for callers to wait before posting again,
+// which is the time to send the backlog of the queues at the drain rate.
+func drainWait(backlog int, rate float64) time.Duration {
+	if backlog <= 0 {
+		return time.Second
+	}
+	if rate <= 0 {
+		return RetryAfterSecond
+	}
+	d := time.Duration(float64(backlog) / rate * float64(time.Second))
+	if d < time.Second {
+		return time.Second
+	}
+	if d > ResetRetryAfterSecond {
+		return ResetRetryAfterSecond
+	}
+	return d
+}
@@ -0,0 +1,84 @@
+package gunfish_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestEnqueueTimeout(t *testing.T) {
+	c := conf
+	c.Provider.WorkerNum = 1
+	c.Provider.QueueSize = config.MinQueueSize
+	c.Provider.EnqueueTimeout = config.Duration{Duration: 5 * time.Second}
+	// notifications to the unknown app fail without sending at the limited rate
+	c.RateLimit = config.SectionRateLimit{
+		Rules: []config.RateLimitRule{
+			{Provider: "apns", App: "backlog", Rate: 20000, Burst: 1},
+		},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	enqueue := func(n int) error {
+		reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", n)
+		for i := range reqs {
+			no := reqs[i].Notification.(apns.Notification)
+			no.App = "backlog"
+			reqs[i].Notification = no
+		}
+		_, err := sup.EnqueueClientRequest(&reqs)
+		return err
+	}
+	// a large batch over the worker's queue blocks the supervisor's queue until it is sent
+	backlog := func() {
+		if err := enqueue(20000); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < c.Provider.QueueSize; i++ {
+			if err := enqueue(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	backlog()
+	start := time.Now()
+	if err := enqueue(1); err != nil {
+		t.Fatalf("enqueue must wait for free space of the queue: %s", err)
+	}
+	if d := time.Since(start); d < 5*time.Millisecond {
+		t.Errorf("enqueue did not wait: %s", d)
+	}
+
+	// without waiting, the full queue responds 503 with Retry-After
+	c.Provider.EnqueueTimeout = config.Duration{}
+	if err := sup.Reload(&c); err != nil {
+		t.Fatal(err)
+	}
+	backlog()
+	r, err := newRequest(createJSONPostedData(1), "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	prov := &gunfish.Provider{Sup: sup}
+	prov.PushAPNsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	ra, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || ra < 1 || ra > int(gunfish.ResetRetryAfterSecond/time.Second) {
+		t.Errorf("unexpected Retry-After: %s", w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,283 @@
+package gunfish
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeliveryState is the state of a notification in a batch.
+type DeliveryState string
+
+// Delivery states
+const (
+	StateQueued    DeliveryState = "queued"
+	StateInFlight  DeliveryState = "in_flight"
+	StateRetrying  DeliveryState = "retrying"
+	StateDelivered DeliveryState = "delivered"
+	StateFailed    DeliveryState = "failed"
+	StateRejected  DeliveryState = "rejected"
+)
+
+// Batch tracks the results of notifications which were posted at once.
+type Batch struct {
+	ID         string
+	Caller     string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+
+	mu      sync.Mutex
+	entries []BatchEntry
+	remain  int
+	done    chan struct{}
+	quota   bool // notifications are counted in the quota of the caller
+}
+
+// BatchEntry is the delivery result of a notification in a batch.
+type BatchEntry struct {
+	Provider   string            `json:"provider"`
+	Token      string            `json:"token"`
+	State      DeliveryState     `json:"state"`
+	Done       bool              `json:"done"`
+	Status     int               `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
+	APNsID     string            `json:"apns-id,omitempty"`
+	Extra      map[string]string `json:"extra,omitempty"`
+	RetryCount int               `json:"retry_count"`
+}
+
+// BatchStatus is the response body of the status API.
+type BatchStatus struct {
+	BatchID    string       `json:"batch_id"`
+	Caller     string       `json:"caller,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Results    []BatchEntry `json:"results"`
+}
+
+// NewBatch creates a batch which tracks the results of reqs.
+func NewBatch(reqs []Request) *Batch {
+	b := &Batch{
+		ID:        uuid.NewV4().String(),
+		CreatedAt: time.Now(),
+		entries:   make([]BatchEntry, len(reqs)),
+		remain:    len(reqs),
+		done:      make(chan struct{}),
+	}
+	for i := range reqs {
+		reqs[i].batch = b
+		reqs[i].index = i
+		t := targetOf(reqs[i].Notification)
+		b.entries[i].Provider, b.entries[i].Token = t.Provider, t.Token
+		b.entries[i].State = StateQueued
+	}
+	if b.remain == 0 {
+		b.FinishedAt = b.CreatedAt
+		close(b.done)
+	}
+	return b
+}
+
+// Wait blocks until all of notifications in the batch have final results or the timeout passes.
+// It returns false when timed out.
+func (b *Batch) Wait(timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-b.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// WaitContext blocks until all of notifications in the batch have final results or the context is done.
+// It returns false when the context is done.
+func (b *Batch) WaitContext(ctx context.Context) bool {
+	select {
+	case <-b.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Entries returns a snapshot of results in the batch.
+func (b *Batch) Entries() []BatchEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := make([]BatchEntry, len(b.entries))
+	copy(entries, b.entries)
+	return entries
+}
+
+// Status returns a snapshot of the batch.
+func (b *Batch) Status() BatchStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BatchStatus{
+		BatchID:   b.ID,
+		Caller:    b.Caller,
+		CreatedAt: b.CreatedAt,
+		Results:   make([]BatchEntry, len(b.entries)),
+	}
+	if !b.FinishedAt.IsZero() {
+		t := b.FinishedAt
+		st.FinishedAt = &t
+	}
+	copy(st.Results, b.entries)
+	return st
+}
+
+func (b *Batch) finishedBefore(t time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.FinishedAt.IsZero() && b.FinishedAt.Before(t)
+}
+
+func (b *Batch) setState(i int, tries int, state DeliveryState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := &b.entries[i]
+	if e.Done {
+		return
+	}
+	e.State = state
+	e.RetryCount = tries
+}
+
+// reject finishes the notification which is not enqueued.
+func (b *Batch) reject(i int, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := &b.entries[i]
+	e.Done = true
+	e.State = StateRejected
+	e.Reason = reason
+	b.remain--
+	if b.remain == 0 {
+		b.FinishedAt = time.Now()
+		close(b.done)
+	}
+}
+
+// Rejected returns tokens of notifications which were rejected.
+func (b *Batch) Rejected() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var tokens []string
+	for _, e := range b.entries {
+		if e.State == StateRejected {
+			tokens = append(tokens, e.Token)
+		}
+	}
+	return tokens
+}
+
+func (b *Batch) finish(i int, tries int, result Result, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := &b.entries[i]
+	if e.Done {
+		return
+	}
+	e.Done = true
+	e.RetryCount = tries
+	if b.quota {
+		quotas.release(b.Caller, 1)
+	}
+	if result != nil {
+		e.Status = result.Status()
+		if rerr := result.Err(); rerr != nil {
+			e.Reason = rerr.Error()
+		}
+		for _, key := range result.ExtraKeys() {
+			v := result.ExtraValue(key)
+			switch {
+			case v == "", key == "reason":
+			case key == "apns-id":
+				e.APNsID = v
+			default:
+				if e.Extra == nil {
+					e.Extra = make(map[string]string)
+				}
+				e.Extra[key] = v
+			}
+		}
+	}
+	if e.Reason == "" && err != nil {
+		e.Reason = err.Error()
+	}
+	if result != nil && e.Reason == "" {
+		e.State = StateDelivered
+	} else {
+		e.State = StateFailed
+	}
+	b.remain--
+	if b.remain == 0 {
+		b.FinishedAt = time.Now()
+		close(b.done)
+	}
+}
+
+// batchStore holds batches until the retention period passes after they are finished,
+// or the max age passes after they are created.
+type batchStore struct {
+	mu        sync.RWMutex
+	batches   map[string]*Batch
+	retention time.Duration
+	maxAge    time.Duration
+}
+
+func newBatchStore(retention, maxAge time.Duration) *batchStore {
+	return &batchStore{
+		batches:   make(map[string]*Batch),
+		retention: retention,
+		maxAge:    maxAge,
+	}
+}
+
+func (bs *batchStore) add(b *Batch) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.batches[b.ID] = b
+}
+
+func (bs *batchStore) get(id string) (*Batch, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	b, ok := bs.batches[id]
+	return b, ok
+}
+
+// expire removes batches which were finished before the retention period, and batches older than the max age.
+// Notifications in removed batches which are not finished are still sent.
+func (bs *batchStore) expire(now time.Time) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	n := 0
+	for id, b := range bs.batches {
+		if b.finishedBefore(now.Add(-bs.retention)) || b.CreatedAt.Before(now.Add(-bs.maxAge)) {
+			delete(bs.batches, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Target describes the destination of a notification.
+type Target struct {
+	Provider string
+	App      string // name of the app or the project which sends the notification, if configured
+	Token    string
+	Topic    string
+}
+
+func targetOf(n Notification) Target {
+	if p := pushProviderOf(n); p != nil {
+		return p.Target(n)
+	}
+	return Target{}
+}
@@ -1,6 +1,6 @@
 package gunfish
 
-// Client interface for fcm and apns client
+// Client sends notifications to a push service. PushProvider.NewClient creates clients.
 type Client interface {
 	Send(Notification) ([]Result, error)
 }
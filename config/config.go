@@ -2,11 +2,19 @@ package config
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/kayac/Gunfish/fcmv1"
@@ -34,25 +42,160 @@ const (
 	DefaultPort = 8003
 	// Default supervisor's queue size. If not configures at file, this value is set.
 	DefaultQueueSize = 1000
+	// Default time to wait for results of notifications in the synchronous mode.
+	DefaultSyncTimeout = time.Second * 10
+	// Default time to keep results of finished batches for the status API.
+	DefaultStatusRetention = time.Minute * 10
+	// Default max time to keep batches for the status API, even if they are not finished.
+	DefaultStatusMaxAge = time.Hour * 24
+	// Default allowed clock skew of timestamps in HMAC signed requests.
+	DefaultMaxClockSkew = time.Minute * 5
+	// Default max byte size of bodies of HMAC signed requests, which are read before authentication.
+	DefaultMaxBodySize = 32 << 20
+	// Default fill ratio of queues which makes Gunfish not ready.
+	DefaultReadyQueueRatio = 0.9
+	// Default remaining time of the APNs certificate which makes Gunfish not ready.
+	DefaultReadyCertificateExpiry = time.Hour * 24 * 7
+	// Default count of consecutive credential failures which makes Gunfish not ready.
+	DefaultReadyFailureThreshold = 10
+	// Default size of the dead letter file to rotate it. (bytes)
+	DefaultDeadLetterMaxSize = 100 * 1024 * 1024
+	// Default number of rotated dead letter files to keep.
+	DefaultDeadLetterMaxBackups = 5
+	// Default number of results posted to a webhook at once.
+	DefaultWebhookBatchSize = 100
+	// Default interval to post results which do not fill a batch.
+	DefaultWebhookFlushInterval = time.Second
+	// Default timeout of a webhook request.
+	DefaultWebhookTimeout = time.Second * 10
+	// Default number of retries of a failed webhook request.
+	DefaultWebhookMaxRetries = 3
+	// Default number of concurrent webhook requests.
+	DefaultWebhookConcurrency = 4
+	// Default number of results waiting to be posted to a webhook.
+	DefaultWebhookQueueSize = 10000
+	// Default interval to invoke hooks with results which do not fill a batch.
+	DefaultHookFlushInterval = time.Second
+	// Default timeout of a hook invocation.
+	DefaultHookTimeout = time.Minute
+	// Default name of the priority class when no classes are configured.
+	DefaultPriorityName = "default"
+	// Default maximum number of sending a notification including the first one.
+	DefaultRetryMaxAttempts = 10
+	// Default backoff curve of retries.
+	DefaultRetryBackoff = BackoffExponential
+	// Default delay before the first retry.
+	DefaultRetryInitialDelay = time.Millisecond * 100
+	// Default maximum delay between retries.
+	DefaultRetryMaxDelay = time.Minute
+	// Default ratio of the random jitter added to retry delays.
+	DefaultRetryJitter = 0.2
+)
+
+// Scheduling of priority classes
+const (
+	SchedulingStrict   = "strict"   // sends notifications of higher classes first
+	SchedulingWeighted = "weighted" // sends notifications of classes in proportion to weights
+)
+
+// Backoff curves of retry delays
+const (
+	BackoffConstant    = "constant"    // initial_delay
+	BackoffLinear      = "linear"      // initial_delay * retries
+	BackoffExponential = "exponential" // initial_delay * 2^(retries-1)
 )
 
 // Config is the configure of an APNS provider server
 type Config struct {
-	Apns     SectionApns     `toml:"apns"`
-	Provider SectionProvider `toml:"provider"`
-	FCM      SectionFCM      `toml:"fcm"`
-	FCMv1    SectionFCMv1    `toml:"fcm_v1"`
+	Apns      SectionApns      `toml:"apns"`
+	Provider  SectionProvider  `toml:"provider"`
+	FCM       SectionFCM       `toml:"fcm"`
+	FCMv1     SectionFCMv1     `toml:"fcm_v1"`
+	WebPush   SectionWebPush   `toml:"webpush"`
+	Retry     SectionRetry     `toml:"retry"`
+	RateLimit SectionRateLimit `toml:"rate_limit"`
+
+	path string // file name which the configuration was loaded from
+}
+
+// Path returns the file name which the configuration was loaded from.
+func (c Config) Path() string {
+	return c.path
 }
 
 // SectionProvider is Gunfish provider configuration
 type SectionProvider struct {
-	WorkerNum        int `toml:"worker_num"`
-	QueueSize        int `toml:"queue_size"`
-	RequestQueueSize int `toml:"max_request_size"`
-	Port             int `toml:"port"`
-	DebugPort        int
-	MaxConnections   int    `toml:"max_connections"`
-	ErrorHook        string `toml:"error_hook"`
+	WorkerNum           int `toml:"worker_num"`
+	QueueSize           int `toml:"queue_size"`
+	RequestQueueSize    int `toml:"max_request_size"`
+	Port                int `toml:"port"`
+	DebugPort           int
+	MaxConnections      int                  `toml:"max_connections"`
+	ErrorHook           string               `toml:"error_hook"`
+	SuccessHook         string               `toml:"success_hook"`
+	IncludeNotification bool                 `toml:"include_notification"` // includes notifications in results for handlers and hooks
+	Hook                SectionHook          `toml:"hook"`
+	WAL                 SectionWAL           `toml:"wal"`
+	DeadLetter          SectionDeadLetter    `toml:"dead_letter"`
+	TokenRegistry       SectionTokenRegistry `toml:"token_registry"`
+	SyncTimeout         Duration             `toml:"sync_timeout"`
+	EnqueueTimeout      Duration             `toml:"enqueue_timeout"` // time to wait for free space of the queue. 0 means not to wait
+	StatusRetention     Duration             `toml:"status_retention"`
+	StatusMaxAge        Duration             `toml:"status_max_age"` // max time to keep batches which are not finished
+	Auth                SectionAuth          `toml:"auth"`
+	Readiness           SectionReadiness     `toml:"readiness"`
+	Priority            SectionPriority      `toml:"priority"`
+	Quota               SectionQuota         `toml:"quota"`
+	ErrorWebhook        SectionWebhook       `toml:"error_webhook"`
+	SuccessWebhook      SectionWebhook       `toml:"success_webhook"`
+}
+
+// SectionReadiness is the configuration of the readiness check
+type SectionReadiness struct {
+	QueueRatio        float64  `toml:"queue_ratio"`
+	CertificateExpiry Duration `toml:"certificate_expiry"`
+	FailureThreshold  int      `toml:"failure_threshold"`
+	DrainGracePeriod  Duration `toml:"drain_grace_period"` // time to keep accepting requests while /readyz reports draining
+}
+
+// SectionAuth is the configuration of caller authentication
+type SectionAuth struct {
+	APIKeys      []APIKey  `toml:"api_keys"`
+	HMACKeys     []HMACKey `toml:"hmac_keys"`
+	MaxClockSkew Duration  `toml:"max_clock_skew"`
+	MaxBodySize  int64     `toml:"max_body_size"`
+}
+
+// APIKey is a static bearer API key
+type APIKey struct {
+	Name string `toml:"name"`
+	Key  string `toml:"key"`
+}
+
+// HMACKey is a shared secret to sign requests
+type HMACKey struct {
+	Name   string `toml:"name"`
+	Secret string `toml:"secret"`
+}
+
+// Enabled returns true when any key is configured.
+func (a SectionAuth) Enabled() bool {
+	return len(a.APIKeys) > 0 || len(a.HMACKeys) > 0
+}
+
+// Duration is time.Duration which is decoded from a string like "10s" in the toml file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration string.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
 }
 
 // SectionApns is the configure which is loaded from gunfish.toml
@@ -64,6 +207,53 @@ type SectionApns struct {
 	TeamID              string `toml:"team_id"`
 	CertificateNotAfter time.Time
 	Enabled             bool
+	Apps                []SectionApnsApp `toml:"apps"`
+}
+
+// SectionApnsApp is the credential of an app which is identified by the name
+type SectionApnsApp struct {
+	Name                string   `toml:"name"`
+	CertFile            string   `toml:"cert_file"`
+	KeyFile             string   `toml:"key_file"`
+	Kid                 string   `toml:"kid"`
+	TeamID              string   `toml:"team_id"`
+	Topics              []string `toml:"topics"` // bundle IDs of the app
+	CertificateNotAfter time.Time
+}
+
+// DefaultApnsAppName is the name of the app which has the credential at the top level of [apns].
+const DefaultApnsAppName = "default"
+
+func (a SectionApnsApp) hasCredential() bool {
+	return (a.CertFile != "" && a.KeyFile != "") || (a.TeamID != "" && a.Kid != "")
+}
+
+// AllApps returns all of the apps. The credential at the top level of [apns] is the app named "default".
+func (c SectionApns) AllApps() []SectionApnsApp {
+	var apps []SectionApnsApp
+	def := SectionApnsApp{
+		Name:                DefaultApnsAppName,
+		CertFile:            c.CertFile,
+		KeyFile:             c.KeyFile,
+		Kid:                 c.Kid,
+		TeamID:              c.TeamID,
+		CertificateNotAfter: c.CertificateNotAfter,
+	}
+	if def.hasCredential() {
+		apps = append(apps, def)
+	}
+	return append(apps, c.Apps...)
+}
+
+// ForApp returns the configuration which has the credential of the app.
+func (c SectionApns) ForApp(app SectionApnsApp) SectionApns {
+	c.CertFile = app.CertFile
+	c.KeyFile = app.KeyFile
+	c.Kid = app.Kid
+	c.TeamID = app.TeamID
+	c.CertificateNotAfter = app.CertificateNotAfter
+	c.Apps = nil
+	return c
 }
 
 // SectionFCM is the configuration of fcm
@@ -79,6 +269,51 @@ type SectionFCMv1 struct {
 	ProjectID                    string
 	TokenSource                  oauth2.TokenSource
 	Endpoint                     string
+	Projects                     []SectionFCMv1Project `toml:"projects"`
+}
+
+// SectionFCMv1Project is the service account of a Firebase project which is identified by the name
+type SectionFCMv1Project struct {
+	Name                         string `toml:"name"`
+	GoogleApplicationCredentials string `toml:"google_application_credentials"`
+	ProjectID                    string
+	TokenSource                  oauth2.TokenSource
+}
+
+// DefaultFCMv1ProjectName is the name of the project which is configured at the top level of [fcm_v1].
+const DefaultFCMv1ProjectName = "default"
+
+// AllProjects returns all of the projects. The project at the top level of [fcm_v1] is the project named "default".
+func (c SectionFCMv1) AllProjects() []SectionFCMv1Project {
+	var projects []SectionFCMv1Project
+	if c.ProjectID != "" {
+		projects = append(projects, SectionFCMv1Project{
+			Name:                         DefaultFCMv1ProjectName,
+			GoogleApplicationCredentials: c.GoogleApplicationCredentials,
+			ProjectID:                    c.ProjectID,
+			TokenSource:                  c.TokenSource,
+		})
+	}
+	return append(projects, c.Projects...)
+}
+
+// ForProject returns the configuration which has the service account of the project.
+func (c SectionFCMv1) ForProject(project SectionFCMv1Project) SectionFCMv1 {
+	c.GoogleApplicationCredentials = project.GoogleApplicationCredentials
+	c.ProjectID = project.ProjectID
+	c.TokenSource = project.TokenSource
+	c.Projects = nil
+	return c
+}
+
+// SectionWebPush is the configuration of Web Push
+type SectionWebPush struct {
+	VAPIDPrivateKey string   `toml:"vapid_private_key"` // base64url encoded P-256 private key
+	VAPIDKeyFile    string   `toml:"vapid_key_file"`    // PEM file of a P-256 private key
+	Subject         string   `toml:"subject"`           // mailto: or https: URL to contact
+	AllowedHosts    []string `toml:"allowed_hosts"`     // hosts of push services. Empty means the default push services of browsers.
+	Enabled         bool
+	PrivateKey      *ecdsa.PrivateKey
 }
 
 // DefaultLoadConfig loads default /etc/gunfish.toml
@@ -93,6 +328,7 @@ func LoadConfig(fn string) (Config, error) {
 	if err := goconf.LoadWithEnvTOML(&config, fn); err != nil {
 		return config, err
 	}
+	config.path = fn
 
 	// if not set parameters, set default value.
 	if config.Provider.RequestQueueSize == 0 {
@@ -107,6 +343,39 @@ func LoadConfig(fn string) (Config, error) {
 		config.Provider.Port = DefaultPort
 	}
 
+	if config.Provider.SyncTimeout.Duration == 0 {
+		config.Provider.SyncTimeout.Duration = DefaultSyncTimeout
+	}
+
+	if config.Provider.StatusRetention.Duration == 0 {
+		config.Provider.StatusRetention.Duration = DefaultStatusRetention
+	}
+
+	if config.Provider.StatusMaxAge.Duration == 0 {
+		config.Provider.StatusMaxAge.Duration = DefaultStatusMaxAge
+	}
+
+	if config.Provider.Auth.MaxClockSkew.Duration == 0 {
+		config.Provider.Auth.MaxClockSkew.Duration = DefaultMaxClockSkew
+	}
+
+	if config.Provider.Auth.MaxBodySize == 0 {
+		config.Provider.Auth.MaxBodySize = DefaultMaxBodySize
+	}
+
+	config.Provider.Readiness.setDefaults()
+	config.Provider.Hook.setDefaults()
+	config.Provider.ErrorWebhook.setDefaults()
+	config.Provider.SuccessWebhook.setDefaults()
+
+	if config.Provider.DeadLetter.MaxSize == 0 {
+		config.Provider.DeadLetter.MaxSize = DefaultDeadLetterMaxSize
+	}
+
+	if config.Provider.DeadLetter.MaxBackups == 0 {
+		config.Provider.DeadLetter.MaxBackups = DefaultDeadLetterMaxBackups
+	}
+
 	// validates config parameters
 	if err := (&config).validateConfig(); err != nil {
 		return config, errors.Wrap(err, "validate config failed")
@@ -119,7 +388,13 @@ func (c *Config) validateConfig() error {
 	if err := c.validateConfigProvider(); err != nil {
 		return errors.Wrap(err, "[provider]")
 	}
-	if (c.Apns.CertFile != "" && c.Apns.KeyFile != "") || (c.Apns.TeamID != "" && c.Apns.Kid != "") {
+	if err := c.validateConfigRetry(); err != nil {
+		return errors.Wrap(err, "[retry]")
+	}
+	if err := c.validateConfigRateLimit(); err != nil {
+		return errors.Wrap(err, "[rate_limit]")
+	}
+	if (c.Apns.CertFile != "" && c.Apns.KeyFile != "") || (c.Apns.TeamID != "" && c.Apns.Kid != "") || len(c.Apns.Apps) > 0 {
 		c.Apns.Enabled = true
 		if err := c.validateConfigAPNs(); err != nil {
 			return errors.Wrap(err, "[apns]")
@@ -128,12 +403,18 @@ func (c *Config) validateConfig() error {
 	if c.FCM.APIKey != "" {
 		return errors.New("[fcm] legacy is not supported anymore. Please use [fcm_v1]")
 	}
-	if c.FCMv1.GoogleApplicationCredentials != "" {
+	if c.FCMv1.GoogleApplicationCredentials != "" || len(c.FCMv1.Projects) > 0 {
 		c.FCMv1.Enabled = true
 		if err := c.validateConfigFCMv1(); err != nil {
 			return errors.Wrap(err, "[fcm_v1]")
 		}
 	}
+	if c.WebPush.VAPIDPrivateKey != "" || c.WebPush.VAPIDKeyFile != "" {
+		c.WebPush.Enabled = true
+		if err := c.validateConfigWebPush(); err != nil {
+			return errors.Wrap(err, "[webpush]")
+		}
+	}
 	return nil
 }
 
@@ -153,54 +434,645 @@ func (c *Config) validateConfigProvider() error {
 			MinWorkerNum, MaxWorkerNum)
 	}
 
+	if c.Provider.SyncTimeout.Duration < 0 {
+		return fmt.Errorf("SyncTimeout must not be negative: %s", c.Provider.SyncTimeout)
+	}
+
+	if c.Provider.EnqueueTimeout.Duration < 0 {
+		return fmt.Errorf("EnqueueTimeout must not be negative: %s", c.Provider.EnqueueTimeout)
+	}
+
+	if c.Provider.StatusRetention.Duration < 0 {
+		return fmt.Errorf("StatusRetention must not be negative: %s", c.Provider.StatusRetention)
+	}
+
+	if c.Provider.StatusMaxAge.Duration < 0 {
+		return fmt.Errorf("StatusMaxAge must not be negative: %s", c.Provider.StatusMaxAge)
+	}
+
+	if err := c.Provider.Auth.validate(); err != nil {
+		return errors.Wrap(err, "[auth]")
+	}
+
+	if err := c.Provider.Hook.validate(); err != nil {
+		return errors.Wrap(err, "[hook]")
+	}
+
+	if err := c.Provider.ErrorWebhook.validate(); err != nil {
+		return errors.Wrap(err, "[error_webhook]")
+	}
+	if err := c.Provider.SuccessWebhook.validate(); err != nil {
+		return errors.Wrap(err, "[success_webhook]")
+	}
+
+	if d := c.Provider.DeadLetter; d.MaxSize < 0 || d.MaxBackups < 0 {
+		return fmt.Errorf("[dead_letter] MaxSize and MaxBackups must not be negative: %d, %d", d.MaxSize, d.MaxBackups)
+	}
+
+	if err := c.validateConfigPriority(); err != nil {
+		return errors.Wrap(err, "[priority]")
+	}
+	if err := c.validateConfigQuota(); err != nil {
+		return errors.Wrap(err, "[quota]")
+	}
+	if r := c.Provider.Readiness; r.QueueRatio <= 0 || r.QueueRatio > 1 {
+		return fmt.Errorf("[readiness] QueueRatio was out of available range: %f. (0-1)", r.QueueRatio)
+	}
+	if r := c.Provider.TokenRegistry; r.TTL.Duration < 0 {
+		return fmt.Errorf("[token_registry] ttl must not be negative: %s", r.TTL.Duration)
+	}
+	if r := c.Provider.Readiness; r.DrainGracePeriod.Duration < 0 {
+		return fmt.Errorf("[readiness] drain_grace_period must not be negative: %s", r.DrainGracePeriod.Duration)
+	}
+
+	return nil
+}
+
+func (r *SectionReadiness) setDefaults() {
+	if r.QueueRatio == 0 {
+		r.QueueRatio = DefaultReadyQueueRatio
+	}
+	if r.CertificateExpiry.Duration == 0 {
+		r.CertificateExpiry.Duration = DefaultReadyCertificateExpiry
+	}
+	if r.FailureThreshold == 0 {
+		r.FailureThreshold = DefaultReadyFailureThreshold
+	}
+}
+
+// SectionWAL is the configuration of the write-ahead log of accepted notifications
+type SectionWAL struct {
+	Dir string `toml:"dir"` // directory of log files. empty disables the write-ahead log
+}
+
+// SectionDeadLetter is the configuration of the dead letter store
+type SectionDeadLetter struct {
+	File       string `toml:"file"`        // JSON lines file of dead letters. empty disables the store
+	MaxSize    int64  `toml:"max_size"`    // bytes to rotate the file
+	MaxBackups int    `toml:"max_backups"` // number of rotated files to keep
+}
+
+// SectionTokenRegistry is the configuration of the registry of invalid tokens
+type SectionTokenRegistry struct {
+	File string   `toml:"file"` // JSON lines file of invalid tokens. empty disables the registry
+	TTL  Duration `toml:"ttl"`  // time for tokens to be valid again after they were invalidated. 0 means never
+}
+
+// SectionHook is the configuration of invocations of the error and success hooks
+type SectionHook struct {
+	BatchSize     int      `toml:"batch_size"`     // max number of results in an invocation. 0 or 1 invokes hooks for each result
+	FlushInterval Duration `toml:"flush_interval"` // max time for results to wait for a batch
+	Timeout       Duration `toml:"timeout"`
+	MaxRetries    int      `toml:"max_retries"` // retries of an invocation which failed or timed out
+}
+
+func (h *SectionHook) setDefaults() {
+	if h.BatchSize == 0 {
+		h.BatchSize = 1
+	}
+	if h.FlushInterval.Duration == 0 {
+		h.FlushInterval.Duration = DefaultHookFlushInterval
+	}
+	if h.Timeout.Duration == 0 {
+		h.Timeout.Duration = DefaultHookTimeout
+	}
+}
+
+// WithDefaults returns the configuration which has default values for unset parameters.
+func (h SectionHook) WithDefaults() SectionHook {
+	h.setDefaults()
+	return h
+}
+
+func (h SectionHook) validate() error {
+	if h.BatchSize < 0 || h.MaxRetries < 0 {
+		return fmt.Errorf("batch_size and max_retries must not be negative")
+	}
+	if h.FlushInterval.Duration < 0 || h.Timeout.Duration < 0 {
+		return fmt.Errorf("flush_interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// SectionWebhook is the configuration of a webhook which receives results of notifications
+type SectionWebhook struct {
+	URL           string   `toml:"url"`            // empty disables the webhook
+	Secret        string   `toml:"secret"`         // HMAC-SHA256 key to sign requests. empty means not to sign
+	BatchSize     int      `toml:"batch_size"`     // max number of results in a request
+	FlushInterval Duration `toml:"flush_interval"` // max time for results to wait for a batch
+	Timeout       Duration `toml:"timeout"`
+	MaxRetries    int      `toml:"max_retries"`
+	Concurrency   int      `toml:"concurrency"` // max number of concurrent requests
+	QueueSize     int      `toml:"queue_size"`  // max number of results waiting to be posted
+}
+
+func (w *SectionWebhook) setDefaults() {
+	if w.BatchSize == 0 {
+		w.BatchSize = DefaultWebhookBatchSize
+	}
+	if w.FlushInterval.Duration == 0 {
+		w.FlushInterval.Duration = DefaultWebhookFlushInterval
+	}
+	if w.Timeout.Duration == 0 {
+		w.Timeout.Duration = DefaultWebhookTimeout
+	}
+	if w.MaxRetries == 0 {
+		w.MaxRetries = DefaultWebhookMaxRetries
+	}
+	if w.Concurrency == 0 {
+		w.Concurrency = DefaultWebhookConcurrency
+	}
+	if w.QueueSize == 0 {
+		w.QueueSize = DefaultWebhookQueueSize
+	}
+}
+
+// WithDefaults returns the configuration which has default values for unset parameters.
+func (w SectionWebhook) WithDefaults() SectionWebhook {
+	w.setDefaults()
+	return w
+}
+
+func (w SectionWebhook) validate() error {
+	if w.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: %s", w.URL)
+	}
+	if w.BatchSize < 0 || w.MaxRetries < 0 || w.Concurrency < 0 || w.QueueSize < 0 {
+		return fmt.Errorf("batch_size, max_retries, concurrency and queue_size must not be negative")
+	}
+	if w.FlushInterval.Duration < 0 || w.Timeout.Duration < 0 {
+		return fmt.Errorf("flush_interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// SectionPriority is the configuration of priority classes
+type SectionPriority struct {
+	Scheduling string          `toml:"scheduling"` // strict or weighted
+	Default    string          `toml:"default"`    // class of notifications which do not specify it
+	Classes    []PriorityClass `toml:"classes"`    // from the highest priority
+}
+
+// PriorityClass is a class of notifications which has its own queue.
+type PriorityClass struct {
+	Name           string   `toml:"name"`
+	QueueSize      int      `toml:"queue_size"`
+	Weight         int      `toml:"weight"`
+	ApnsPriorities []string `toml:"apns_priorities"` // apns-priority header values which select the class
+}
+
+// AllClasses returns priority classes which have default values for unset parameters.
+// It returns the default class which has queueSize when no classes are configured.
+func (p SectionPriority) AllClasses(queueSize int) []PriorityClass {
+	if len(p.Classes) == 0 {
+		return []PriorityClass{{Name: DefaultPriorityName, QueueSize: queueSize, Weight: 1}}
+	}
+	classes := make([]PriorityClass, len(p.Classes))
+	for i, class := range p.Classes {
+		if class.QueueSize == 0 {
+			class.QueueSize = queueSize
+		}
+		if class.Weight == 0 {
+			class.Weight = 1
+		}
+		classes[i] = class
+	}
+	return classes
+}
+
+// DefaultClass returns the name of the class of notifications which do not specify it.
+// It is the lowest class unless default is set.
+func (p SectionPriority) DefaultClass() string {
+	if p.Default != "" {
+		return p.Default
+	}
+	if len(p.Classes) == 0 {
+		return DefaultPriorityName
+	}
+	return p.Classes[len(p.Classes)-1].Name
+}
+
+func (c *Config) validateConfigPriority() error {
+	p := c.Provider.Priority
+	switch p.Scheduling {
+	case "", SchedulingStrict, SchedulingWeighted:
+	default:
+		return fmt.Errorf("scheduling must be strict or weighted: %s", p.Scheduling)
+	}
+	names := make(map[string]bool, len(p.Classes))
+	apnsPriorities := make(map[string]string)
+	for i, class := range p.AllClasses(c.Provider.QueueSize) {
+		if class.Name == "" {
+			return fmt.Errorf("classes[%d]: name is required", i)
+		}
+		if names[class.Name] {
+			return fmt.Errorf("classes[%d]: name %s is duplicated", i, class.Name)
+		}
+		names[class.Name] = true
+		if class.QueueSize < MinQueueSize || class.QueueSize > MaxQueueSize {
+			return fmt.Errorf("classes[%d]: queue_size was out of available range: %d. (%d-%d)", i, class.QueueSize,
+				MinQueueSize, MaxQueueSize)
+		}
+		if class.Weight < 0 {
+			return fmt.Errorf("classes[%d]: weight must not be negative: %d", i, class.Weight)
+		}
+		for _, v := range class.ApnsPriorities {
+			if other, ok := apnsPriorities[v]; ok {
+				return fmt.Errorf("classes[%d]: apns_priorities %s is also used by %s", i, v, other)
+			}
+			apnsPriorities[v] = class.Name
+		}
+	}
+	if !names[p.DefaultClass()] {
+		return fmt.Errorf("default class %s is not defined", p.DefaultClass())
+	}
+	return nil
+}
+
+// SectionQuota is the configuration of quotas of callers
+type SectionQuota struct {
+	MaxQueued int           `toml:"max_queued"` // notifications of each caller in queues. 0 means unlimited
+	Callers   []CallerQuota `toml:"callers"`
+}
+
+// CallerQuota is the quota of a caller which overrides the default
+type CallerQuota struct {
+	Name      string `toml:"name"`       // name of the caller
+	MaxQueued int    `toml:"max_queued"` // 0 means the default
+	Weight    int    `toml:"weight"`     // share of sending between callers. 0 means 1
+}
+
+// Caller returns the quota of the caller which has default values for unset parameters.
+func (q SectionQuota) Caller(name string) CallerQuota {
+	cq := CallerQuota{Name: name}
+	for _, c := range q.Callers {
+		if c.Name == name {
+			cq = c
+			break
+		}
+	}
+	if cq.MaxQueued == 0 {
+		cq.MaxQueued = q.MaxQueued
+	}
+	if cq.Weight == 0 {
+		cq.Weight = 1
+	}
+	return cq
+}
+
+func (c *Config) validateConfigQuota() error {
+	q := c.Provider.Quota
+	if q.MaxQueued < 0 {
+		return fmt.Errorf("max_queued must not be negative: %d", q.MaxQueued)
+	}
+	names := make(map[string]bool, len(q.Callers))
+	for i, cq := range q.Callers {
+		if cq.Name == "" {
+			return fmt.Errorf("callers[%d]: name is required", i)
+		}
+		if names[cq.Name] {
+			return fmt.Errorf("callers[%d]: name %s is duplicated", i, cq.Name)
+		}
+		names[cq.Name] = true
+		if cq.MaxQueued < 0 || cq.Weight < 0 {
+			return fmt.Errorf("callers[%d]: max_queued and weight must not be negative: %d, %d", i, cq.MaxQueued, cq.Weight)
+		}
+	}
+	return nil
+}
+
+// SectionRateLimit is the configuration of outbound rate limits
+type SectionRateLimit struct {
+	Rate  int             `toml:"rate"`  // notifications per second of all providers. 0 means unlimited
+	Burst int             `toml:"burst"` // maximum notifications sent at once. 0 means the same as rate
+	Rules []RateLimitRule `toml:"rules"`
+}
+
+// RateLimitRule is a rate limit of notifications which match the provider, the app and the topic.
+// Empty app and topic match any.
+type RateLimitRule struct {
+	Provider string `toml:"provider"`
+	App      string `toml:"app"`   // APNs app or FCM project
+	Topic    string `toml:"topic"` // apns-topic or topic of the FCM message
+	Rate     int    `toml:"rate"`
+	Burst    int    `toml:"burst"`
+}
+
+func (c *Config) validateConfigRateLimit() error {
+	r := c.RateLimit
+	if r.Rate < 0 || r.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative: %d, %d", r.Rate, r.Burst)
+	}
+	for i, rule := range r.Rules {
+		if rule.Provider == "" {
+			return fmt.Errorf("rules[%d]: provider is required", i)
+		}
+		if rule.Rate <= 0 || rule.Burst < 0 {
+			return fmt.Errorf("rules[%d]: rate must be greater than 0 and burst must not be negative: %d, %d", i, rule.Rate, rule.Burst)
+		}
+	}
+	return nil
+}
+
+// SectionRetry is the configuration of retry policies keyed by the provider name. (e.g. "apns", "fcmv1")
+// The policy of "default" applies to all providers.
+type SectionRetry map[string]RetryPolicy
+
+// RetryPolicy is the configuration of retries. Unset parameters inherit from the less specific policy.
+type RetryPolicy struct {
+	Retry        *bool                  `toml:"retry"`         // retries or not regardless of the provider's decision
+	MaxAttempts  *int                   `toml:"max_attempts"`  // maximum number of sending a notification including the first one
+	Backoff      *string                `toml:"backoff"`       // constant, linear or exponential
+	InitialDelay *Duration              `toml:"initial_delay"` // delay before the first retry
+	MaxDelay     *Duration              `toml:"max_delay"`     // maximum delay between retries
+	Jitter       *float64               `toml:"jitter"`        // ratio of the random jitter added to delays (0-1)
+	Reasons      map[string]RetryPolicy `toml:"reasons"`       // policies keyed by the error reason
+}
+
+// Merge returns the policy which parameters set in o override. Reasons are not merged.
+func (p RetryPolicy) Merge(o RetryPolicy) RetryPolicy {
+	if o.Retry != nil {
+		p.Retry = o.Retry
+	}
+	if o.MaxAttempts != nil {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.Backoff != nil {
+		p.Backoff = o.Backoff
+	}
+	if o.InitialDelay != nil {
+		p.InitialDelay = o.InitialDelay
+	}
+	if o.MaxDelay != nil {
+		p.MaxDelay = o.MaxDelay
+	}
+	if o.Jitter != nil {
+		p.Jitter = o.Jitter
+	}
+	p.Reasons = nil
+	return p
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts != nil && *p.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be greater than 0: %d", *p.MaxAttempts)
+	}
+	if p.Backoff != nil {
+		switch *p.Backoff {
+		case BackoffConstant, BackoffLinear, BackoffExponential:
+		default:
+			return fmt.Errorf("backoff must be constant, linear or exponential: %s", *p.Backoff)
+		}
+	}
+	if p.InitialDelay != nil && p.InitialDelay.Duration < 0 {
+		return fmt.Errorf("initial_delay must not be negative: %s", p.InitialDelay)
+	}
+	if p.MaxDelay != nil && p.MaxDelay.Duration < 0 {
+		return fmt.Errorf("max_delay must not be negative: %s", p.MaxDelay)
+	}
+	if p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1) {
+		return fmt.Errorf("jitter was out of available range: %f. (0-1)", *p.Jitter)
+	}
+	return nil
+}
+
+func (c *Config) validateConfigRetry() error {
+	for name, policy := range c.Retry {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		for reason, p := range policy.Reasons {
+			if len(p.Reasons) > 0 {
+				return fmt.Errorf("%s.reasons.%s: reasons can not be nested", name, reason)
+			}
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("%s.reasons.%s: %s", name, reason, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WithDefaults returns the configuration which has default values for unset parameters.
+func (r SectionReadiness) WithDefaults() SectionReadiness {
+	r.setDefaults()
+	return r
+}
+
+func (a SectionAuth) validate() error {
+	names := make(map[string]bool)
+	for _, k := range a.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return fmt.Errorf("name and key of api_keys are required")
+		}
+		if names[k.Name] {
+			return fmt.Errorf("duplicated key name: %s", k.Name)
+		}
+		names[k.Name] = true
+	}
+	for _, k := range a.HMACKeys {
+		if k.Name == "" || k.Secret == "" {
+			return fmt.Errorf("name and secret of hmac_keys are required")
+		}
+		if names[k.Name] {
+			return fmt.Errorf("duplicated key name: %s", k.Name)
+		}
+		names[k.Name] = true
+	}
+	if a.MaxClockSkew.Duration < 0 {
+		return fmt.Errorf("MaxClockSkew must not be negative: %s", a.MaxClockSkew)
+	}
+	if a.MaxBodySize < 0 {
+		return fmt.Errorf("MaxBodySize must not be negative: %d", a.MaxBodySize)
+	}
 	return nil
 }
 
 func (c *Config) validateConfigFCMv1() error {
-	b, err := os.ReadFile(c.FCMv1.GoogleApplicationCredentials)
+	if c.FCMv1.GoogleApplicationCredentials != "" {
+		projectID, ts, err := loadServiceAccount(c.FCMv1.GoogleApplicationCredentials)
+		if err != nil {
+			return err
+		}
+		c.FCMv1.ProjectID = projectID
+		c.FCMv1.TokenSource = ts
+	}
+
+	names := map[string]bool{DefaultFCMv1ProjectName: c.FCMv1.ProjectID != ""}
+	for i := range c.FCMv1.Projects {
+		project := &c.FCMv1.Projects[i]
+		if project.Name == "" {
+			return fmt.Errorf("projects[%d]: name is required", i)
+		}
+		if names[project.Name] {
+			return fmt.Errorf("projects[%d]: name %s is duplicated", i, project.Name)
+		}
+		names[project.Name] = true
+		if project.GoogleApplicationCredentials == "" {
+			return fmt.Errorf("projects[%d]: google_application_credentials is required", i)
+		}
+		projectID, ts, err := loadServiceAccount(project.GoogleApplicationCredentials)
+		if err != nil {
+			return fmt.Errorf("projects[%d]: %s", i, err)
+		}
+		project.ProjectID = projectID
+		project.TokenSource = ts
+	}
+	return nil
+}
+
+// loadServiceAccount reads the service account json and returns the project ID and the token source.
+func loadServiceAccount(fn string) (string, oauth2.TokenSource, error) {
+	b, err := os.ReadFile(fn)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 	serviceAccount := make(map[string]string)
 	if err := json.Unmarshal(b, &serviceAccount); err != nil {
-		return err
+		return "", nil, err
 	}
-	if projectID := serviceAccount["project_id"]; projectID != "" {
-		c.FCMv1.ProjectID = projectID
-	} else {
-		return fmt.Errorf("invalid service account json: %s project_id is not defined", c.FCMv1.GoogleApplicationCredentials)
+	projectID := serviceAccount["project_id"]
+	if projectID == "" {
+		return "", nil, fmt.Errorf("invalid service account json: %s project_id is not defined", fn)
 	}
 
 	conf, err := google.JWTConfigFromJSON(b, fcmv1.Scope)
+	if err != nil {
+		return "", nil, err
+	}
+	return projectID, conf.TokenSource(context.Background()), nil
+}
+
+func (c *Config) validateConfigAPNs() error {
+	names := map[string]bool{DefaultApnsAppName: c.Apns.CertFile != "" || c.Apns.Kid != ""}
+	topics := make(map[string]string)
+	for i := range c.Apns.Apps {
+		app := &c.Apns.Apps[i]
+		if app.Name == "" {
+			return fmt.Errorf("apps[%d]: name is required", i)
+		}
+		if names[app.Name] {
+			return fmt.Errorf("apps[%d]: name %s is duplicated", i, app.Name)
+		}
+		names[app.Name] = true
+		if !app.hasCredential() {
+			return fmt.Errorf("apps[%d]: cert_file and key_file, or kid and team_id are required", i)
+		}
+		for _, topic := range app.Topics {
+			if other, ok := topics[topic]; ok {
+				return fmt.Errorf("apps[%d]: topic %s is also used by %s", i, topic, other)
+			}
+			topics[topic] = app.Name
+		}
+		notAfter, err := validateCertificate(app.CertFile, app.KeyFile)
+		if err != nil {
+			return fmt.Errorf("apps[%d]: %s", i, err)
+		}
+		app.CertificateNotAfter = notAfter
+	}
+
+	notAfter, err := validateCertificate(c.Apns.CertFile, c.Apns.KeyFile)
 	if err != nil {
 		return err
 	}
-	c.FCMv1.TokenSource = conf.TokenSource(context.Background())
+	c.Apns.CertificateNotAfter = notAfter
 
-	return err
+	// holds minimum not after of all apps
+	for _, app := range c.Apns.Apps {
+		if app.CertificateNotAfter.IsZero() {
+			continue
+		}
+		if c.Apns.CertificateNotAfter.IsZero() || app.CertificateNotAfter.Before(c.Apns.CertificateNotAfter) {
+			c.Apns.CertificateNotAfter = app.CertificateNotAfter
+		}
+	}
+	return nil
 }
 
-func (c *Config) validateConfigAPNs() error {
-	if c.Apns.CertFile != "" && c.Apns.KeyFile != "" {
-		// check certificate files and expiration
-		cert, err := tls.LoadX509KeyPair(c.Apns.CertFile, c.Apns.KeyFile)
+// validateCertificate checks certificate files and returns the expiration.
+func validateCertificate(certFile, keyFile string) (time.Time, error) {
+	var notAfter time.Time
+	if certFile == "" || keyFile == "" {
+		return notAfter, nil
+	}
+	// check certificate files and expiration
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return notAfter, fmt.Errorf("Invalid certificate pair for APNS: %s", err)
+	}
+	now := time.Now()
+	for _, _ct := range cert.Certificate {
+		ct, err := x509.ParseCertificate(_ct)
 		if err != nil {
-			return fmt.Errorf("Invalid certificate pair for APNS: %s", err)
+			return notAfter, fmt.Errorf("Cannot parse X509 certificate")
 		}
-		now := time.Now()
-		for _, _ct := range cert.Certificate {
-			ct, err := x509.ParseCertificate(_ct)
-			if err != nil {
-				return fmt.Errorf("Cannot parse X509 certificate")
-			}
-			if now.Before(ct.NotBefore) || now.After(ct.NotAfter) {
-				return fmt.Errorf("Certificate is expired. Subject: %s, NotBefore: %s, NotAfter: %s", ct.Subject, ct.NotBefore, ct.NotAfter)
-			}
-			if c.Apns.CertificateNotAfter.IsZero() || c.Apns.CertificateNotAfter.Before(ct.NotAfter) {
-				// hold minimum not after
-				c.Apns.CertificateNotAfter = ct.NotAfter
-			}
+		if now.Before(ct.NotBefore) || now.After(ct.NotAfter) {
+			return notAfter, fmt.Errorf("Certificate is expired. Subject: %s, NotBefore: %s, NotAfter: %s", ct.Subject, ct.NotBefore, ct.NotAfter)
+		}
+		if notAfter.IsZero() || notAfter.Before(ct.NotAfter) {
+			// hold minimum not after
+			notAfter = ct.NotAfter
 		}
 	}
+	return notAfter, nil
+}
+
+func (c *Config) validateConfigWebPush() error {
+	if !strings.HasPrefix(c.WebPush.Subject, "mailto:") && !strings.HasPrefix(c.WebPush.Subject, "https:") {
+		return fmt.Errorf("subject must be a mailto: or https: URL: %s", c.WebPush.Subject)
+	}
+	for _, h := range c.WebPush.AllowedHosts {
+		if h == "" || strings.ContainsAny(h, ":/*") {
+			return fmt.Errorf("allowed_hosts must be host names: %q", h)
+		}
+	}
+
+	if c.WebPush.VAPIDKeyFile != "" {
+		b, err := os.ReadFile(c.WebPush.VAPIDKeyFile)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return fmt.Errorf("invalid PEM file: %s", c.WebPush.VAPIDKeyFile)
+		}
+		var key interface{}
+		if block.Type == "EC PRIVATE KEY" {
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		} else {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return fmt.Errorf("VAPID key must be a P-256 private key")
+		}
+		c.WebPush.PrivateKey = ecKey
+		return nil
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.WebPush.VAPIDPrivateKey, "="))
+	if err != nil || len(d) != 32 {
+		return fmt.Errorf("vapid_private_key must be a 32 bytes key encoded in base64url")
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return err
+	}
+	pub := key.PublicKey().Bytes()
+	c.WebPush.PrivateKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
 	return nil
 }
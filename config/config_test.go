@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadTomlConfigFile(t *testing.T) {
@@ -19,3 +21,275 @@ func TestLoadTomlConfigFile(t *testing.T) {
 		t.Errorf("not match error hook: got %s want %s", g, w)
 	}
 }
+
+func TestWebPushVAPIDKey(t *testing.T) {
+	c := Config{
+		WebPush: SectionWebPush{
+			VAPIDPrivateKey: "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94",
+			Subject:         "mailto:push@example.com",
+		},
+	}
+	if err := c.validateConfigWebPush(); err != nil {
+		t.Fatal(err)
+	}
+	key := c.WebPush.PrivateKey
+	if key == nil || !key.Curve.IsOnCurve(key.X, key.Y) {
+		t.Errorf("invalid VAPID key: %#v", key)
+	}
+
+	c.WebPush.Subject = "push@example.com"
+	if err := c.validateConfigWebPush(); err == nil {
+		t.Error("subject without mailto: must be invalid")
+	}
+
+	c.WebPush.Subject = "mailto:push@example.com"
+	c.WebPush.AllowedHosts = []string{"https://push.example.com/"}
+	if err := c.validateConfigWebPush(); err == nil {
+		t.Error("allowed_hosts with URLs must be invalid")
+	}
+}
+
+func TestApnsApps(t *testing.T) {
+	c := Config{
+		Apns: SectionApns{
+			CertFile: "../test/server.crt",
+			KeyFile:  "../test/server.key",
+			Apps: []SectionApnsApp{
+				{Name: "second", Kid: "ABCDE12345", TeamID: "TEAM123456", Topics: []string{"com.example.second"}},
+			},
+		},
+	}
+	if err := c.validateConfigAPNs(); err != nil {
+		t.Fatal(err)
+	}
+	apps := c.Apns.AllApps()
+	if len(apps) != 2 || apps[0].Name != DefaultApnsAppName || apps[1].Name != "second" {
+		t.Errorf("unexpected apps: %#v", apps)
+	}
+	if a := c.Apns.ForApp(apps[1]); a.Kid != "ABCDE12345" || a.CertFile != "" {
+		t.Errorf("unexpected configuration for app: %#v", a)
+	}
+
+	c.Apns.Apps = append(c.Apns.Apps, SectionApnsApp{
+		Name: "third", Kid: "ABCDE12345", TeamID: "TEAM123456", Topics: []string{"com.example.second"},
+	})
+	if err := c.validateConfigAPNs(); err == nil {
+		t.Error("duplicated topic must be invalid")
+	}
+
+	c.Apns.Apps[1] = SectionApnsApp{Name: DefaultApnsAppName, Kid: "ABCDE12345", TeamID: "TEAM123456"}
+	if err := c.validateConfigAPNs(); err == nil {
+		t.Error("duplicated name must be invalid")
+	}
+}
+
+func TestFCMv1Projects(t *testing.T) {
+	c := Config{
+		FCMv1: SectionFCMv1{
+			ProjectID: "first",
+			Projects: []SectionFCMv1Project{
+				{Name: "second", ProjectID: "second"},
+			},
+		},
+	}
+	projects := c.FCMv1.AllProjects()
+	if len(projects) != 2 || projects[0].Name != DefaultFCMv1ProjectName || projects[1].Name != "second" {
+		t.Errorf("unexpected projects: %#v", projects)
+	}
+	if f := c.FCMv1.ForProject(projects[1]); f.ProjectID != "second" || f.Projects != nil {
+		t.Errorf("unexpected configuration for project: %#v", f)
+	}
+
+	c.FCMv1.Projects[0].GoogleApplicationCredentials = ""
+	if err := c.validateConfigFCMv1(); err == nil {
+		t.Error("project without google_application_credentials must be invalid")
+	}
+
+	c.FCMv1.Projects[0].Name = DefaultFCMv1ProjectName
+	if err := c.validateConfigFCMv1(); err == nil {
+		t.Error("duplicated name must be invalid")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	src := `
+[provider]
+worker_num = 1
+
+[retry.default]
+max_attempts = 5
+backoff = "linear"
+
+[retry.apns]
+initial_delay = "1s"
+
+[retry.apns.reasons.TooManyRequests]
+max_attempts = 2
+max_delay = "30s"
+jitter = 0.0
+
+[retry.apns.reasons.Unregistered]
+retry = false
+`
+	fn := filepath.Join(t.TempDir(), "gunfish.toml")
+	if err := os.WriteFile(fn, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, apns := c.Retry["default"], c.Retry["apns"]
+	p := def.Merge(apns).Merge(apns.Reasons["TooManyRequests"])
+	if *p.MaxAttempts != 2 || *p.Backoff != BackoffLinear || p.InitialDelay.Duration != time.Second ||
+		p.MaxDelay.Duration != 30*time.Second || *p.Jitter != 0 || p.Retry != nil {
+		t.Errorf("unexpected merged policy: %#v", p)
+	}
+	if r := apns.Reasons["Unregistered"].Retry; r == nil || *r {
+		t.Errorf("retry must be disabled: %v", r)
+	}
+
+	for _, invalid := range []string{
+		"[retry.apns]\nmax_attempts = 0\n",
+		"[retry.apns]\nbackoff = \"quadratic\"\n",
+		"[retry.apns.reasons.TooManyRequests]\njitter = 1.5\n",
+		"[retry.apns.reasons.TooManyRequests.reasons.Shutdown]\nretry = true\n",
+	} {
+		if err := os.WriteFile(fn, []byte("[provider]\nworker_num = 1\n"+invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(fn); err == nil {
+			t.Errorf("must be invalid: %s", invalid)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := Config{
+		RateLimit: SectionRateLimit{
+			Rate: 1000,
+			Rules: []RateLimitRule{
+				{Provider: "fcmv1", App: "second", Rate: 100, Burst: 10},
+			},
+		},
+	}
+	if err := c.validateConfigRateLimit(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.RateLimit.Rules = append(c.RateLimit.Rules, RateLimitRule{Topic: "com.example.app", Rate: 100})
+	if err := c.validateConfigRateLimit(); err == nil {
+		t.Error("rule without provider must be invalid")
+	}
+	c.RateLimit.Rules = []RateLimitRule{{Provider: "apns"}}
+	if err := c.validateConfigRateLimit(); err == nil {
+		t.Error("rule without rate must be invalid")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	c := Config{
+		Provider: SectionProvider{
+			QueueSize: 200,
+			Priority: SectionPriority{
+				Scheduling: SchedulingWeighted,
+				Classes: []PriorityClass{
+					{Name: "transactional", Weight: 9, ApnsPriorities: []string{"10"}},
+					{Name: "bulk", QueueSize: 1000, ApnsPriorities: []string{"5", "1"}},
+				},
+			},
+		},
+	}
+	if err := c.validateConfigPriority(); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Provider.Priority.DefaultClass(); d != "bulk" {
+		t.Errorf("unexpected default class: %s", d)
+	}
+	classes := c.Provider.Priority.AllClasses(c.Provider.QueueSize)
+	if classes[0].QueueSize != 200 || classes[1].Weight != 1 {
+		t.Errorf("unexpected classes: %#v", classes)
+	}
+
+	invalids := []SectionPriority{
+		{Scheduling: "random"},
+		{Default: "transactional"},
+		{Classes: []PriorityClass{{Name: "a"}, {Name: "a"}}},
+		{Classes: []PriorityClass{{Name: "a", ApnsPriorities: []string{"10"}}, {Name: "b", ApnsPriorities: []string{"10"}}}},
+		{Classes: []PriorityClass{{Name: "a", Weight: -1}}},
+	}
+	for _, p := range invalids {
+		c.Provider.Priority = p
+		if err := c.validateConfigPriority(); err == nil {
+			t.Errorf("must be invalid: %#v", p)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	c := Config{
+		Provider: SectionProvider{
+			Quota: SectionQuota{
+				MaxQueued: 1000,
+				Callers: []CallerQuota{
+					{Name: "campaign", MaxQueued: 100},
+					{Name: "transaction", Weight: 4},
+				},
+			},
+		},
+	}
+	if err := c.validateConfigQuota(); err != nil {
+		t.Fatal(err)
+	}
+	if q := c.Provider.Quota.Caller("campaign"); q.MaxQueued != 100 || q.Weight != 1 {
+		t.Errorf("unexpected quota: %#v", q)
+	}
+	if q := c.Provider.Quota.Caller("transaction"); q.MaxQueued != 1000 || q.Weight != 4 {
+		t.Errorf("unexpected quota: %#v", q)
+	}
+	if q := c.Provider.Quota.Caller(""); q.MaxQueued != 1000 || q.Weight != 1 {
+		t.Errorf("unexpected quota: %#v", q)
+	}
+
+	c.Provider.Quota.Callers = append(c.Provider.Quota.Callers, CallerQuota{Name: "campaign"})
+	if err := c.validateConfigQuota(); err == nil {
+		t.Error("duplicated caller must be invalid")
+	}
+	c.Provider.Quota.Callers = []CallerQuota{{Name: "campaign", Weight: -1}}
+	if err := c.validateConfigQuota(); err == nil {
+		t.Error("negative weight must be invalid")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	w := SectionWebhook{URL: "https://example.com/hook"}
+	if err := w.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d := w.WithDefaults(); d.BatchSize != DefaultWebhookBatchSize || d.Concurrency != DefaultWebhookConcurrency {
+		t.Errorf("unexpected defaults: %#v", d)
+	}
+	for _, u := range []string{"example.com/hook", "ftp://example.com/hook", "https://"} {
+		if err := (SectionWebhook{URL: u}).validate(); err == nil {
+			t.Errorf("url %s must be invalid", u)
+		}
+	}
+	w.Concurrency = -1
+	if err := w.validate(); err == nil {
+		t.Error("negative concurrency must be invalid")
+	}
+}
+
+func TestHook(t *testing.T) {
+	h := SectionHook{}.WithDefaults()
+	if h.BatchSize != 1 || h.Timeout.Duration != DefaultHookTimeout || h.MaxRetries != 0 {
+		t.Errorf("unexpected defaults: %#v", h)
+	}
+	if err := h.validate(); err != nil {
+		t.Fatal(err)
+	}
+	h.MaxRetries = -1
+	if err := h.validate(); err == nil {
+		t.Error("negative max_retries must be invalid")
+	}
+}
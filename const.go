@@ -2,12 +2,14 @@ package gunfish
 
 import (
 	"time"
+
+	"github.com/kayac/Gunfish/config"
 )
 
 // Default values
 const (
-	// SendRetryCount is the threashold which is resend count.
-	SendRetryCount = 10
+	// SendRetryCount is the default maximum number of sending a notification. See config.DefaultRetryMaxAttempts.
+	SendRetryCount = config.DefaultRetryMaxAttempts
 	// RetryWaitTime is periodical time to retrieve notifications from retry queue to resend
 	RetryWaitTime = time.Millisecond * 500
 	// RetryOnceCount is the number of sending notification at once.
@@ -19,11 +21,13 @@ const (
 	// About the average time of response from apns. That value is not accurate
 	// because that is defined heuristically in Japan.
 	AverageResponseTime = time.Millisecond * 150
-	// Minimum RetryAfter time (seconds).
+	// RetryAfter time when the drain rate of the queue is not observed yet.
 	RetryAfterSecond = time.Second * 10
-	// Gunfish returns RetryAfter header based on 'Exponential Backoff'. Therefore,
+	// Gunfish returns RetryAfter header based on the drain rate of the queue. Therefore,
 	// that defines the wait time threshold so as not to wait too long.
 	ResetRetryAfterSecond = time.Second * 60
+	// DrainRateInterval is the interval to estimate the drain rate of the queue.
+	DrainRateInterval = time.Second
 	// FlowRateInterval is the designed value to enable to delivery notifications
 	// for that value seconds. Gunfish is designed as to ensure to delivery
 	// notifications for 10 seconds.
@@ -34,6 +38,29 @@ const (
 	ShutdownWaitTime = time.Millisecond * 10
 	// That is the count while request counter is 0 in the 'ShutdownWaitTime' period.
 	RestartWaitCount = 50
+	// WorkerFlushInterval is periodical time to enqueue requests which wait for free space of worker's queues.
+	WorkerFlushInterval = time.Millisecond * 10
+	// BatchExpireInterval is periodical time to remove expired batches for the status API.
+	BatchExpireInterval = time.Minute
+	// WebhookRetryWaitTime is the wait time before the first retry of a webhook request. It doubles on each retry.
+	WebhookRetryWaitTime = time.Second
+	// HookRetryWaitTime is the wait time before the first retry of a hook invocation. It doubles on each retry.
+	HookRetryWaitTime = time.Second
+	// HookWaitDelay is the time to wait for output of a hook after it exited or was killed.
+	HookWaitDelay = time.Second
+	// WALAdoptInterval is periodical time to adopt write-ahead logs left by stopped processes.
+	WALAdoptInterval = time.Second * 10
+	// WALCompactThreshold is the number of finished notifications to compact the write-ahead log.
+	WALCompactThreshold = 10000
+	// TokenRegistryCompactThreshold is the number of records appended to the file of the token registry to compact it.
+	TokenRegistryCompactThreshold = 10000
+	// RateLimitMaxReservation is the max time for which notifications reserve tokens of rate limits in advance.
+	// It is short so that notifications of higher priority classes do not wait for reserved ones long.
+	RateLimitMaxReservation = time.Second
+	// EventBufferSize is the number of events buffered for each client of the event stream.
+	EventBufferSize = 1000
+	// EventKeepAliveInterval is periodical time to send comments to keep the event stream alive.
+	EventKeepAliveInterval = time.Second * 15
 )
 
 // Apns endpoints
@@ -46,9 +73,29 @@ const (
 // Supports Content-Type
 const (
 	ApplicationJSON              = "application/json"
+	ApplicationJSONLines         = "application/x-ndjson"
 	ApplicationXW3FormURLEncoded = "application/x-www-form-urlencoded"
+	TextEventStream              = "text/event-stream"
+)
+
+// MaxMetadataSize is the max byte size of metadata of a notification.
+const MaxMetadataSize = 4096
+
+// StatusPathPrefix is the path of the status API. A batch id follows it.
+const StatusPathPrefix = "/push/status/"
+
+// Request headers to select the synchronous mode
+const (
+	SyncHeader        = "X-Gunfish-Sync"
+	SyncTimeoutHeader = "X-Gunfish-Sync-Timeout"
 )
 
+// PriorityHeader is the request header to select the priority class of notifications.
+const PriorityHeader = "X-Gunfish-Priority"
+
+// CallerHeader is the request header to name the caller when authentication is not configured.
+const CallerHeader = "X-Gunfish-Caller"
+
 // Environment struct
 type Environment int
 
@@ -61,6 +108,8 @@ const (
 )
 
 // Alert fields mapping
+//
+// Deprecated: apns.Alert decodes and validates alerts. It is kept for compatibility and not used by Gunfish.
 var (
 	AlertKeyToField = map[string]string{
 		"title":          "Title",
@@ -79,4 +128,5 @@ var (
 	OutputHookStderr bool
 )
 
+// RetryBackoff enables delays of retry policies. It is disabled for testing.
 var RetryBackoff = true
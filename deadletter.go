@@ -0,0 +1,497 @@
+package gunfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons of dead letters
+const (
+	DeadLetterRetryExhausted      = "retry count exceeded"
+	DeadLetterRetryQueueFull      = "retry queue is full"
+	DeadLetterSupervisorQueueFull = "supervisor queue is full"
+	DeadLetterResponseQueueFull   = "response queue is full"
+	DeadLetterCommandQueueFull    = "command queue is full"
+	DeadLetterHookFailed          = "hook failed"
+	DeadLetterWebhookQueueFull    = "webhook queue is full"
+	DeadLetterWebhookFailed       = "webhook failed"
+	DeadLetterShutdown            = "shut down before sending"
+)
+
+// DeadLetter is a notification which Gunfish gave up delivering, or an error hook which could not be invoked.
+type DeadLetter struct {
+	ID           string          `json:"id"`
+	Time         time.Time       `json:"time"`
+	Reason       string          `json:"reason"`
+	Provider     string          `json:"provider"`
+	Notification json.RawMessage `json:"notification"`
+	Tries        int             `json:"tries"`
+	BatchID      string          `json:"batch_id,omitempty"`
+	Caller       string          `json:"caller,omitempty"`
+	Priority     string          `json:"priority,omitempty"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"` // the last result from the push service
+	Error        string          `json:"error,omitempty"`
+	Hook         string          `json:"hook,omitempty"`    // the error hook command which could not be invoked
+	Webhook      string          `json:"webhook,omitempty"` // URL of the error webhook which could not receive the result
+}
+
+// walRecord returns the record to decode the notification.
+func (dl DeadLetter) walRecord() walRecord {
+	return walRecord{Provider: dl.Provider, Priority: dl.Priority, Notification: dl.Notification, Metadata: dl.Metadata}
+}
+
+// DeadLetterStore stores dead letters.
+type DeadLetterStore interface {
+	// Put stores the dead letter.
+	Put(DeadLetter) error
+	// List returns stored dead letters from the oldest. limit <= 0 means no limit.
+	List(limit int) ([]DeadLetter, error)
+	// Remove removes dead letters which have the ids.
+	Remove(ids []string) error
+}
+
+// InitDeadLetterStore sets the store of dead letters.
+func InitDeadLetterStore(store DeadLetterStore) error {
+	if store == nil {
+		return fmt.Errorf("Invalid dead letter store: %v", store)
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	deadLetterStore = store
+	return nil
+}
+
+func currentDeadLetterStore() DeadLetterStore {
+	deadLetterMu.RLock()
+	defer deadLetterMu.RUnlock()
+	return deadLetterStore
+}
+
+// putDeadLetter stores the request which Gunfish gave up delivering as a dead letter.
+func putDeadLetter(req Request, result Result, err error, reason string) {
+	var b []byte
+	if result != nil {
+		b, _ = result.MarshalJSON()
+	}
+	storeDeadLetterRecord(req, b, err, reason, "", "")
+}
+
+// putDeadHook stores the error hook which could not be invoked as a dead letter.
+func putDeadHook(cmd Command, err error, reason string) {
+	storeDeadLetterRecord(cmd.req, cmd.input, err, reason, cmd.command, "")
+}
+
+// putDeadWebhook stores the error result which could not be posted to the webhook as a dead letter.
+func putDeadWebhook(item webhookItem, err error, reason, url string) {
+	storeDeadLetterRecord(item.req, item.body, err, reason, "", url)
+}
+
+func storeDeadLetterRecord(req Request, result []byte, err error, reason, hook, webhook string) {
+	provider := targetOf(req.Notification).Provider
+	metrics.deadLetters.add(1, provider, reason)
+	atomic.AddInt64(&(srvStats.DeadLetterCount), 1)
+	store := currentDeadLetterStore()
+	if store == nil {
+		return
+	}
+
+	logf := logrus.Fields{"type": "dead_letter", "reason": reason}
+	dl := DeadLetter{
+		ID:       uuid.NewV4().String(),
+		Time:     time.Now(),
+		Reason:   reason,
+		Provider: provider,
+		Tries:    req.Tries,
+		BatchID:  req.BatchID(),
+		Caller:   req.Caller(),
+		Priority: req.priority,
+		Metadata: req.Metadata,
+		Hook:     hook,
+		Webhook:  webhook,
+	}
+	b, merr := json.Marshal(req.Notification)
+	if merr != nil {
+		LogWithFields(logf).Errorf("failed to encode the notification: %s", merr)
+		return
+	}
+	dl.Notification = b
+	dl.Result = result
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	if perr := store.Put(dl); perr != nil {
+		LogWithFields(logf).Errorf("failed to store the dead letter: %s", perr)
+		return
+	}
+	LogWithFields(logf).Debugf("Stored the dead letter %s", dl.ID)
+}
+
+// fileDeadLetterStore stores dead letters in a JSON lines file and rotates it by size.
+type fileDeadLetterStore struct {
+	mu         sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+}
+
+// NewFileDeadLetterStore creates a store which writes dead letters to the JSON lines file.
+// The file is rotated to name.1, name.2, ... when it exceeds maxSize bytes.
+func NewFileDeadLetterStore(name string, maxSize int64, maxBackups int) (DeadLetterStore, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &fileDeadLetterStore{name: name, maxSize: maxSize, maxBackups: maxBackups}, nil
+}
+
+func (s *fileDeadLetterStore) Put(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rotate(int64(len(b) + 1)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// rotate rotates the file when it would exceed maxSize by n bytes.
+func (s *fileDeadLetterStore) rotate(n int64) error {
+	st, err := os.Stat(s.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if s.maxSize <= 0 || st.Size() == 0 || st.Size()+n <= s.maxSize {
+		return nil
+	}
+	if s.maxBackups <= 0 {
+		return os.Remove(s.name)
+	}
+	os.Remove(s.backupName(s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(s.backupName(i), s.backupName(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.name, s.backupName(1))
+}
+
+func (s *fileDeadLetterStore) backupName(i int) string {
+	return s.name + "." + strconv.Itoa(i)
+}
+
+// files returns the files from the oldest.
+func (s *fileDeadLetterStore) files() []string {
+	var names []string
+	for i := s.maxBackups; i >= 1; i-- {
+		names = append(names, s.backupName(i))
+	}
+	return append(names, s.name)
+}
+
+func (s *fileDeadLetterStore) List(limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dls []DeadLetter
+	for _, name := range s.files() {
+		d, err := readDeadLetters(name)
+		if err != nil {
+			return nil, err
+		}
+		dls = append(dls, d...)
+		if limit > 0 && len(dls) >= limit {
+			return dls[:limit], nil
+		}
+	}
+	return dls, nil
+}
+
+func (s *fileDeadLetterStore) Remove(ids []string) error {
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.files() {
+		dls, err := readDeadLetters(name)
+		if err != nil {
+			return err
+		}
+		kept := dls[:0]
+		for _, dl := range dls {
+			if !remove[dl.ID] {
+				kept = append(kept, dl)
+			}
+		}
+		if len(kept) == len(dls) {
+			continue
+		}
+		if err := writeDeadLetters(name, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDeadLetters(name string) ([]DeadLetter, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var dls []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			LogWithFields(logrus.Fields{"type": "dead_letter", "file": name}).Warnf("skipped a broken dead letter: %s", err)
+			continue
+		}
+		dls = append(dls, dl)
+	}
+	return dls, scanner.Err()
+}
+
+func writeDeadLetters(name string, dls []DeadLetter) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, dl := range dls {
+		if err := enc.Encode(dl); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// newDeadLetterStore creates the store by the configuration. It returns nil when the store is not configured.
+func newDeadLetterStore(conf config.SectionDeadLetter) (DeadLetterStore, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	return NewFileDeadLetterStore(conf.File, conf.MaxSize, conf.MaxBackups)
+}
+
+// DeadLettersResponse is the response body of GET /dead-letters.
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// RequeueRequest is the request body of POST /dead-letters/requeue.
+type RequeueRequest struct {
+	IDs []string `json:"ids"` // empty means all of dead letters
+}
+
+// RequeueResponse is the response body of POST /dead-letters/requeue.
+type RequeueResponse struct {
+	Result   string   `json:"result"`
+	BatchID  string   `json:"batch_id,omitempty"`  // the first batch
+	BatchIDs []string `json:"batch_ids,omitempty"` // all of batches
+	Requeued int      `json:"requeued"`
+	Hooks    int      `json:"hooks"`
+	Webhooks int      `json:"webhooks"`
+}
+
+// DeadLettersHandler returns stored dead letters at GET /dead-letters.
+func (prov *Provider) DeadLettersHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+		store := currentDeadLetterStore()
+		if store == nil {
+			writeReason(res, http.StatusNotFound, "dead letter store is not configured")
+			return
+		}
+		limit := 0
+		if v := req.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeReason(res, http.StatusBadRequest, "invalid limit: "+v)
+				return
+			}
+			limit = n
+		}
+		dls, err := store.List(limit)
+		if err != nil {
+			writeReason(res, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if dls == nil {
+			dls = []DeadLetter{}
+		}
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		json.NewEncoder(res).Encode(DeadLettersResponse{DeadLetters: dls})
+	})
+}
+
+// RequeueDeadLettersHandler enqueues dead letters again at POST /dead-letters/requeue.
+func (prov *Provider) RequeueDeadLettersHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := validateMethod(res, req); err != nil {
+			logrus.Warn(err)
+			return
+		}
+		store := currentDeadLetterStore()
+		if store == nil {
+			writeReason(res, http.StatusNotFound, "dead letter store is not configured")
+			return
+		}
+		var rr RequeueRequest
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+				writeReason(res, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		r, err := prov.requeueDeadLetters(store, rr.IDs, CallerName(req.Context()))
+		if err != nil {
+			writeReason(res, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		json.NewEncoder(res).Encode(r)
+	})
+}
+
+func (prov *Provider) requeueDeadLetters(store DeadLetterStore, ids []string, caller string) (RequeueResponse, error) {
+	r := RequeueResponse{Result: "ok"}
+	dls, err := store.List(0)
+	if err != nil {
+		return r, err
+	}
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var reqs []Request
+	var reqIDs, hookIDs, webhookIDs []string
+	var hooks []Command
+	var items []webhookItem
+	for _, dl := range dls {
+		if len(ids) > 0 && !wanted[dl.ID] {
+			continue
+		}
+		if dl.Webhook == "" && dl.Hook != "" && (dl.Reason == DeadLetterWebhookFailed || dl.Reason == DeadLetterWebhookQueueFull) {
+			// stored by older versions which recorded the URL as the hook
+			dl.Webhook, dl.Hook = dl.Hook, ""
+		}
+		if dl.Webhook != "" {
+			item := webhookItem{body: dl.Result}
+			if req, err := decodeWALRecord(dl.walRecord()); err == nil {
+				item.req = req
+			}
+			items = append(items, item)
+			webhookIDs = append(webhookIDs, dl.ID)
+			continue
+		}
+		if dl.Hook != "" {
+			cmd := Command{command: dl.Hook, input: dl.Result, kind: resultError}
+			if req, err := decodeWALRecord(dl.walRecord()); err == nil {
+				cmd.req = req
+			}
+			hooks = append(hooks, cmd)
+			hookIDs = append(hookIDs, dl.ID)
+			continue
+		}
+		req, err := decodeWALRecord(dl.walRecord())
+		if err != nil {
+			return r, fmt.Errorf("dead letter %s: %s", dl.ID, err)
+		}
+		reqs = append(reqs, req)
+		reqIDs = append(reqIDs, dl.ID)
+	}
+	// enqueues in batches of config.MaxRequestSize as well as requests of POST /push/*,
+	// and removes only dead letters which were accepted
+	for len(reqs) > 0 {
+		n := len(reqs)
+		if n > config.MaxRequestSize {
+			n = config.MaxRequestSize
+		}
+		chunk := reqs[:n]
+		batch, err := prov.Sup.EnqueueBatch(&chunk, BatchOptions{Caller: caller})
+		if err != nil {
+			return r, err
+		}
+		if err := store.Remove(reqIDs[:n]); err != nil {
+			return r, err
+		}
+		if r.BatchID == "" {
+			r.BatchID = batch.ID
+		}
+		r.BatchIDs = append(r.BatchIDs, batch.ID)
+		r.Requeued += n
+		reqs, reqIDs = reqs[n:], reqIDs[n:]
+	}
+	for i, cmd := range hooks {
+		if !prov.Sup.enqueueCommand(cmd) {
+			hookIDs = hookIDs[:i]
+			break
+		}
+	}
+	if err := store.Remove(hookIDs); err != nil {
+		return r, err
+	}
+	r.Hooks = len(hookIDs)
+	if r.Hooks < len(hooks) {
+		return r, errors.New("command queue is full")
+	}
+
+	var werr error
+	for i, item := range items {
+		if werr = webhooks.requeue(item); werr != nil {
+			webhookIDs = webhookIDs[:i]
+			break
+		}
+	}
+	if err := store.Remove(webhookIDs); err != nil {
+		return r, err
+	}
+	r.Webhooks = len(webhookIDs)
+	return r, werr
+}
@@ -0,0 +1,233 @@
+package gunfish_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestFileDeadLetterStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dead_letters.json")
+	store, err := gunfish.NewFileDeadLetterStore(name, 300, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		err := store.Put(gunfish.DeadLetter{
+			ID:           fmt.Sprintf("dl-%d", i),
+			Reason:       gunfish.DeadLetterRetryExhausted,
+			Provider:     "apns",
+			Notification: json.RawMessage(`{"token":"xxx"}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(name + ".1"); err != nil {
+		t.Errorf("the file must be rotated: %s", err)
+	}
+	if _, err := os.Stat(name + ".2"); !os.IsNotExist(err) {
+		t.Errorf("too many backups: %v", err)
+	}
+
+	dls, err := store.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) == 0 || len(dls) >= 6 {
+		t.Fatalf("old dead letters must be discarded by the rotation: %d", len(dls))
+	}
+	if dls[len(dls)-1].ID != "dl-5" {
+		t.Errorf("unexpected order: %#v", dls)
+	}
+	if l, _ := store.List(1); len(l) != 1 || l[0].ID != dls[0].ID {
+		t.Errorf("unexpected limited list: %#v", l)
+	}
+
+	if err := store.Remove([]string{"dl-5"}); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := store.List(0); len(l) != len(dls)-1 {
+		t.Errorf("the dead letter must be removed: %#v", l)
+	}
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	store, err := gunfish.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "dead_letters.json"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gunfish.InitDeadLetterStore(store)
+	defer func() {
+		// other tests must not write to the removed directory
+		null, _ := gunfish.NewFileDeadLetterStore(os.DevNull, 0, 0)
+		gunfish.InitDeadLetterStore(null)
+	}()
+
+	notification := `{"token":"1122334455667788112233445566778811223344556677881122334455667788","payload":{"aps":{"alert":"dead"}}}`
+	for _, id := range []string{"a", "b"} {
+		store.Put(gunfish.DeadLetter{
+			ID:           id,
+			Time:         time.Now(),
+			Reason:       gunfish.DeadLetterRetryExhausted,
+			Provider:     "apns",
+			Notification: json.RawMessage(notification),
+			Tries:        gunfish.SendRetryCount,
+		})
+	}
+
+	sup, _ := gunfish.StartSupervisor(&conf)
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+
+	r, _ := http.NewRequest("GET", "/dead-letters?limit=10", nil)
+	w := httptest.NewRecorder()
+	prov.DeadLettersHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", w.Code)
+	}
+	var list gunfish.DeadLettersResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.DeadLetters) != 2 || list.DeadLetters[0].ID != "a" {
+		t.Errorf("unexpected dead letters: %#v", list.DeadLetters)
+	}
+
+	r, _ = http.NewRequest("POST", "/dead-letters/requeue", bytes.NewBufferString(`{"ids":["a"]}`))
+	w = httptest.NewRecorder()
+	prov.RequeueDeadLettersHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	var rr gunfish.RequeueResponse
+	if err := json.NewDecoder(w.Body).Decode(&rr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Requeued != 1 || rr.BatchID == "" {
+		t.Errorf("unexpected response: %#v", rr)
+	}
+
+	batch, ok := sup.Batch(rr.BatchID)
+	if !ok {
+		t.Fatal("batch is not found")
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Error("batch was not finished")
+	}
+	for _, e := range batch.Entries() {
+		if e.State != gunfish.StateDelivered {
+			t.Errorf("unexpected state: %#v", e)
+		}
+	}
+
+	dls, _ := store.List(0)
+	if len(dls) != 1 || dls[0].ID != "b" {
+		t.Errorf("requeued dead letters must be removed: %#v", dls)
+	}
+}
+
+func TestRequeueWebhookDeadLetters(t *testing.T) {
+	store, err := gunfish.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "dead_letters.json"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gunfish.InitDeadLetterStore(store)
+	defer func() {
+		null, _ := gunfish.NewFileDeadLetterStore(os.DevNull, 0, 0)
+		gunfish.InitDeadLetterStore(null)
+	}()
+
+	var mu sync.Mutex
+	failing := true
+	var received []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var results []map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&results)
+		received = append(received, results...)
+	}))
+	defer ts.Close()
+
+	c := conf
+	c.Provider.ErrorWebhook = config.SectionWebhook{
+		URL:           ts.URL + "/error",
+		MaxRetries:    1,
+		FlushInterval: config.Duration{Duration: 100 * time.Millisecond},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+
+	reqs := repeatRequestData("unregistered", 1)
+	if _, err := sup.EnqueueClientRequest(&reqs); err != nil {
+		t.Fatal(err)
+	}
+	var dls []gunfish.DeadLetter
+	for i := 0; len(dls) == 0; i++ {
+		if i > 100 {
+			t.Fatal("the result was not stored as a dead letter")
+		}
+		time.Sleep(50 * time.Millisecond)
+		dls, _ = store.List(0)
+	}
+	if dl := dls[0]; dl.Reason != gunfish.DeadLetterWebhookFailed || dl.Webhook != ts.URL+"/error" || dl.Hook != "" {
+		t.Fatalf("unexpected dead letter: %#v", dl)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	r, _ := http.NewRequest("POST", "/dead-letters/requeue", nil)
+	w := httptest.NewRecorder()
+	prov.RequeueDeadLettersHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	var rr gunfish.RequeueResponse
+	if err := json.NewDecoder(w.Body).Decode(&rr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Webhooks != 1 || rr.Requeued != 0 || rr.Hooks != 0 {
+		t.Errorf("unexpected response: %#v", rr)
+	}
+
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("the result was not posted to the webhook")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(received) != 1 || received[0]["reason"] != "Unregistered" {
+		t.Errorf("unexpected results: %v", received)
+	}
+	mu.Unlock()
+	if dls, _ := store.List(0); len(dls) != 0 {
+		t.Errorf("requeued dead letters must be removed: %#v", dls)
+	}
+}
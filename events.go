@@ -0,0 +1,267 @@
+package gunfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResultEvent is a result of a notification which is published to the event stream.
+type ResultEvent struct {
+	ID       uint64          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Provider string          `json:"provider"`
+	App      string          `json:"app,omitempty"`
+	Topic    string          `json:"topic,omitempty"`
+	BatchID  string          `json:"batch_id,omitempty"`
+	Caller   string          `json:"caller,omitempty"`
+	Status   int             `json:"status"`
+	Result   json.RawMessage `json:"result"`
+}
+
+// eventFilter selects events which a subscriber receives. Empty fields match any events.
+type eventFilter struct {
+	provider string
+	topic    string
+	batchID  string
+	statuses []string // success, error or status classes such as 4xx
+}
+
+func parseEventFilter(req *http.Request) (eventFilter, error) {
+	q := req.URL.Query()
+	f := eventFilter{
+		provider: q.Get("provider"),
+		topic:    q.Get("topic"),
+		batchID:  q.Get("batch_id"),
+	}
+	if v := q.Get("status"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if !validStatusClass(s) {
+				return f, fmt.Errorf("invalid status: %s", s)
+			}
+			f.statuses = append(f.statuses, s)
+		}
+	}
+	return f, nil
+}
+
+func validStatusClass(s string) bool {
+	switch s {
+	case resultSuccess, resultError:
+		return true
+	}
+	return len(s) == 3 && s[0] >= '1' && s[0] <= '5' && s[1:] == "xx"
+}
+
+func (f eventFilter) match(ev *ResultEvent, failed bool) bool {
+	if f.provider != "" && f.provider != ev.Provider {
+		return false
+	}
+	if f.topic != "" && f.topic != ev.Topic {
+		return false
+	}
+	if f.batchID != "" && f.batchID != ev.BatchID {
+		return false
+	}
+	if len(f.statuses) == 0 {
+		return true
+	}
+	class := strconv.Itoa(ev.Status/100) + "xx"
+	for _, s := range f.statuses {
+		switch s {
+		case resultSuccess:
+			if !failed {
+				return true
+			}
+		case resultError:
+			if failed {
+				return true
+			}
+		default:
+			if s == class {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventSubscriber is a client of the event stream.
+type eventSubscriber struct {
+	filter  eventFilter
+	events  chan *ResultEvent
+	dropped int64 // events which were dropped since the last event sent, guarded by eventBroker.mu
+	done    chan struct{}
+}
+
+// eventBroker publishes results of notifications to subscribers of the event stream.
+type eventBroker struct {
+	mu     sync.Mutex
+	lastID uint64
+	subs   map[*eventSubscriber]struct{}
+	closed bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[*eventSubscriber]struct{})}
+}
+
+// subscribe adds a subscriber. It returns nil after the broker was closed.
+func (b *eventBroker) subscribe(f eventFilter) *eventSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	s := &eventSubscriber{
+		filter: f,
+		events: make(chan *ResultEvent, EventBufferSize),
+		done:   make(chan struct{}),
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *eventBroker) unsubscribe(s *eventSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.done)
+	}
+}
+
+// takeDropped returns the number of events dropped for the subscriber, and resets it.
+func (b *eventBroker) takeDropped(s *eventSubscriber) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+func (b *eventBroker) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// publish sends the result to subscribers without blocking.
+// Events for a subscriber which does not keep up with the stream are dropped.
+func (b *eventBroker) publish(req Request, result Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	body, err := result.MarshalJSON()
+	if err != nil {
+		LogWithFields(logrus.Fields{"type": "events"}).Errorf("failed to encode the result: %s", err)
+		return
+	}
+	t := targetOf(req.Notification)
+	b.lastID++
+	ev := &ResultEvent{
+		ID:       b.lastID,
+		Time:     time.Now(),
+		Provider: result.Provider(),
+		App:      t.App,
+		Topic:    t.Topic,
+		BatchID:  req.BatchID(),
+		Caller:   req.Caller(),
+		Status:   result.Status(),
+		Result:   body,
+	}
+	failed := result.Err() != nil
+	for s := range b.subs {
+		if !s.filter.match(ev, failed) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+			metrics.events.add(1, "sent")
+		default:
+			s.dropped++
+			metrics.events.add(1, "dropped")
+		}
+	}
+}
+
+// close disconnects all subscribers. It is called when the server shuts down.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.done)
+	}
+}
+
+// EventsHandler streams results of notifications as Server-Sent Events at GET /events.
+func (prov *Provider) EventsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+		flusher, ok := res.(http.Flusher)
+		if !ok {
+			writeReason(res, http.StatusInternalServerError, "streaming is not supported")
+			return
+		}
+		f, err := parseEventFilter(req)
+		if err != nil {
+			writeReason(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		s := events.subscribe(f)
+		if s == nil {
+			writeReason(res, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		defer events.unsubscribe(s)
+
+		logf := logrus.Fields{"type": "events", "caller": CallerName(req.Context()), "remote": req.RemoteAddr}
+		LogWithFields(logf).Info("Subscribed to the event stream")
+		defer LogWithFields(logf).Info("Unsubscribed from the event stream")
+
+		res.Header().Set("Content-Type", TextEventStream)
+		res.Header().Set("Cache-Control", "no-cache")
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprint(res, ": connected\n\n")
+		flusher.Flush()
+
+		ticker := time.NewTicker(EventKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-s.events:
+				if n := events.takeDropped(s); n > 0 {
+					fmt.Fprintf(res, "event: dropped\ndata: {\"dropped\":%d}\n\n", n)
+				}
+				b, _ := json.Marshal(ev)
+				if _, err := fmt.Fprintf(res, "id: %d\nevent: result\ndata: %s\n\n", ev.ID, b); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ticker.C:
+				if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-s.done:
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
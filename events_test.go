@@ -0,0 +1,98 @@
+package gunfish_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+func TestEventsHandler(t *testing.T) {
+	sup, err := gunfish.StartSupervisor(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+	ts := httptest.NewServer(prov.EventsHandler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?status=xxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status for an invalid filter: %d", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "?provider=apns&status=4xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != gunfish.TextEventStream {
+		t.Errorf("unexpected Content-Type: %s", ct)
+	}
+	r := bufio.NewReader(res.Body)
+	// waits for the subscription
+	if line, _ := r.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+
+	reqs := append(repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 1), repeatRequestData("unregistered", 1)...)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+
+	events := make(chan gunfish.ResultEvent)
+	go func() {
+		var name string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: ") && name == "result":
+				var ev gunfish.ResultEvent
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+					t.Error(err)
+				}
+				events <- ev
+			}
+		}
+	}()
+
+	select {
+	case ev := <-events:
+		if ev.Provider != "apns" || ev.Status != http.StatusGone || ev.BatchID != batch.ID {
+			t.Errorf("unexpected event: %#v", ev)
+		}
+		if !strings.Contains(string(ev.Result), "Unregistered") {
+			t.Errorf("unexpected result: %s", ev.Result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not received")
+	}
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Errorf("unexpected event: %#v", ev)
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+}
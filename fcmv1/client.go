@@ -8,6 +8,7 @@ import (
 	"path"
 	"time"
 
+	"github.com/kayac/Gunfish/internal/retryafter"
 	"golang.org/x/oauth2"
 )
 
@@ -38,6 +39,7 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 	}
 	defer res.Body.Close()
 
+	retryAfter := retryafter.Parse(res.Header, time.Now())
 	var body ResponseBody
 	dec := json.NewDecoder(res.Body)
 	if err = dec.Decode(&body); err != nil {
@@ -49,6 +51,7 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 			{
 				StatusCode: res.StatusCode,
 				Token:      p.Message.Token,
+				Project:    p.Project,
 			},
 		}, nil
 	} else if body.Error != nil {
@@ -56,7 +59,9 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 			{
 				StatusCode: res.StatusCode,
 				Token:      p.Message.Token,
+				Project:    p.Project,
 				Error:      body.Error,
+				RetryAfter: retryAfter,
 			},
 		}, nil
 	}
@@ -66,7 +71,7 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 
 // NewRequest creates request for fcm
 func (c *Client) NewRequest(p Payload) (*http.Request, error) {
-	data, err := json.Marshal(p)
+	data, err := json.Marshal(Payload{Message: p.Message})
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +79,7 @@ func (c *Client) NewRequest(p Payload) (*http.Request, error) {
 	if ts := c.tokenSource; ts != nil {
 		token, err := c.tokenSource.Token()
 		if err != nil {
-			return nil, err
+			return nil, TokenError{Err: err}
 		}
 		bearer = token.AccessToken
 	} else {
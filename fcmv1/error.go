@@ -6,12 +6,16 @@ type FCMErrorResponseCode int
 
 // Error const variables
 const (
-	InvalidArgument = "INVALID_ARGUMENT"
-	Unregistered    = "UNREGISTERED"
-	NotFound        = "NOT_FOUND"
-	Internal        = "INTERNAL"
-	Unavailable     = "UNAVAILABLE"
-	QuotaExceeded   = "QUOTA_EXCEEDED"
+	InvalidArgument     = "INVALID_ARGUMENT"
+	Unregistered        = "UNREGISTERED"
+	NotFound            = "NOT_FOUND"
+	Internal            = "INTERNAL"
+	Unavailable         = "UNAVAILABLE"
+	QuotaExceeded       = "QUOTA_EXCEEDED"
+	Unauthenticated     = "UNAUTHENTICATED"
+	PermissionDenied    = "PERMISSION_DENIED"
+	SenderIDMismatch    = "SENDER_ID_MISMATCH"
+	ThirdPartyAuthError = "THIRD_PARTY_AUTH_ERROR"
 )
 
 type Error struct {
@@ -29,3 +33,12 @@ func NewError(s int, r string) Error {
 		Reason:     r,
 	}
 }
+
+// TokenError is returned when the client could not get an access token.
+type TokenError struct {
+	Err error
+}
+
+func (e TokenError) Error() string {
+	return "failed to get access token: " + e.Err.Error()
+}
@@ -7,6 +7,7 @@ import (
 // Payload for fcm v1
 type Payload struct {
 	Message messaging.Message `json:"message"`
+	Project string            `json:"project,omitempty"` // name of the project in [[fcm_v1.projects]]. not sent to FCM
 }
 
 // MaxBulkRequests represens max count of request payloads in a request body.
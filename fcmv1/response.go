@@ -3,6 +3,7 @@ package fcmv1
 import (
 	"encoding/json"
 	"errors"
+	"time"
 )
 
 const Provider = "fcmv1"
@@ -28,7 +29,14 @@ type Detail struct {
 type Result struct {
 	StatusCode int       `json:"status,omitempty"`
 	Token      string    `json:"token,omitempty"`
+	Project    string    `json:"project,omitempty"`
 	Error      *FCMError `json:"error,omitempty"`
+	RetryAfter int64     `json:"retry_after,omitempty"` // seconds of Retry-After header
+}
+
+// Backoff returns the time which FCM requested to wait before sending again.
+func (r Result) Backoff() time.Duration {
+	return time.Duration(r.RetryAfter) * time.Second
 }
 
 func (r Result) Err() error {
@@ -47,7 +55,7 @@ func (r Result) RecipientIdentifier() string {
 }
 
 func (r Result) ExtraKeys() []string {
-	return []string{"message"}
+	return []string{"message", "project"}
 }
 
 func (r Result) Provider() string {
@@ -60,6 +68,8 @@ func (r Result) ExtraValue(key string) string {
 		if r.Error != nil {
 			return r.Error.Message
 		}
+	case "project":
+		return r.Project
 	}
 	return ""
 }
@@ -2,8 +2,12 @@ package fcmv1
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"firebase.google.com/go/messaging"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -93,3 +97,24 @@ func TestResult(t *testing.T) {
 		t.Errorf("unexpected encoded json: %s", string(b))
 	}
 }
+
+func TestSendRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"status":"QUOTA_EXCEEDED","message":"Quota exceeded."}}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, "test", ts.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.Send(Payload{Message: messaging.Message{Token: "xxx"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].RetryAfter != 30 || results[0].Backoff() != 30*time.Second {
+		t.Errorf("unexpected results: %#v", results)
+	}
+}
@@ -2,18 +2,38 @@ package gunfish
 
 import (
 	"fmt"
+	"sync"
 )
 
 // Application global variables
 var (
 	srvStats               Stats
+	callerStats            callerStatsMap
+	appStats               appStatsMap
+	metrics                = NewMetrics()
+	health                 = newHealthTracker()
+	retryPolicies          = newRetryPolicySet()
+	pauses                 = newPauseTracker()
+	rateLimits             = newRateLimiter()
+	quotas                 = newCallerQuotas()
+	webhooks               = newWebhookSet()
+	events                 = newEventBroker()
+	responseHandlerMu      sync.RWMutex
 	errorResponseHandler   ResponseHandler
 	successResponseHandler ResponseHandler
+	deadLetterMu           sync.RWMutex
+	deadLetterStore        DeadLetterStore
+	tokenRegistryMu        sync.RWMutex
+	tokenRegistry          TokenRegistry
+	notificationIncluded   int32 // 1 when results for handlers and hooks include notifications
+	certificateNotAfter    int64 // expiration of the APNs certificate in unix nanoseconds. it is replaced on reloading
 )
 
 // InitErrorResponseHandler initialize error response handler.
 func InitErrorResponseHandler(erh ResponseHandler) error {
 	if erh != nil {
+		responseHandlerMu.Lock()
+		defer responseHandlerMu.Unlock()
 		errorResponseHandler = erh
 		return nil
 	}
@@ -23,8 +43,17 @@ func InitErrorResponseHandler(erh ResponseHandler) error {
 // InitSuccessResponseHandler initialize success response handler.
 func InitSuccessResponseHandler(sh ResponseHandler) error {
 	if sh != nil {
+		responseHandlerMu.Lock()
+		defer responseHandlerMu.Unlock()
 		successResponseHandler = sh
 		return nil
 	}
 	return fmt.Errorf("Invalid response handler: %v", sh)
 }
+
+// responseHandlers returns the error response handler and the success response handler.
+func responseHandlers() (ResponseHandler, ResponseHandler) {
+	responseHandlerMu.RLock()
+	defer responseHandlerMu.RUnlock()
+	return errorResponseHandler, successResponseHandler
+}
@@ -0,0 +1,119 @@
+package gunfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessResponse is the response body of /readyz.
+type ReadinessResponse struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// healthTracker counts consecutive credential failures for each provider.
+type healthTracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		failures: make(map[string]int),
+	}
+}
+
+// observe records a result of sending a notification which the provider classified.
+func (h *healthTracker) observe(provider string, act Action, success bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if act.CredentialFailure {
+		h.failures[provider]++
+	} else if success {
+		h.failures[provider] = 0
+	}
+}
+
+// failing returns reasons of providers which fail consecutively over the threshold.
+func (h *healthTracker) failing(threshold int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var reasons []string
+	for provider, n := range h.failures {
+		if n >= threshold {
+			reasons = append(reasons, fmt.Sprintf("%s: %d consecutive credential failures", provider, n))
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// HealthHandler returns 200 while the process is alive.
+func (prov *Provider) HealthHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprint(res, `{"status":"ok"}`)
+	})
+}
+
+// ReadinessHandler returns 503 when Gunfish should not receive new notifications.
+func (prov *Provider) ReadinessHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+
+		reasons := prov.readinessFailures(time.Now())
+		r := ReadinessResponse{Status: "ok", Reasons: reasons}
+		code := http.StatusOK
+		if len(reasons) > 0 {
+			r.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(code)
+		json.NewEncoder(res).Encode(r)
+	})
+}
+
+func (prov *Provider) readinessFailures(now time.Time) []string {
+	conf := prov.current().readiness.WithDefaults()
+	var reasons []string
+
+	s := prov.Sup
+	if s.Draining() {
+		reasons = append(reasons, "supervisor is draining")
+	}
+	if c := s.lanes.cap(); c > 0 && float64(s.lanes.len())/float64(c) > conf.QueueRatio {
+		reasons = append(reasons, fmt.Sprintf("supervisor queue is filled over %g", conf.QueueRatio))
+	}
+	if c := cap(s.retryq); c > 0 && float64(len(s.retryq))/float64(c) > conf.QueueRatio {
+		reasons = append(reasons, fmt.Sprintf("retry queue is filled over %g", conf.QueueRatio))
+	}
+
+	if na := loadCertificateNotAfter(); !na.IsZero() && na.Sub(now) < conf.CertificateExpiry.Duration {
+		reasons = append(reasons, fmt.Sprintf("APNs certificate expires at %s", na.Format(time.RFC3339)))
+	}
+
+	reasons = append(reasons, health.failing(conf.FailureThreshold)...)
+	return reasons
+}
+
+// Draining returns true while the supervisor is shutting down.
+func (s *Supervisor) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// StartDraining makes /readyz report draining before the server stops accepting requests.
+func (s *Supervisor) StartDraining() {
+	atomic.StoreInt32(&s.draining, 1)
+}
@@ -0,0 +1,88 @@
+package gunfish
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/sirupsen/logrus"
+)
+
+// batchCommands groups commands of the command queue by hooks, and sends a batch
+// when it is filled or it waited for the flush interval.
+func batchCommands(conf config.SectionHook, cmdq <-chan Command, batchq chan<- []Command) {
+	defer close(batchq)
+	ticker := time.NewTicker(conf.FlushInterval.Duration)
+	defer ticker.Stop()
+
+	pending := make(map[string][]Command)
+	flush := func(hook string) {
+		if cmds := pending[hook]; len(cmds) > 0 {
+			delete(pending, hook)
+			batchq <- cmds
+		}
+	}
+	for {
+		select {
+		case cmd, ok := <-cmdq:
+			if !ok {
+				for hook := range pending {
+					flush(hook)
+				}
+				return
+			}
+			pending[cmd.command] = append(pending[cmd.command], cmd)
+			if len(pending[cmd.command]) >= conf.BatchSize {
+				flush(cmd.command)
+			}
+		case <-ticker.C:
+			for hook := range pending {
+				flush(hook)
+			}
+		}
+	}
+}
+
+// hookInput returns STDIN of the hook for the batch.
+// Batches are passed as JSON lines, and a result which is not batched is passed as is.
+func hookInput(conf config.SectionHook, cmds []Command) []byte {
+	if conf.BatchSize <= 1 && len(cmds) == 1 {
+		return cmds[0].input
+	}
+	var b bytes.Buffer
+	for _, cmd := range cmds {
+		b.Write(cmd.input)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// invokeHook invokes the hook with the batch, and retries it when it fails or times out.
+func invokeHook(conf config.SectionHook, cmds []Command) {
+	hook, kind := cmds[0].command, cmds[0].kind
+	logf := logrus.Fields{"type": "cmd_worker", "hook": kind, "size": len(cmds)}
+	input := hookInput(conf, cmds)
+
+	var err error
+	for i := 0; i <= conf.MaxRetries; i++ {
+		if i > 0 {
+			time.Sleep(HookRetryWaitTime * time.Duration(1<<uint(i-1)))
+		}
+		LogWithFields(logf).Debugf("invoking command: %s %s", hook, string(input))
+		var out []byte
+		out, err = invokePipe(hook, bytes.NewReader(input), conf.Timeout.Duration)
+		if err == nil {
+			metrics.hooks.add(1, kind, "ok")
+			LogWithFields(logf).Debugf("Success to execute command")
+			return
+		}
+		LogWithFields(logf).Warnf("(%s) %s", err.Error(), string(out))
+	}
+	metrics.hooks.add(1, kind, "failed")
+	LogWithFields(logf).Errorf("Gave up invoking command %s: %s", hook, err)
+	if kind == resultError {
+		for _, cmd := range cmds {
+			putDeadHook(cmd, err, DeadLetterHookFailed)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package gunfish_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+func readHookOutputs(t *testing.T, pattern string) (files int, results []map[string]interface{}) {
+	names, _ := filepath.Glob(pattern)
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var r map[string]interface{}
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Errorf("invalid line %q: %s", s.Text(), err)
+			}
+			results = append(results, r)
+		}
+		f.Close()
+	}
+	return len(names), results
+}
+
+func TestBatchedHook(t *testing.T) {
+	dir := t.TempDir()
+	// the success hook writes a file for each invocation, and the error hook fails once
+	gunfish.InitSuccessResponseHandler(gunfish.DefaultResponseHandler{
+		Hook: "cat > " + dir + "/success.$$",
+	})
+	gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{
+		Hook: "test -f " + dir + "/failed || { touch " + dir + "/failed; exit 1; }; cat > " + dir + "/error.$$",
+	})
+	defer func() {
+		gunfish.InitSuccessResponseHandler(gunfish.DefaultResponseHandler{})
+		gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
+	}()
+
+	c := conf
+	c.Provider.Hook = config.SectionHook{
+		BatchSize:     3,
+		FlushInterval: config.Duration{Duration: 2 * time.Second},
+		Timeout:       config.Duration{Duration: 5 * time.Second},
+		MaxRetries:    1,
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 3)
+	reqs = append(reqs, repeatRequestData("unregistered", 2)...)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	sup.Shutdown()
+
+	files, results := readHookOutputs(t, dir+"/success.*")
+	if files != 1 || len(results) != 3 {
+		t.Errorf("success hook must be invoked once with 3 results: %d invocations, %d results", files, len(results))
+	}
+	files, results = readHookOutputs(t, dir+"/error.*")
+	if files != 1 || len(results) != 2 {
+		t.Fatalf("error hook must be retried with 2 results: %d invocations, %d results", files, len(results))
+	}
+	for _, r := range results {
+		if r["reason"] != "Unregistered" {
+			t.Errorf("unexpected error result: %v", r)
+		}
+	}
+}
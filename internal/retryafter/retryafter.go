@@ -0,0 +1,27 @@
+// Package retryafter parses the Retry-After header of push services.
+package retryafter
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Parse returns seconds of the Retry-After header, which is seconds or an HTTP date.
+func Parse(h http.Header, now time.Time) int64 {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return sec
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return int64(math.Ceil(t.Sub(now).Seconds()))
+	}
+	return 0
+}
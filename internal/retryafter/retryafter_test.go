@@ -0,0 +1,25 @@
+package retryafter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	for v, expected := range map[string]int64{
+		"":                              0,
+		"120":                           120,
+		"-1":                            0,
+		"Sun, 18 Oct 2026 00:01:00 GMT": 60,
+		"Sat, 17 Oct 2026 23:59:00 GMT": 0,
+		"invalid":                       0,
+	} {
+		h := http.Header{}
+		h.Set("Retry-After", v)
+		if got := Parse(h, now); got != expected {
+			t.Errorf("Retry-After %q: got %d want %d", v, got, expected)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package gunfish_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+)
+
+type resultRecorder struct {
+	mu      *sync.Mutex
+	results *[]gunfish.Result
+}
+
+func (r resultRecorder) OnResponse(result gunfish.Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.results = append(*r.results, result)
+}
+
+func (r resultRecorder) HookCmd() string {
+	return ""
+}
+
+func TestRequestMetadata(t *testing.T) {
+	var results []gunfish.Result
+	rec := resultRecorder{mu: &sync.Mutex{}, results: &results}
+	gunfish.InitErrorResponseHandler(rec)
+	defer gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
+
+	c := conf
+	c.Provider.IncludeNotification = true
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+
+	body := `[{"token":"unregistered","payload":{"aps":{"alert":"hi"}},"metadata":{ "user_id": 1,
+	"campaign": "spring" }}]`
+	r, _ := newRequest([]byte(body), "POST", gunfish.ApplicationJSON)
+	r.Header.Set(gunfish.SyncHeader, "true")
+	w := httptest.NewRecorder()
+	prov.PushAPNsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(results) != 1 {
+		t.Fatalf("unexpected results: %v", results)
+	}
+	rr, ok := results[0].(gunfish.RequestResult)
+	if !ok {
+		t.Fatalf("result is not RequestResult: %T", results[0])
+	}
+	if string(rr.Metadata) != `{"user_id":1,"campaign":"spring"}` {
+		t.Errorf("unexpected metadata: %s", rr.Metadata)
+	}
+	if _, ok := rr.Unwrap().(apns.Result); !ok {
+		t.Errorf("unexpected result of the push provider: %T", rr.Unwrap())
+	}
+	b, err := json.Marshal(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["reason"] != "Unregistered" || v["metadata"] == nil || v["notification"] == nil {
+		t.Errorf("unexpected JSON of the result: %s", b)
+	}
+	if strings.Contains(string(b), "\n") {
+		t.Errorf("JSON of the result must be a line: %s", b)
+	}
+
+	for _, metadata := range []string{`"user"`, `[1]`, `{"data":"` + strings.Repeat("x", gunfish.MaxMetadataSize) + `"}`} {
+		body := `[{"token":"unregistered","payload":{"aps":{"alert":"hi"}},"metadata":` + metadata + `}]`
+		r, _ := newRequest([]byte(body), "POST", gunfish.ApplicationJSON)
+		w := httptest.NewRecorder()
+		prov.PushAPNsHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("metadata %.20s must be rejected: %d", metadata, w.Code)
+		}
+	}
+}
+
+func TestResultWithoutMetadata(t *testing.T) {
+	var results []gunfish.Result
+	rec := resultRecorder{mu: &sync.Mutex{}, results: &results}
+	gunfish.InitErrorResponseHandler(rec)
+	defer gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
+
+	c := conf
+	c.Provider.IncludeNotification = false
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+
+	r, _ := newRequest([]byte(`[{"token":"unregistered","payload":{"aps":{"alert":"hi"}}}]`), "POST", gunfish.ApplicationJSON)
+	r.Header.Set(gunfish.SyncHeader, "true")
+	w := httptest.NewRecorder()
+	prov.PushAPNsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(results) != 1 {
+		t.Fatalf("unexpected results: %v", results)
+	}
+	// handlers which expect results of push providers keep working
+	if _, ok := results[0].(apns.Result); !ok {
+		t.Errorf("result is not apns.Result: %T", results[0])
+	}
+}
@@ -0,0 +1,334 @@
+package gunfish
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PrometheusContentType is Content-Type of the Prometheus text format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	sendDurationBuckets  = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 1, 2, 5, 10}
+	queueDurationBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+)
+
+// Metrics holds metrics which are exposed in the Prometheus text format.
+type Metrics struct {
+	delivered     *counterVec
+	failed        *counterVec
+	retried       *counterVec
+	deadLetters   *counterVec
+	sendDuration  *histogramVec
+	queueDuration *histogramVec
+	rateLimitWait *histogramVec
+	webhooks      *counterVec
+	hooks         *counterVec
+	invalidTokens *counterVec
+	events        *counterVec
+}
+
+// NewMetrics creates Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		delivered: newCounterVec(
+			"gunfish_notifications_delivered_total",
+			"Number of notifications which were delivered.",
+			"provider", "app", "topic",
+		),
+		failed: newCounterVec(
+			"gunfish_notifications_failed_total",
+			"Number of notifications which were failed to deliver.",
+			"provider", "app", "topic", "reason",
+		),
+		retried: newCounterVec(
+			"gunfish_notifications_retried_total",
+			"Number of retries to send notifications.",
+			"provider", "app", "topic", "reason",
+		),
+		deadLetters: newCounterVec(
+			"gunfish_dead_letters_total",
+			"Number of notifications and error hooks which Gunfish gave up.",
+			"provider", "reason",
+		),
+		sendDuration: newHistogramVec(
+			"gunfish_send_duration_seconds",
+			"Response time of push services.",
+			sendDurationBuckets,
+			"provider",
+		),
+		queueDuration: newHistogramVec(
+			"gunfish_queue_duration_seconds",
+			"Time which notifications spent in the queue before sending.",
+			queueDurationBuckets,
+			"provider",
+		),
+		rateLimitWait: newHistogramVec(
+			"gunfish_rate_limit_wait_seconds",
+			"Time which notifications waited for rate limits.",
+			queueDurationBuckets,
+			"provider",
+		),
+		webhooks: newCounterVec(
+			"gunfish_webhook_requests_total",
+			"Number of requests to webhooks, and results dropped by full queues of webhooks.",
+			"webhook", "result",
+		),
+		hooks: newCounterVec(
+			"gunfish_hook_invocations_total",
+			"Number of invocations of hooks, and results dropped by the full command queue.",
+			"hook", "result",
+		),
+		invalidTokens: newCounterVec(
+			"gunfish_invalid_tokens_total",
+			"Number of invalid tokens recorded in the token registry, and notifications rejected by it.",
+			"provider", "result",
+		),
+		events: newCounterVec(
+			"gunfish_events_total",
+			"Number of results sent to clients of the event stream, and dropped for slow clients.",
+			"result",
+		),
+	}
+}
+
+// Write writes metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) {
+	m.delivered.write(w)
+	m.failed.write(w)
+	m.retried.write(w)
+	m.deadLetters.write(w)
+	m.sendDuration.write(w)
+	m.queueDuration.write(w)
+	m.rateLimitWait.write(w)
+	m.webhooks.write(w)
+	m.hooks.write(w)
+	m.invalidTokens.write(w)
+	m.events.write(w)
+}
+
+// MetricsHandler exposes metrics and queue gauges in the Prometheus text format.
+func (prov *Provider) MetricsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+
+		res.Header().Set("Content-Type", PrometheusContentType)
+		res.WriteHeader(http.StatusOK)
+		metrics.Write(res)
+		prov.Sup.writeQueueGauges(res)
+	})
+}
+
+func (s *Supervisor) writeQueueGauges(w io.Writer) {
+	length := newGaugeSet("gunfish_queue_length", "Number of items in the queue.", "queue", "worker")
+	capacity := newGaugeSet("gunfish_queue_capacity", "Capacity of the queue.", "queue", "worker")
+
+	length.set(float64(s.lanes.len()), "supervisor", "")
+	capacity.set(float64(s.lanes.cap()), "supervisor", "")
+	length.set(float64(len(s.retryq)), "retry", "")
+	capacity.set(float64(cap(s.retryq)), "retry", "")
+	length.set(float64(len(s.cmdq)), "command", "")
+	capacity.set(float64(cap(s.cmdq)), "command", "")
+	for _, wk := range s.workerList() {
+		id := strconv.Itoa(wk.id)
+		length.set(float64(wk.lanes.len()), "worker", id)
+		capacity.set(float64(wk.lanes.cap()), "worker", id)
+		length.set(float64(len(wk.respq)), "response", id)
+		capacity.set(float64(cap(wk.respq)), "response", id)
+	}
+
+	length.write(w)
+	capacity.write(w)
+
+	plength := newGaugeSet("gunfish_priority_queue_length", "Number of items in the supervisor queue of the priority class.", "priority")
+	pcapacity := newGaugeSet("gunfish_priority_queue_capacity", "Capacity of the supervisor queue of the priority class.", "priority")
+	for i, class := range s.lanes.classes {
+		plength.set(float64(s.lanes.queues[i].len()), class.Name)
+		pcapacity.set(float64(s.lanes.queues[i].cap()), class.Name)
+	}
+	plength.write(w)
+	pcapacity.write(w)
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // for histograms
+	count       uint64   // for histograms
+}
+
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+func (v *metricVec) get(lvs []string) *metricValue {
+	key := strings.Join(lvs, "\xff")
+	mv, ok := v.values[key]
+	if !ok {
+		mv = &metricValue{labelValues: append([]string(nil), lvs...)}
+		v.values[key] = mv
+	}
+	return mv
+}
+
+func (v *metricVec) sortedValues() []*metricValue {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mvs := make([]*metricValue, 0, len(keys))
+	for _, k := range keys {
+		mvs = append(mvs, v.values[k])
+	}
+	return mvs
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+type counterVec struct {
+	metricVec
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{metricVec{
+		name:   name,
+		help:   help,
+		typ:    "counter",
+		labels: labels,
+		values: make(map[string]*metricValue),
+	}}
+}
+
+func (c *counterVec) add(v float64, lvs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(lvs).value += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, mv := range c.sortedValues() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, mv.labelValues), formatValue(mv.value))
+	}
+}
+
+// gaugeSet is a set of gauges which are computed at the time of a scrape.
+type gaugeSet struct {
+	metricVec
+}
+
+func newGaugeSet(name, help string, labels ...string) *gaugeSet {
+	return &gaugeSet{metricVec{
+		name:   name,
+		help:   help,
+		typ:    "gauge",
+		labels: labels,
+		values: make(map[string]*metricValue),
+	}}
+}
+
+func (g *gaugeSet) set(v float64, lvs ...string) {
+	g.get(lvs).value = v
+}
+
+func (g *gaugeSet) write(w io.Writer) {
+	g.writeHeader(w)
+	for _, mv := range g.sortedValues() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, mv.labelValues), formatValue(mv.value))
+	}
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		metricVec: metricVec{
+			name:   name,
+			help:   help,
+			typ:    "histogram",
+			labels: labels,
+			values: make(map[string]*metricValue),
+		},
+		buckets: buckets,
+	}
+}
+
+func (h *histogramVec) observe(v float64, lvs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	mv := h.get(lvs)
+	if mv.counts == nil {
+		mv.counts = make([]uint64, len(h.buckets))
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			mv.counts[i]++
+		}
+	}
+	mv.value += v
+	mv.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, mv := range h.sortedValues() {
+		for i, le := range h.buckets {
+			lvs := append(append([]string(nil), mv.labelValues...), formatValue(le))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, lvs), mv.counts[i])
+		}
+		lvs := append(append([]string(nil), mv.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, lvs), mv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, mv.labelValues), formatValue(mv.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, mv.labelValues), mv.count)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueReplacer.Replace(v)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -48,6 +48,9 @@ func APNsMockServer(verbose bool) *http.ServeMux {
 			w.Header().Set("apns-id", "apns-id")
 			w.WriteHeader(http.StatusBadRequest)
 			createErrorResponse(w, apns.BadDeviceToken, http.StatusBadRequest)
+		} else if len(r.Header.Get("apns-collapse-id")) > apns.MaxCollapseIDSize {
+			w.WriteHeader(http.StatusBadRequest)
+			createErrorResponse(w, apns.BadCollapseId, http.StatusBadRequest)
 		} else if token == "missingtopic" {
 			w.WriteHeader(http.StatusBadRequest)
 			createErrorResponse(w, apns.MissingTopic, http.StatusBadRequest)
@@ -60,6 +63,13 @@ func APNsMockServer(verbose bool) *http.ServeMux {
 			// a later timestamp with your provider.
 			w.WriteHeader(http.StatusGone)
 			createErrorResponse(w, apns.Unregistered, http.StatusGone)
+		} else if token == "toomanyrequests" {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			createErrorResponse(w, apns.TooManyRequests, http.StatusTooManyRequests)
+		} else if token == "serviceunavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			createErrorResponse(w, apns.ServiceUnavailable, http.StatusServiceUnavailable)
 		} else if token == "expiredprovidertoken" {
 			w.WriteHeader(http.StatusForbidden)
 			createErrorResponse(w, apns.ExpiredProviderToken, http.StatusForbidden)
@@ -80,7 +90,7 @@ func createErrorResponse(w io.Writer, ermsg apns.ErrorResponseCode, status int)
 	if status == http.StatusGone {
 		er = apns.ErrorResponse{
 			Reason:    ermsg.String(),
-			Timestamp: time.Now().Unix(),
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
 		}
 	} else {
 		er = apns.ErrorResponse{
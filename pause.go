@@ -0,0 +1,99 @@
+package gunfish
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackoffResult is implemented by results which have the time the push service requested to wait
+// before sending again. (e.g. Retry-After header)
+type BackoffResult interface {
+	Backoff() time.Duration
+}
+
+// backoffOf returns the time the push service requested to wait.
+func backoffOf(result Result) time.Duration {
+	if r, ok := result.(BackoffResult); ok {
+		return r.Backoff()
+	}
+	return 0
+}
+
+// pauseTracker holds times until which sending to providers or apps is paused.
+type pauseTracker struct {
+	mu    sync.RWMutex
+	until map[string]time.Time // keyed by pauseKey
+}
+
+func newPauseTracker() *pauseTracker {
+	return &pauseTracker{
+		until: make(map[string]time.Time),
+	}
+}
+
+// pauseKey returns provider/app, or provider when the app is not resolved.
+func pauseKey(provider, app string) string {
+	if app == "" {
+		return provider
+	}
+	return provider + "/" + app
+}
+
+// pause pauses sending to the app of the provider for d.
+func (t *pauseTracker) pause(provider, app string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	key := pauseKey(provider, app)
+	until := time.Now().Add(d)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until.After(t.until[key]) {
+		t.until[key] = until
+		LogWithFields(logrus.Fields{"type": "pause", "provider": provider, "app": app}).
+			Warnf("Paused sending for %s as the push service requested.", d)
+	}
+}
+
+// remaining returns the time until sending to the app of the provider is resumed.
+func (t *pauseTracker) remaining(provider, app string) time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if d := time.Until(t.until[pauseKey(provider, app)]); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// wait blocks while sending to the app of the provider is paused. It returns false when exit is closed.
+func (t *pauseTracker) wait(provider, app string, exit <-chan struct{}) bool {
+	for {
+		d := t.remaining(provider, app)
+		if d <= 0 {
+			return true
+		}
+		if !sleep(d, exit) {
+			return false
+		}
+	}
+}
+
+// paused returns provider/app keys which are paused now, and forgets expired pauses.
+func (t *pauseTracker) paused() []string {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for key, until := range t.until {
+		if until.After(now) {
+			keys = append(keys, key)
+		} else {
+			delete(t.until, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,349 @@
+package gunfish
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+// errUnknownPriority is returned when the priority class is not configured.
+type errUnknownPriority string
+
+func (e errUnknownPriority) Error() string {
+	return "unknown priority: " + string(e)
+}
+
+// laneScheduler decides the lane to take the next item from.
+type laneScheduler struct {
+	weighted bool
+	weights  []int
+
+	mu      sync.Mutex
+	current []int // current weights of the smooth weighted round robin
+}
+
+func newLaneScheduler(conf config.SectionPriority, classes []config.PriorityClass) *laneScheduler {
+	s := &laneScheduler{
+		weighted: conf.Scheduling == config.SchedulingWeighted,
+		weights:  make([]int, len(classes)),
+		current:  make([]int, len(classes)),
+	}
+	for i, class := range classes {
+		s.weights[i] = class.Weight
+	}
+	return s
+}
+
+// pick returns the index of the lane to take the next item from. It returns -1 when all lanes are empty.
+func (s *laneScheduler) pick(lens []int) int {
+	if !s.weighted {
+		for i, n := range lens {
+			if n > 0 {
+				return i
+			}
+		}
+		return -1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	best, total := -1, 0
+	for i, n := range lens {
+		if n == 0 {
+			continue
+		}
+		s.current[i] += s.weights[i]
+		total += s.weights[i]
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		s.current[best] -= total
+	}
+	return best
+}
+
+// priorityClasses resolves priority classes of notifications.
+type priorityClasses struct {
+	classes []config.PriorityClass
+	index   map[string]int
+	apns    map[string]string // class names keyed by apns-priority
+	def     string
+	sched   config.SectionPriority
+}
+
+func newPriorityClasses(conf config.Config) *priorityClasses {
+	p := &priorityClasses{
+		classes: conf.Provider.Priority.AllClasses(conf.Provider.QueueSize),
+		index:   make(map[string]int),
+		apns:    make(map[string]string),
+		def:     conf.Provider.Priority.DefaultClass(),
+		sched:   conf.Provider.Priority,
+	}
+	for i, class := range p.classes {
+		p.index[class.Name] = i
+		for _, v := range class.ApnsPriorities {
+			p.apns[v] = class.Name
+		}
+	}
+	return p
+}
+
+// assign sets the priority class to the request. name is the class specified for the batch.
+// Without it, the class of the request is kept if configured, or derived from apns-priority.
+func (p *priorityClasses) assign(req *Request, name string) error {
+	if _, ok := p.index[req.priority]; name == "" && ok {
+		return nil
+	}
+	if name == "" {
+		if n, ok := req.Notification.(apns.Notification); ok {
+			name = p.apns[n.Header.ApnsPriority]
+		}
+	}
+	if name == "" {
+		name = p.def
+	}
+	if _, ok := p.index[name]; !ok {
+		return errUnknownPriority(name)
+	}
+	req.priority = name
+	return nil
+}
+
+// lane returns the index of the lane of the request.
+func (p *priorityClasses) lane(req Request) int {
+	if i, ok := p.index[req.priority]; ok {
+		return i
+	}
+	return p.index[p.def]
+}
+
+// requestLanes are queues of the supervisor for each priority class.
+type requestLanes struct {
+	*priorityClasses
+	queues []*fairQueue
+	ready  chan struct{} // has a token for each queued item
+	sched  *laneScheduler
+	pushMu sync.Mutex
+	counts []int64 // numbers of enqueued requests
+	drain  *drainRate
+
+	spaceMu sync.Mutex
+	space   chan struct{} // closed when items are taken
+}
+
+func newRequestLanes(classes *priorityClasses) *requestLanes {
+	l := &requestLanes{
+		priorityClasses: classes,
+		queues:          make([]*fairQueue, len(classes.classes)),
+		sched:           newLaneScheduler(classes.sched, classes.classes),
+		counts:          make([]int64, len(classes.classes)),
+		drain:           newDrainRate(),
+		space:           make(chan struct{}),
+	}
+	total := 0
+	for i, class := range classes.classes {
+		l.queues[i] = newFairQueue(class.QueueSize)
+		total += class.QueueSize
+	}
+	l.ready = make(chan struct{}, total)
+	return l
+}
+
+// push enqueues requests into lanes of their classes. It enqueues nothing and returns false
+// when any of the lanes is full.
+func (l *requestLanes) push(reqs *[]Request) bool {
+	items := make(map[int]*[]Request)
+	for _, req := range *reqs {
+		i := l.lane(req)
+		if items[i] == nil {
+			items[i] = &[]Request{}
+		}
+		*items[i] = append(*items[i], req)
+	}
+	if len(items) == 1 {
+		for i := range items {
+			items[i] = reqs
+		}
+	}
+
+	l.pushMu.Lock()
+	defer l.pushMu.Unlock()
+	for i := range items {
+		if l.queues[i].len() >= l.queues[i].cap() {
+			return false
+		}
+	}
+	// consumers only take items, so the lanes have space for all items
+	for i, item := range items {
+		l.queues[i].push(item)
+		l.ready <- struct{}{}
+	}
+	return true
+}
+
+// pop takes an item of the lanes which accept returns true for, after taking a token from ready.
+// It gives the token back and returns false when no lanes have items which can be accepted.
+func (l *requestLanes) pop(accept func(i int) bool) (*[]Request, bool) {
+	lens := make([]int, len(l.queues))
+	for {
+		skipped := false
+		for i, q := range l.queues {
+			lens[i] = q.len()
+			if lens[i] > 0 && !accept(i) {
+				lens[i] = 0
+				skipped = true
+			}
+		}
+		i := l.sched.pick(lens)
+		if i < 0 {
+			if skipped {
+				l.ready <- struct{}{}
+				return nil, false
+			}
+			// the item for the token is being enqueued
+			runtime.Gosched()
+			continue
+		}
+		if reqs, ok := l.queues[i].pop(); ok {
+			l.drain.add(len(*reqs), time.Now())
+			l.freed()
+			return reqs, true
+		}
+		// taken by another worker
+	}
+}
+
+// freed notifies waiters that items are taken.
+func (l *requestLanes) freed() {
+	l.spaceMu.Lock()
+	defer l.spaceMu.Unlock()
+	close(l.space)
+	l.space = make(chan struct{})
+}
+
+// pushWait enqueues requests like push. It waits for free space until the timeout passes or exit is closed.
+func (l *requestLanes) pushWait(reqs *[]Request, timeout time.Duration, exit <-chan struct{}) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		// takes the channel before pushing not to miss the notification
+		l.spaceMu.Lock()
+		space := l.space
+		l.spaceMu.Unlock()
+		if l.push(reqs) {
+			return true
+		}
+		if expired == nil {
+			return false
+		}
+		select {
+		case <-space:
+		case <-expired:
+			return false
+		case <-exit:
+			return false
+		}
+	}
+}
+
+// backlog returns the number of notifications in the lanes.
+func (l *requestLanes) backlog() int {
+	n := 0
+	for _, q := range l.queues {
+		n += q.backlog()
+	}
+	return n
+}
+
+// retryAfter returns the time for callers to wait before posting again when the lanes are full.
+func (l *requestLanes) retryAfter() time.Duration {
+	return drainWait(l.backlog(), l.drain.get(time.Now()))
+}
+
+// enqueued counts the request accepted by the supervisor.
+func (l *requestLanes) enqueued(req Request) {
+	atomic.AddInt64(&l.counts[l.lane(req)], 1)
+}
+
+// len returns the number of queued items.
+func (l *requestLanes) len() int {
+	return len(l.ready)
+}
+
+// cap returns the capacity of all lanes.
+func (l *requestLanes) cap() int {
+	return cap(l.ready)
+}
+
+// workerLanes are queues of a worker for each priority class.
+type workerLanes struct {
+	*priorityClasses
+	queues []chan Request
+	ready  chan struct{} // has a token for each queued request. it is closed to stop senders
+	sched  *laneScheduler
+}
+
+func newWorkerLanes(classes *priorityClasses, size int) *workerLanes {
+	l := &workerLanes{
+		priorityClasses: classes,
+		queues:          make([]chan Request, len(classes.classes)),
+		ready:           make(chan struct{}, size*len(classes.classes)),
+		sched:           newLaneScheduler(classes.sched, classes.classes),
+	}
+	for i := range l.queues {
+		l.queues[i] = make(chan Request, size)
+	}
+	return l
+}
+
+// push enqueues the request into the lane of its class. It returns false when the lane is full.
+func (l *workerLanes) push(req Request) bool {
+	select {
+	case l.queues[l.lane(req)] <- req:
+		l.ready <- struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+// pop takes a request after taking a token from ready.
+func (l *workerLanes) pop() Request {
+	lens := make([]int, len(l.queues))
+	for {
+		for i, q := range l.queues {
+			lens[i] = len(q)
+		}
+		i := l.sched.pick(lens)
+		if i < 0 {
+			runtime.Gosched()
+			continue
+		}
+		select {
+		case req := <-l.queues[i]:
+			return req
+		default:
+			// taken by another sender
+		}
+	}
+}
+
+// len returns the number of queued requests.
+func (l *workerLanes) len() int {
+	return len(l.ready)
+}
+
+// cap returns the capacity of all lanes.
+func (l *workerLanes) cap() int {
+	return cap(l.ready)
+}
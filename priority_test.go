@@ -0,0 +1,75 @@
+package gunfish_test
+
+import (
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestPriorityLanes(t *testing.T) {
+	c := conf
+	c.Provider.WorkerNum = 1
+	c.Provider.Priority = config.SectionPriority{
+		Scheduling: config.SchedulingStrict,
+		Classes: []config.PriorityClass{
+			{Name: "transactional", ApnsPriorities: []string{"10"}},
+			{Name: "bulk"},
+		},
+	}
+	// makes a backlog of bulk notifications
+	c.RateLimit = config.SectionRateLimit{Rate: 20, Burst: 1}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	token := "1122334455667788112233445566778811223344556677881122334455667788"
+	bulk := repeatRequestData(token, 60)
+	bulkBatch, err := sup.EnqueueBatch(&bulk, gunfish.BatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the priority class is specified for the batch
+	high := repeatRequestData(token, 1)
+	if _, err := sup.EnqueueBatch(&high, gunfish.BatchOptions{Priority: "unknown"}); err == nil {
+		t.Error("unknown priority must be rejected")
+	}
+	highBatch, err := sup.EnqueueBatch(&high, gunfish.BatchOptions{Priority: "transactional"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// or derived from apns-priority
+	derived := repeatRequestData(token, 1)
+	no := derived[0].Notification.(apns.Notification)
+	no.Header.ApnsPriority = "10"
+	derived[0].Notification = no
+	derivedBatch, err := sup.EnqueueBatch(&derived, gunfish.BatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 60 bulk notifications at 20/sec take 3 sec
+	for _, b := range []*gunfish.Batch{highBatch, derivedBatch} {
+		if !b.Wait(2 * time.Second) {
+			t.Fatal("transactional notifications were blocked by the bulk backlog")
+		}
+	}
+	if bulkBatch.Wait(0) {
+		t.Error("bulk notifications must be sent after transactional ones")
+	}
+	if !bulkBatch.Wait(10 * time.Second) {
+		t.Error("bulk batch was not finished")
+	}
+	entries := append(highBatch.Entries(), derivedBatch.Entries()...)
+	for _, e := range append(entries, bulkBatch.Entries()...) {
+		if e.State != gunfish.StateDelivered {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package gunfish
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+// PushProvider is a push service which the supervisor delivers notifications to.
+// A provider bundles the client, response classification and HTTP ingestion routes.
+type PushProvider interface {
+	// Name returns the name of the provider. (e.g. "apns")
+	Name() string
+
+	// Enabled reports whether the provider is enabled by the configuration.
+	Enabled(conf config.Config) bool
+
+	// NewClient creates a client. The supervisor creates a client for each worker.
+	NewClient(conf config.Config) (Client, error)
+
+	// Accepts reports whether the notification is sent by the provider.
+	Accepts(n Notification) bool
+
+	// Target returns the destination of the notification.
+	Target(n Notification) Target
+
+	// Classify decides how to handle the result or the error from the push service.
+	// result is nil when the request was not completed. (e.g. connection error)
+	Classify(result Result, err error) Action
+
+	// Routes returns HTTP handlers which accept notifications for the provider, keyed by path.
+	Routes(prov *Provider) map[string]http.HandlerFunc
+}
+
+// NotificationDecoder is implemented by providers whose notifications can be recorded in the write-ahead log.
+// Notifications are encoded by encoding/json.
+type NotificationDecoder interface {
+	DecodeNotification(data []byte) (Notification, error)
+}
+
+// Action tells the supervisor how to handle a response from a push service.
+type Action struct {
+	Retry             bool          // retries to send the notification
+	Delay             time.Duration // waits at least before enqueueing into the retry queue
+	Hook              bool          // invokes the error hook
+	CredentialFailure bool          // the push service rejected the credential
+	InvalidToken      bool          // the token is no longer valid, so it is recorded in the token registry
+}
+
+var (
+	pushProvidersMu sync.RWMutex
+	pushProviders   []PushProvider
+)
+
+// RegisterPushProvider makes a push provider available to the supervisor and the server.
+// It panics if a provider which has the same name is already registered.
+func RegisterPushProvider(p PushProvider) {
+	pushProvidersMu.Lock()
+	defer pushProvidersMu.Unlock()
+	for _, r := range pushProviders {
+		if r.Name() == p.Name() {
+			panic(fmt.Sprintf("push provider %s is already registered", p.Name()))
+		}
+	}
+	pushProviders = append(pushProviders, p)
+}
+
+// PushProviders returns the registered push providers.
+func PushProviders() []PushProvider {
+	pushProvidersMu.RLock()
+	defer pushProvidersMu.RUnlock()
+	return append([]PushProvider(nil), pushProviders...)
+}
+
+// pushProviderOf returns the provider which sends the notification.
+func pushProviderOf(n Notification) PushProvider {
+	pushProvidersMu.RLock()
+	defer pushProvidersMu.RUnlock()
+	for _, p := range pushProviders {
+		if p.Accepts(n) {
+			return p
+		}
+	}
+	return nil
+}
+
+// errNoClient is returned when a worker has no client of the provider.
+type errNoClient string
+
+func (e errNoClient) Error() string {
+	return string(e) + " client is not present"
+}
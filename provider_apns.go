@@ -0,0 +1,169 @@
+package gunfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func init() {
+	RegisterPushProvider(apnsProvider{})
+}
+
+// apnsProvider delivers notifications via APNs.
+type apnsProvider struct{}
+
+// apnsCredentialFailures are error reasons which mean that APNs rejects the credential.
+var apnsCredentialFailures = map[string]bool{
+	apns.BadCertificate.String():            true,
+	apns.BadCertificateEnvironment.String(): true,
+	apns.InvalidProviderToken.String():      true,
+	apns.MissingProviderToken.String():      true,
+}
+
+func (apnsProvider) Name() string {
+	return apns.Provider
+}
+
+func (apnsProvider) Enabled(conf config.Config) bool {
+	return conf.Apns.Enabled
+}
+
+func (apnsProvider) NewClient(conf config.Config) (Client, error) {
+	c := apnsClient{
+		router:  newAPNsRouter(conf.Apns),
+		clients: make(map[string]*apns.Client),
+	}
+	for _, app := range conf.Apns.AllApps() {
+		ac, err := apns.NewClient(conf.Apns.ForApp(app))
+		if err != nil {
+			return nil, fmt.Errorf("app %s: %s", app.Name, err)
+		}
+		c.clients[app.Name] = ac
+	}
+	return c, nil
+}
+
+func (apnsProvider) Accepts(n Notification) bool {
+	_, ok := n.(apns.Notification)
+	return ok
+}
+
+func (apnsProvider) DecodeNotification(data []byte) (Notification, error) {
+	var n apns.Notification
+	err := json.Unmarshal(data, &n)
+	return n, err
+}
+
+func (apnsProvider) Target(n Notification) Target {
+	no := n.(apns.Notification)
+	return Target{Provider: apns.Provider, App: no.App, Token: no.Token, Topic: no.Header.ApnsTopic}
+}
+
+func (apnsProvider) Classify(result Result, err error) Action {
+	if result == nil {
+		if _, ok := err.(errUnknownApp); ok {
+			return Action{}
+		}
+		// HTTP connection error with APNs
+		return Action{Retry: true}
+	}
+	reason := result.Err().Error()
+	return Action{
+		Retry:             apnsRetryableReasons[reason],
+		Hook:              true,
+		CredentialFailure: apnsCredentialFailures[reason],
+		InvalidToken:      reason == apns.Unregistered.String(),
+	}
+}
+
+// apnsRetryableReasons are reasons which are retried by default.
+var apnsRetryableReasons = map[string]bool{
+	apns.ExpiredProviderToken.String(): true, // the client renews the provider authentication token
+	apns.TooManyRequests.String():      true,
+	apns.InternalServerError.String():  true,
+	apns.ServiceUnavailable.String():   true,
+	apns.Shutdown.String():             true,
+}
+
+func (apnsProvider) Routes(prov *Provider) map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/push/apns": prov.PushAPNsHandler(),
+	}
+}
+
+// apnsClient sends notifications by the client of the app.
+type apnsClient struct {
+	router  *apnsRouter
+	clients map[string]*apns.Client // keyed by the app name
+}
+
+func (c apnsClient) Send(n Notification) ([]Result, error) {
+	no := n.(apns.Notification)
+	app, err := c.router.resolve(no)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.clients[app].Send(no)
+	rs := make([]Result, 0, len(results))
+	for _, v := range results {
+		v.App = app
+		rs = append(rs, v)
+	}
+	return rs, err
+}
+
+// errUnknownApp is returned when no app sends the notification.
+type errUnknownApp string
+
+func (e errUnknownApp) Error() string {
+	return string(e)
+}
+
+// apnsRouter decides the app which sends a notification.
+type apnsRouter struct {
+	apps   map[string]bool
+	topics map[string]string // bundle ID to the app name
+	only   string            // the app name when only one app is configured
+}
+
+func newAPNsRouter(conf config.SectionApns) *apnsRouter {
+	r := &apnsRouter{
+		apps:   make(map[string]bool),
+		topics: make(map[string]string),
+	}
+	apps := conf.AllApps()
+	for _, app := range apps {
+		r.apps[app.Name] = true
+		for _, topic := range app.Topics {
+			r.topics[topic] = app.Name
+		}
+	}
+	if len(apps) == 1 {
+		r.only = apps[0].Name
+	}
+	return r
+}
+
+// resolve returns the app name by the app of the notification, or apns-topic.
+func (r *apnsRouter) resolve(n apns.Notification) (string, error) {
+	if n.App != "" {
+		if !r.apps[n.App] {
+			return "", errUnknownApp(fmt.Sprintf("unknown APNs app: %s", n.App))
+		}
+		return n.App, nil
+	}
+	if app, ok := r.topics[apns.BundleID(n.Header.ApnsTopic)]; ok {
+		return app, nil
+	}
+	if r.only != "" {
+		return r.only, nil
+	}
+	if r.apps[config.DefaultApnsAppName] {
+		return config.DefaultApnsAppName, nil
+	}
+	return "", errUnknownApp(fmt.Sprintf("no APNs app for apns-topic: %s", n.Header.ApnsTopic))
+}
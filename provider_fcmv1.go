@@ -0,0 +1,158 @@
+package gunfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+func init() {
+	RegisterPushProvider(fcmv1Provider{})
+}
+
+// fcmv1Provider delivers notifications via FCM HTTP v1 API.
+type fcmv1Provider struct{}
+
+// fcmv1CredentialFailures are error statuses which mean that FCM rejects the credential.
+var fcmv1CredentialFailures = map[string]bool{
+	fcmv1.Unauthenticated:     true,
+	fcmv1.PermissionDenied:    true,
+	fcmv1.SenderIDMismatch:    true,
+	fcmv1.ThirdPartyAuthError: true,
+}
+
+func (fcmv1Provider) Name() string {
+	return fcmv1.Provider
+}
+
+func (fcmv1Provider) Enabled(conf config.Config) bool {
+	return conf.FCMv1.Enabled
+}
+
+func (fcmv1Provider) NewClient(conf config.Config) (Client, error) {
+	c := fcmv1Client{
+		router:  newFCMv1Router(conf.FCMv1),
+		clients: make(map[string]*fcmv1.Client),
+	}
+	for _, project := range conf.FCMv1.AllProjects() {
+		fc := conf.FCMv1.ForProject(project)
+		client, err := fcmv1.NewClient(fc.TokenSource, fc.ProjectID, fc.Endpoint, fcmv1.ClientTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("project %s: %s", project.Name, err)
+		}
+		c.clients[project.Name] = client
+	}
+	return c, nil
+}
+
+func (fcmv1Provider) Accepts(n Notification) bool {
+	_, ok := n.(fcmv1.Payload)
+	return ok
+}
+
+func (fcmv1Provider) DecodeNotification(data []byte) (Notification, error) {
+	var n fcmv1.Payload
+	err := json.Unmarshal(data, &n)
+	return n, err
+}
+
+func (fcmv1Provider) Target(n Notification) Target {
+	p := n.(fcmv1.Payload)
+	return Target{Provider: fcmv1.Provider, App: p.Project, Token: p.Message.Token, Topic: p.Message.Topic}
+}
+
+func (fcmv1Provider) Classify(result Result, err error) Action {
+	if result == nil {
+		if _, ok := err.(errUnknownProject); ok {
+			return Action{}
+		}
+		_, tokenErr := err.(fcmv1.TokenError)
+		return Action{Retry: true, CredentialFailure: tokenErr}
+	}
+	switch reason := result.Err().Error(); reason {
+	case fcmv1.Internal, fcmv1.Unavailable, fcmv1.QuotaExceeded:
+		return Action{Retry: true}
+	case fcmv1.Unregistered:
+		return Action{Hook: true, InvalidToken: true}
+	case fcmv1.InvalidArgument, fcmv1.NotFound:
+		return Action{Hook: true}
+	default:
+		return Action{CredentialFailure: fcmv1CredentialFailures[reason]}
+	}
+}
+
+func (fcmv1Provider) Routes(prov *Provider) map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/push/fcm/v1":         prov.PushFCMHandler(),
+		fcmv1ProjectPathPrefix: prov.PushFCMHandler(),
+	}
+}
+
+// fcmv1ProjectPathPrefix is the path to send notifications by the project. (e.g. /push/fcm/v1/{project})
+const fcmv1ProjectPathPrefix = "/push/fcm/v1/"
+
+// fcmv1Client sends notifications by the client of the project.
+type fcmv1Client struct {
+	router  *fcmv1Router
+	clients map[string]*fcmv1.Client // keyed by the project name
+}
+
+func (c fcmv1Client) Send(n Notification) ([]Result, error) {
+	p := n.(fcmv1.Payload)
+	project, err := c.router.resolve(p.Project)
+	if err != nil {
+		return nil, err
+	}
+	p.Project = project
+	results, err := c.clients[project].Send(p)
+	rs := make([]Result, 0, len(results))
+	for _, v := range results {
+		rs = append(rs, v)
+	}
+	return rs, err
+}
+
+// errUnknownProject is returned when no project sends the notification.
+type errUnknownProject string
+
+func (e errUnknownProject) Error() string {
+	return string(e)
+}
+
+// fcmv1Router decides the project which sends a notification.
+type fcmv1Router struct {
+	projects map[string]bool
+	only     string // the project name when only one project is configured
+}
+
+func newFCMv1Router(conf config.SectionFCMv1) *fcmv1Router {
+	r := &fcmv1Router{projects: make(map[string]bool)}
+	projects := conf.AllProjects()
+	for _, project := range projects {
+		r.projects[project.Name] = true
+	}
+	if len(projects) == 1 {
+		r.only = projects[0].Name
+	}
+	return r
+}
+
+// resolve returns the project name by the name which a notification specifies.
+func (r *fcmv1Router) resolve(name string) (string, error) {
+	if name != "" {
+		if !r.projects[name] {
+			return "", errUnknownProject(fmt.Sprintf("unknown FCM project: %s", name))
+		}
+		return name, nil
+	}
+	if r.only != "" {
+		return r.only, nil
+	}
+	if r.projects[config.DefaultFCMv1ProjectName] {
+		return config.DefaultFCMv1ProjectName, nil
+	}
+	return "", errUnknownProject("FCM project is not specified")
+}
@@ -0,0 +1,107 @@
+package gunfish_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+type echoNotification struct {
+	Token string
+}
+
+type echoResult struct {
+	token  string
+	reason string
+}
+
+func (r echoResult) Err() error {
+	if r.reason == "" {
+		return nil
+	}
+	return errors.New(r.reason)
+}
+func (r echoResult) Status() int                  { return http.StatusOK }
+func (r echoResult) Provider() string             { return "echo" }
+func (r echoResult) RecipientIdentifier() string  { return r.token }
+func (r echoResult) ExtraKeys() []string          { return nil }
+func (r echoResult) ExtraValue(key string) string { return "" }
+func (r echoResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"provider": "echo", "token": r.token, "reason": r.reason})
+}
+
+type echoClient struct{}
+
+func (echoClient) Send(n gunfish.Notification) ([]gunfish.Result, error) {
+	no := n.(echoNotification)
+	if no.Token == "invalid" {
+		return []gunfish.Result{echoResult{token: no.Token, reason: "Invalid"}}, nil
+	}
+	return []gunfish.Result{echoResult{token: no.Token}}, nil
+}
+
+type echoProvider struct{}
+
+func (echoProvider) Name() string                    { return "echo" }
+func (echoProvider) Enabled(conf config.Config) bool { return true }
+func (echoProvider) NewClient(config.Config) (gunfish.Client, error) {
+	return echoClient{}, nil
+}
+func (echoProvider) Accepts(n gunfish.Notification) bool {
+	_, ok := n.(echoNotification)
+	return ok
+}
+func (echoProvider) Target(n gunfish.Notification) gunfish.Target {
+	return gunfish.Target{Provider: "echo", Token: n.(echoNotification).Token}
+}
+func (echoProvider) Classify(result gunfish.Result, err error) gunfish.Action {
+	return gunfish.Action{}
+}
+func (echoProvider) Routes(prov *gunfish.Provider) map[string]http.HandlerFunc {
+	return nil
+}
+
+func init() {
+	gunfish.RegisterPushProvider(echoProvider{})
+}
+
+func TestRegisterPushProvider(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the same provider twice must panic")
+		}
+	}()
+	gunfish.RegisterPushProvider(echoProvider{})
+}
+
+func TestCustomPushProvider(t *testing.T) {
+	sup, err := gunfish.StartSupervisor(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	reqs := []gunfish.Request{
+		{Notification: echoNotification{Token: "valid"}},
+		{Notification: echoNotification{Token: "invalid"}},
+	}
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("timed out")
+	}
+	entries := batch.Entries()
+	if e := entries[0]; e.Provider != "echo" || e.Token != "valid" || e.State != gunfish.StateDelivered {
+		t.Errorf("unexpected result: %#v", e)
+	}
+	if e := entries[1]; e.State != gunfish.StateFailed || e.Reason != "Invalid" || e.RetryCount != 0 {
+		t.Errorf("unexpected result: %#v", e)
+	}
+}
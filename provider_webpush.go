@@ -0,0 +1,95 @@
+package gunfish
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/webpush"
+)
+
+func init() {
+	RegisterPushProvider(webpushProvider{})
+}
+
+// webpushProvider delivers notifications to browsers via Web Push.
+type webpushProvider struct{}
+
+func (webpushProvider) Name() string {
+	return webpush.Provider
+}
+
+func (webpushProvider) Enabled(conf config.Config) bool {
+	return conf.WebPush.Enabled
+}
+
+func (webpushProvider) NewClient(conf config.Config) (Client, error) {
+	c, err := webpush.NewClient(conf.WebPush.PrivateKey, conf.WebPush.Subject, webpush.ClientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.AllowedHosts = webpushAllowedHosts(conf.WebPush)
+	return webpushClient{c}, nil
+}
+
+func (webpushProvider) Accepts(n Notification) bool {
+	_, ok := n.(webpush.Notification)
+	return ok
+}
+
+func (webpushProvider) DecodeNotification(data []byte) (Notification, error) {
+	var n webpush.Notification
+	err := json.Unmarshal(data, &n)
+	return n, err
+}
+
+func (webpushProvider) Target(n Notification) Target {
+	no := n.(webpush.Notification)
+	// Topic of Web Push is chosen by callers freely, so it is not used as a label of metrics.
+	return Target{Provider: webpush.Provider, Token: no.Subscription.Endpoint}
+}
+
+func (webpushProvider) Classify(result Result, err error) Action {
+	if result == nil {
+		// HTTP connection error with the push service
+		return Action{Retry: true}
+	}
+	switch result.Err().Error() {
+	case webpush.TooManyRequests, webpush.ServerError:
+		return Action{Retry: true}
+	case webpush.Unauthorized:
+		return Action{Hook: true, CredentialFailure: true}
+	case webpush.Unregistered:
+		return Action{Hook: true, InvalidToken: true}
+	default:
+		return Action{Hook: true}
+	}
+}
+
+func (webpushProvider) Routes(prov *Provider) map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/push/webpush": prov.PushWebPushHandler(),
+	}
+}
+
+// webpushAllowedHosts returns the hosts of push services which notifications are sent to.
+func webpushAllowedHosts(conf config.SectionWebPush) []string {
+	if len(conf.AllowedHosts) == 0 {
+		return webpush.DefaultAllowedHosts
+	}
+	return conf.AllowedHosts
+}
+
+// webpushClient adapts webpush.Client to Client.
+type webpushClient struct {
+	*webpush.Client
+}
+
+func (c webpushClient) Send(n Notification) ([]Result, error) {
+	results, err := c.Client.Send(n.(webpush.Notification))
+	rs := make([]Result, 0, len(results))
+	for _, v := range results {
+		rs = append(rs, v)
+	}
+	return rs, err
+}
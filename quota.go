@@ -0,0 +1,192 @@
+package gunfish
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+// errQuotaExceeded is returned when the caller has too many notifications in queues.
+type errQuotaExceeded struct {
+	caller string
+	max    int
+}
+
+func (e errQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded: %s has %d notifications in queues at most", e.caller, e.max)
+}
+
+// callerQuotas counts notifications of callers in queues and limits them by the configuration.
+type callerQuotas struct {
+	mu     sync.Mutex
+	conf   config.SectionQuota
+	queued map[string]int
+}
+
+func newCallerQuotas() *callerQuotas {
+	return &callerQuotas{
+		queued: make(map[string]int),
+	}
+}
+
+// set replaces quotas by the configuration.
+func (q *callerQuotas) set(conf config.SectionQuota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.conf = conf
+}
+
+// known reports whether the caller is configured in [[provider.quota.callers]].
+func (q *callerQuotas) known(caller string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range q.conf.Callers {
+		if c.Name == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire counts n notifications of the caller. It returns errQuotaExceeded without counting them
+// when the caller exceeds max_queued.
+func (q *callerQuotas) acquire(caller string, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if max := q.conf.Caller(caller).MaxQueued; max > 0 && q.queued[caller]+n > max {
+		if caller != "" {
+			atomic.AddInt64(&(callerStats.get(caller).RejectedCount), int64(n))
+		}
+		return errQuotaExceeded{caller: caller, max: max}
+	}
+	q.add(caller, n)
+	return nil
+}
+
+// force counts n notifications of the caller regardless of max_queued.
+func (q *callerQuotas) force(caller string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(caller, n)
+}
+
+// release uncounts n notifications of the caller which got final results.
+func (q *callerQuotas) release(caller string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(caller, -n)
+}
+
+func (q *callerQuotas) add(caller string, n int) {
+	q.queued[caller] += n
+	if q.queued[caller] <= 0 {
+		delete(q.queued, caller)
+	}
+	if caller != "" {
+		atomic.StoreInt64(&(callerStats.get(caller).QueuedCount), int64(q.queued[caller]))
+	}
+}
+
+// weight returns the share of sending of the caller.
+func (q *callerQuotas) weight(caller string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.conf.Caller(caller).Weight
+}
+
+// fairQueue is a queue of requests which takes them fairly between callers.
+// Each caller has its virtual time which advances by the number of taken notifications divided by
+// its weight, and the caller which has the earliest virtual time is taken first.
+type fairQueue struct {
+	mu      sync.Mutex
+	size    int
+	n       int
+	reqs    int // number of queued notifications
+	callers map[string]*callerQueue
+	vtime   float64 // virtual time of the last taken caller
+}
+
+type callerQueue struct {
+	items []*[]Request
+	vtime float64
+}
+
+func newFairQueue(size int) *fairQueue {
+	return &fairQueue{
+		size:    size,
+		callers: make(map[string]*callerQueue),
+	}
+}
+
+// push enqueues requests of a caller. It returns false when the queue is full.
+func (q *fairQueue) push(reqs *[]Request) bool {
+	caller := ""
+	if len(*reqs) > 0 {
+		caller = (*reqs)[0].Caller()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n >= q.size {
+		return false
+	}
+	cq, ok := q.callers[caller]
+	if !ok {
+		// a caller which was idle starts from now not to take over others
+		cq = &callerQueue{vtime: q.vtime}
+		q.callers[caller] = cq
+	}
+	cq.items = append(cq.items, reqs)
+	q.n++
+	q.reqs += len(*reqs)
+	return true
+}
+
+// pop takes requests of the caller which has the earliest virtual time.
+func (q *fairQueue) pop() (*[]Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var (
+		next string
+		cq   *callerQueue
+	)
+	for caller, c := range q.callers {
+		if cq == nil || c.vtime < cq.vtime || c.vtime == cq.vtime && caller < next {
+			next, cq = caller, c
+		}
+	}
+	if cq == nil {
+		return nil, false
+	}
+	reqs := cq.items[0]
+	cq.items[0] = nil
+	cq.items = cq.items[1:]
+	q.n--
+	q.reqs -= len(*reqs)
+	q.vtime = cq.vtime
+	cq.vtime += float64(len(*reqs)) / float64(quotas.weight(next))
+	if len(cq.items) == 0 {
+		delete(q.callers, next)
+	}
+	return reqs, true
+}
+
+// len returns the number of queued items.
+func (q *fairQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// backlog returns the number of queued notifications.
+func (q *fairQueue) backlog() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.reqs
+}
+
+// cap returns the capacity of the queue.
+func (q *fairQueue) cap() int {
+	return q.size
+}
@@ -0,0 +1,54 @@
+package gunfish_test
+
+import (
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestCallerQuota(t *testing.T) {
+	c := conf
+	c.Provider.Quota = config.SectionQuota{
+		MaxQueued: 100,
+		Callers: []config.CallerQuota{
+			{Name: "campaign", MaxQueued: 5},
+		},
+	}
+	// keeps notifications in queues
+	c.RateLimit = config.SectionRateLimit{Rate: 10, Burst: 1}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	token := "1122334455667788112233445566778811223344556677881122334455667788"
+	enqueue := func(caller string, n int) (*gunfish.Batch, error) {
+		reqs := repeatRequestData(token, n)
+		return sup.EnqueueBatch(&reqs, gunfish.BatchOptions{Caller: caller})
+	}
+
+	campaign, err := enqueue("campaign", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enqueue("campaign", 1); err == nil {
+		t.Error("notifications over the quota must be rejected")
+	}
+	other, err := enqueue("transaction", 5)
+	if err != nil {
+		t.Errorf("other callers must not be affected: %s", err)
+	}
+
+	for _, b := range []*gunfish.Batch{campaign, other} {
+		if !b.Wait(5 * time.Second) {
+			t.Fatal("batch was not finished")
+		}
+	}
+	// finished notifications are released from the quota
+	if _, err := enqueue("campaign", 5); err != nil {
+		t.Error(err)
+	}
+}
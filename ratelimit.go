@@ -0,0 +1,146 @@
+package gunfish
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+// tokenBucket limits the rate of sending notifications.
+// Tokens can be borrowed for a short wait, so waiting senders take tokens in order of arrival.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait adds tokens since the last time, and returns the time to wait until the next token is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes a token. Tokens become negative when it is borrowed.
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// rateLimitRule is a token bucket of notifications which match the rule.
+type rateLimitRule struct {
+	config.RateLimitRule
+	bucket *tokenBucket
+}
+
+func (r rateLimitRule) match(t Target) bool {
+	return r.Provider == t.Provider &&
+		(r.App == "" || r.App == t.App) &&
+		(r.Topic == "" || r.Topic == t.Topic)
+}
+
+// waitRateLimits blocks until tokens of rate limits for the target are taken. It returns false when exit is closed.
+// Tokens are taken in advance for waits up to RateLimitMaxReservation only. Senders which must wait longer
+// wait without taking tokens, so that buckets do not go far negative.
+func waitRateLimits(t Target, exit <-chan struct{}) bool {
+	var waited time.Duration
+	defer func() {
+		if waited > 0 {
+			metrics.rateLimitWait.observe(waited.Seconds(), t.Provider)
+		}
+	}()
+	for {
+		d, ok := rateLimits.reserve(t, RateLimitMaxReservation)
+		if !ok {
+			d -= RateLimitMaxReservation
+		}
+		if d > 0 {
+			if !sleep(d, exit) {
+				return false
+			}
+			waited += d
+		}
+		if ok {
+			return true
+		}
+	}
+}
+
+// rateLimiter holds token buckets of the configuration.
+type rateLimiter struct {
+	mu     sync.Mutex
+	global *tokenBucket // nil means unlimited
+	rules  []rateLimitRule
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{}
+}
+
+// set replaces token buckets by the configuration.
+func (l *rateLimiter) set(conf config.SectionRateLimit) {
+	var global *tokenBucket
+	if conf.Rate > 0 {
+		global = newTokenBucket(conf.Rate, conf.Burst)
+	}
+	rules := make([]rateLimitRule, 0, len(conf.Rules))
+	for _, r := range conf.Rules {
+		rules = append(rules, rateLimitRule{RateLimitRule: r, bucket: newTokenBucket(r.Rate, r.Burst)})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = global
+	l.rules = rules
+}
+
+// reserve takes tokens of the global limit and all of rules which match the target,
+// and returns the time to wait until all of them are available.
+// When the wait exceeds max, it takes no tokens and returns false, so that the notification is sent later.
+func (l *rateLimiter) reserve(t Target, max time.Duration) (time.Duration, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buckets := make([]*tokenBucket, 0, len(l.rules)+1)
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+	for _, r := range l.rules {
+		if r.match(t) {
+			buckets = append(buckets, r.bucket)
+		}
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.wait(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > max {
+		return wait, false
+	}
+	for _, b := range buckets {
+		b.take()
+	}
+	return wait, true
+}
@@ -0,0 +1,103 @@
+package gunfish_test
+
+import (
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	c := conf
+	c.RateLimit = config.SectionRateLimit{
+		Rules: []config.RateLimitRule{
+			{Provider: "apns", Topic: "com.example.limited", Rate: 5, Burst: 1},
+		},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	send := func(topic string, n int) time.Duration {
+		reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", n)
+		for i := range reqs {
+			no := reqs[i].Notification.(apns.Notification)
+			no.Header.ApnsTopic = topic
+			reqs[i].Notification = no
+		}
+		start := time.Now()
+		batch, err := sup.EnqueueClientRequest(&reqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !batch.Wait(10 * time.Second) {
+			t.Fatal("batch was not finished")
+		}
+		for _, e := range batch.Entries() {
+			if e.State != gunfish.StateDelivered {
+				t.Errorf("unexpected entry: %#v", e)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// 6 notifications at 5/sec take 1 sec at least
+	if d := send("com.example.limited", 6); d < time.Second {
+		t.Errorf("notifications were not limited: %s", d)
+	}
+	if d := send("com.example.other", 6); d >= time.Second {
+		t.Errorf("notifications of other topics must not be limited: %s", d)
+	}
+}
+
+func TestRateLimitKeepsNotificationsQueued(t *testing.T) {
+	c := conf
+	// the retry queue has 200 notifications at most
+	c.Provider.WorkerNum = 1
+	c.Provider.RequestQueueSize = 200
+	c.Provider.EnqueueTimeout = config.Duration{Duration: 30 * time.Second}
+	c.RateLimit = config.SectionRateLimit{
+		Rules: []config.RateLimitRule{
+			{Provider: "apns", Topic: "com.example.limited", Rate: 50, Burst: 1},
+		},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	// more notifications than the retry queue, which callers enqueue as the queue has free space
+	var batches []*gunfish.Batch
+	for i := 0; i < 4; i++ {
+		reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 100)
+		for i := range reqs {
+			no := reqs[i].Notification.(apns.Notification)
+			no.Header.ApnsTopic = "com.example.limited"
+			reqs[i].Notification = no
+		}
+		batch, err := sup.EnqueueClientRequest(&reqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, batch)
+	}
+	failed := 0
+	for _, batch := range batches {
+		if !batch.Wait(30 * time.Second) {
+			t.Fatal("batch was not finished")
+		}
+		for _, e := range batch.Entries() {
+			if e.State != gunfish.StateDelivered || e.RetryCount != 0 {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		t.Errorf("%d notifications waiting for rate limits were not delivered", failed)
+	}
+}
@@ -0,0 +1,95 @@
+package gunfish
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Reload applies the configuration without dropping queued notifications.
+// Credentials, the number of workers, hooks and provider settings are replaced.
+// Settings which need to listen or to allocate queues again are not changed. (e.g. port, queue_size)
+func (prov *Provider) Reload(conf config.Config) error {
+	prov.reloadMu.Lock()
+	defer prov.reloadMu.Unlock()
+
+	prov.mu.RLock()
+	old := prov.conf
+	prov.mu.RUnlock()
+
+	logf := logrus.Fields{"type": "provider"}
+	conf.Apns.Host = old.Apns.Host
+	conf.Provider.Port = old.Provider.Port
+	conf.Provider.DebugPort = old.Provider.DebugPort
+	if conf.Provider.QueueSize != old.Provider.QueueSize ||
+		conf.Provider.RequestQueueSize != old.Provider.RequestQueueSize ||
+		conf.Provider.MaxConnections != old.Provider.MaxConnections {
+		LogWithFields(logf).Warnf("queue_size, max_request_size and max_connections are not reloaded. Restart Gunfish to change them.")
+	}
+	if conf.Provider.Hook != old.Provider.Hook {
+		LogWithFields(logf).Warnf("[provider.hook] is not reloaded. Restart Gunfish to change it.")
+	}
+
+	if err := prov.Sup.Reload(&conf); err != nil {
+		return err
+	}
+
+	prov.mu.Lock()
+	prov.settings = newProviderSettings(conf)
+	prov.conf = conf
+	prov.mu.Unlock()
+
+	// replaces hook commands unless the application sets its own handlers
+	erh, sh := responseHandlers()
+	if _, ok := erh.(DefaultResponseHandler); ok {
+		InitErrorResponseHandler(DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
+	}
+	if _, ok := sh.(DefaultResponseHandler); ok {
+		InitSuccessResponseHandler(DefaultResponseHandler{Hook: conf.Provider.SuccessHook})
+	}
+	setCertificateNotAfter(conf.Apns.CertificateNotAfter)
+
+	LogWithFields(logf).Infof("Reloaded configuration")
+	return nil
+}
+
+// ReloadConfigFile reads the configuration file again and reloads it.
+func (prov *Provider) ReloadConfigFile() error {
+	prov.mu.RLock()
+	path := prov.conf.Path()
+	prov.mu.RUnlock()
+	if path == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+
+	conf, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return prov.Reload(conf)
+}
+
+// ReloadHandler reloads the configuration file at POST /admin/reload.
+func (prov *Provider) ReloadHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&(srvStats.RequestCount), 1)
+
+		if err := validateMethod(res, req); err != nil {
+			logrus.Warn(err)
+			return
+		}
+
+		res.Header().Set("Content-Type", ApplicationJSON)
+		if err := prov.ReloadConfigFile(); err != nil {
+			LogWithFields(logrus.Fields{"type": "provider"}).Errorf("Failed to reload configuration: %s", err)
+			writeReason(res, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprint(res, `{"result":"ok"}`)
+	})
+}
@@ -1,19 +1,94 @@
 package gunfish
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/kayac/Gunfish/apns"
 )
 
 type Request struct {
 	Notification Notification
 	Tries        int
+	Metadata     json.RawMessage // opaque JSON object which is passed to response handlers and hooks with the result
+
+	batch      *Batch    // batch which the request belongs to, if tracked.
+	index      int       // index in the batch
+	enqueuedAt time.Time // time when the request was enqueued into the supervisor's queue
+	wal        *writeAheadLog
+	walID      string // ID of the record in the write-ahead log
+	priority   string // name of the priority class
+}
+
+// setState records the delivery state of the request.
+func (r Request) setState(state DeliveryState) {
+	if r.batch != nil {
+		r.batch.setState(r.index, r.Tries, state)
+	}
+}
+
+// BatchID returns the ID of the batch which the request belongs to.
+func (r Request) BatchID() string {
+	if r.batch != nil {
+		return r.batch.ID
+	}
+	return ""
+}
+
+// Caller returns the name of the caller which posted the request.
+func (r Request) Caller() string {
+	if r.batch != nil {
+		return r.batch.Caller
+	}
+	return ""
+}
+
+// finish records the final result of the request.
+func (r Request) finish(result Result, err error) {
+	t := targetOf(r.Notification)
+	if result != nil && result.Err() == nil && err == nil {
+		metrics.delivered.add(1, t.Provider, t.App, t.Topic)
+	} else {
+		metrics.failed.add(1, t.Provider, t.App, t.Topic, reasonLabel(result, err))
+	}
+	if r.batch != nil {
+		r.batch.finish(r.index, r.Tries, result, err)
+	}
+	if r.wal != nil {
+		r.wal.done(r.walID)
+	}
 }
 
 type Notification interface{}
 
 // PostedData is posted data to this provider server /push/apns.
 type PostedData struct {
-	Header  apns.Header  `json:"header,omitempty"`
-	Token   string       `json:"token"`
-	Payload apns.Payload `json:"payload"`
+	Header   apns.Header     `json:"header,omitempty"`
+	Token    string          `json:"token"`
+	Payload  apns.Payload    `json:"payload"`
+	App      string          `json:"app,omitempty"`      // name of the app in [[apns.apps]]
+	Metadata json.RawMessage `json:"metadata,omitempty"` // passed to hooks with the result
+}
+
+// compactMetadata validates metadata posted with a notification, and removes spaces
+// so that it fits in a line of JSON lines.
+func compactMetadata(m json.RawMessage) (json.RawMessage, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(m, &v); err != nil || v == nil {
+		return nil, errors.New("metadata must be a JSON object")
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, m); err != nil {
+		return nil, err
+	}
+	if b.Len() > MaxMetadataSize {
+		return nil, fmt.Errorf("metadata is too large. Be less than %d bytes: %d", MaxMetadataSize, b.Len())
+	}
+	return b.Bytes(), nil
 }
@@ -1,6 +1,11 @@
 package gunfish
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
 
 type Result interface {
 	Err() error
@@ -11,3 +16,78 @@ type Result interface {
 	ExtraValue(string) string
 	json.Marshaler
 }
+
+// RequestResult is a result with the request of the notification.
+// Response handlers, hooks and webhooks receive results as RequestResult.
+type RequestResult struct {
+	Result
+	Metadata     json.RawMessage // metadata which the caller posted with the notification
+	Notification Notification    // nil unless include_notification is enabled
+}
+
+// Unwrap returns the result from the push provider. (e.g. apns.Result, fcmv1.Result)
+func (r RequestResult) Unwrap() Result {
+	return r.Result
+}
+
+// MarshalJSON adds metadata and notification to the JSON object of the result.
+func (r RequestResult) MarshalJSON() ([]byte, error) {
+	b, err := r.Result.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Metadata) == 0 && r.Notification == nil {
+		return b, nil
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < 2 || b[len(b)-1] != '}' {
+		return nil, fmt.Errorf("result is not a JSON object: %s", b)
+	}
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1])
+	sep := ","
+	if len(bytes.TrimSpace(b[1:len(b)-1])) == 0 {
+		sep = ""
+	}
+	if len(r.Metadata) > 0 {
+		buf.WriteString(sep + `"metadata":`)
+		buf.Write(r.Metadata)
+		sep = ","
+	}
+	if r.Notification != nil {
+		n, err := json.Marshal(r.Notification)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(sep + `"notification":`)
+		buf.Write(n)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// includeNotification reports whether results for handlers and hooks include notifications.
+func includeNotification() bool {
+	return atomic.LoadInt32(&notificationIncluded) == 1
+}
+
+func setIncludeNotification(include bool) {
+	var v int32
+	if include {
+		v = 1
+	}
+	atomic.StoreInt32(&notificationIncluded, v)
+}
+
+// requestResult returns the result with the request for handlers and hooks.
+// It returns the result as is when there is nothing to add.
+func requestResult(req Request, result Result) Result {
+	if len(req.Metadata) == 0 && !includeNotification() {
+		return result
+	}
+	r := RequestResult{Result: result, Metadata: req.Metadata}
+	if includeNotification() {
+		r.Notification = req.Notification
+	}
+	return r
+}
@@ -0,0 +1,212 @@
+package gunfish
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+// retryPolicy decides whether and when a failed notification is sent again.
+type retryPolicy struct {
+	retry        *bool // nil means as the provider classifies
+	maxAttempts  int
+	backoff      string
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	jitter       float64
+}
+
+// builtinRetryPolicies are default policies which the configuration overrides.
+var builtinRetryPolicies = config.SectionRetry{
+	fcmv1.Provider: {
+		Reasons: map[string]config.RetryPolicy{
+			// FCM asks to wait for a while on exceeding the quota
+			fcmv1.QuotaExceeded: {
+				Backoff:      stringPtr(config.BackoffConstant),
+				InitialDelay: &config.Duration{Duration: time.Minute},
+			},
+		},
+	},
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// retryPolicySet holds retry policies of the configuration.
+type retryPolicySet struct {
+	mu       sync.RWMutex
+	policies config.SectionRetry
+}
+
+func newRetryPolicySet() *retryPolicySet {
+	return &retryPolicySet{policies: builtinRetryPolicies}
+}
+
+// set replaces the policies by the configuration.
+func (s *retryPolicySet) set(conf config.SectionRetry) {
+	merged := make(config.SectionRetry, len(builtinRetryPolicies)+len(conf))
+	for _, src := range []config.SectionRetry{builtinRetryPolicies, conf} {
+		for name, p := range src {
+			m := merged[name].Merge(p)
+			m.Reasons = make(map[string]config.RetryPolicy)
+			for reason, r := range merged[name].Reasons {
+				m.Reasons[reason] = r
+			}
+			for reason, r := range p.Reasons {
+				m.Reasons[reason] = m.Reasons[reason].Merge(r)
+			}
+			merged[name] = m
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = merged
+}
+
+// policy returns the policy for the reason of the provider.
+// Policies are applied in order of "default", the provider, reasons of "default" and reasons of the provider.
+func (s *retryPolicySet) policy(provider, reason string) retryPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	def, prov := s.policies["default"], s.policies[provider]
+	c := def.Merge(prov).Merge(def.Reasons[reason]).Merge(prov.Reasons[reason])
+
+	p := retryPolicy{
+		retry:        c.Retry,
+		maxAttempts:  config.DefaultRetryMaxAttempts,
+		backoff:      config.DefaultRetryBackoff,
+		initialDelay: config.DefaultRetryInitialDelay,
+		maxDelay:     config.DefaultRetryMaxDelay,
+		jitter:       config.DefaultRetryJitter,
+	}
+	if c.MaxAttempts != nil {
+		p.maxAttempts = *c.MaxAttempts
+	}
+	if c.Backoff != nil {
+		p.backoff = *c.Backoff
+	}
+	if c.InitialDelay != nil {
+		p.initialDelay = c.InitialDelay.Duration
+	}
+	if c.MaxDelay != nil {
+		p.maxDelay = c.MaxDelay.Duration
+	}
+	if c.Jitter != nil {
+		p.jitter = *c.Jitter
+	}
+	return p
+}
+
+// shouldRetry reports whether the notification is retried. act is the decision of the provider.
+func (p retryPolicy) shouldRetry(act Action) bool {
+	if p.retry != nil {
+		return *p.retry
+	}
+	return act.Retry
+}
+
+// exhausted reports whether the notification was sent max_attempts times.
+func (p retryPolicy) exhausted(req Request) bool {
+	return req.Tries+1 >= p.maxAttempts
+}
+
+// delay returns the delay before the n-th retry.
+func (p retryPolicy) delay(n int) time.Duration {
+	if !RetryBackoff || n < 1 {
+		return 0
+	}
+	d := float64(p.initialDelay)
+	switch p.backoff {
+	case config.BackoffLinear:
+		d *= float64(n)
+	case config.BackoffExponential:
+		d *= math.Pow(2, float64(n-1))
+	}
+	if p.jitter > 0 {
+		d += d * p.jitter * (rand.Float64()*2 - 1)
+	}
+	if p.maxDelay > 0 && d > float64(p.maxDelay) {
+		d = float64(p.maxDelay)
+	}
+	return time.Duration(d)
+}
+
+// delayedRetries enqueues requests into the retry queue after delays.
+// It keeps track of waiting requests, so that the supervisor drains them on shutdown.
+type delayedRetries struct {
+	retryq  chan<- Request
+	mu      sync.Mutex
+	timers  map[*time.Timer]delayedRetry
+	stopped bool
+}
+
+// delayedRetry is a request which waits for the delay.
+type delayedRetry struct {
+	req    Request
+	result Result
+	err    error
+}
+
+func newDelayedRetries(retryq chan<- Request) *delayedRetries {
+	return &delayedRetries{
+		retryq: retryq,
+		timers: make(map[*time.Timer]delayedRetry),
+	}
+}
+
+// after calls enqueue with the retry queue after d. enqueue must not block.
+// Requests are given up as stop does after the delayed retries were stopped.
+func (dr *delayedRetries) after(d time.Duration, r delayedRetry, enqueue func(retryq chan<- Request)) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if dr.stopped {
+		giveUpRetry(r)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		dr.mu.Lock()
+		defer dr.mu.Unlock()
+		if dr.stopped {
+			return // stop gave up the request
+		}
+		delete(dr.timers, t)
+		enqueue(dr.retryq)
+	})
+	dr.timers[t] = r
+}
+
+// len returns the number of requests which wait for delays.
+func (dr *delayedRetries) len() int {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	return len(dr.timers)
+}
+
+// stop stops timers and gives up requests which wait for delays. The retry queue is never used after stop.
+func (dr *delayedRetries) stop() int {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.stopped = true
+	n := len(dr.timers)
+	for t, r := range dr.timers {
+		t.Stop()
+		giveUpRetry(r)
+	}
+	dr.timers = make(map[*time.Timer]delayedRetry)
+	return n
+}
+
+// giveUpRetry leaves the request to the write-ahead log if it is recorded, or stores it as a dead letter.
+func giveUpRetry(r delayedRetry) {
+	if r.req.wal != nil {
+		return // the next process sends it again
+	}
+	putDeadLetter(r.req, r.result, r.err, DeadLetterShutdown)
+	r.req.finish(r.result, r.err)
+}
@@ -0,0 +1,187 @@
+package gunfish_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	maxAttempts := 3
+	never := false
+	c := conf
+	c.Retry = config.SectionRetry{
+		"apns": {
+			Reasons: map[string]config.RetryPolicy{
+				apns.ServiceUnavailable.String(): {MaxAttempts: &maxAttempts},
+				apns.Unregistered.String():       {Retry: &never},
+			},
+		},
+	}
+	var results []gunfish.Result
+	rec := resultRecorder{mu: &sync.Mutex{}, results: &results}
+	gunfish.InitErrorResponseHandler(rec)
+	defer gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
+
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	// ServiceUnavailable is retried by default
+	reqs := repeatRequestData("serviceunavailable", 1)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(10 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	for _, e := range batch.Entries() {
+		if e.State != gunfish.StateFailed || e.RetryCount != maxAttempts-1 {
+			t.Errorf("must be sent %d times: %#v", maxAttempts, e)
+		}
+	}
+	// the error handler gets the final result only
+	rec.mu.Lock()
+	if len(results) != 1 {
+		t.Errorf("the error handler was called %d times", len(results))
+	}
+	rec.mu.Unlock()
+
+	reqs = repeatRequestData("unregistered", 1)
+	batch, err = sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	for _, e := range batch.Entries() {
+		if e.State != gunfish.StateFailed || e.RetryCount != 0 {
+			t.Errorf("must not be retried: %#v", e)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	never := false
+	c := conf
+	c.Retry = config.SectionRetry{
+		"apns": {
+			Reasons: map[string]config.RetryPolicy{
+				apns.TooManyRequests.String(): {Retry: &never},
+			},
+		},
+	}
+	// the retry queue has 200 notifications at most
+	c.Provider.WorkerNum = 1
+	c.Provider.RequestQueueSize = 200
+	c.Provider.EnqueueTimeout = config.Duration{Duration: 10 * time.Second}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+
+	// APNs responds 429 with Retry-After: 1
+	reqs := repeatRequestData("toomanyrequests", 1)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	pausedAt := time.Now()
+
+	r, _ := http.NewRequest("GET", "/stats/app", nil)
+	w := httptest.NewRecorder()
+	prov.StatsHandler().ServeHTTP(w, r)
+	var stats gunfish.Stats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Paused) != 1 || stats.Paused[0] != "apns" {
+		t.Errorf("apns must be paused: %v", stats.Paused)
+	}
+
+	// notifications more than the retry queue are held in the queues, and sent after the window without counting retries
+	var batches []*gunfish.Batch
+	for i := 0; i < 3; i++ {
+		reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 100)
+		batch, err := sup.EnqueueClientRequest(&reqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, batch)
+	}
+	for _, batch := range batches {
+		if !batch.Wait(10 * time.Second) {
+			t.Fatal("batch was not finished")
+		}
+		for _, e := range batch.Entries() {
+			if e.State != gunfish.StateDelivered || e.RetryCount != 0 {
+				t.Errorf("unexpected entry: %#v", e)
+			}
+		}
+	}
+	if d := time.Since(pausedAt); d < 500*time.Millisecond {
+		t.Errorf("notification was sent while paused: %s", d)
+	}
+}
+
+func TestShutdownWithDelayedRetry(t *testing.T) {
+	gunfish.RetryBackoff = true
+	defer func() { gunfish.RetryBackoff = false }()
+
+	maxAttempts := 2
+	constant := config.BackoffConstant
+	jitter := 0.0
+	c := conf
+	c.Retry = config.SectionRetry{
+		"apns": {
+			Reasons: map[string]config.RetryPolicy{
+				apns.ServiceUnavailable.String(): {
+					MaxAttempts:  &maxAttempts,
+					Backoff:      &constant,
+					InitialDelay: &config.Duration{Duration: time.Second},
+					Jitter:       &jitter,
+				},
+			},
+		},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := repeatRequestData("serviceunavailable", 1)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; batch.Entries()[0].State != gunfish.StateRetrying; i++ {
+		if i > 100 {
+			t.Fatal("notification was not retried")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Shutdown waits for the retry after the delay
+	sup.Shutdown()
+	for _, e := range batch.Entries() {
+		if e.State != gunfish.StateFailed || e.RetryCount != maxAttempts-1 {
+			t.Errorf("must be sent %d times: %#v", maxAttempts, e)
+		}
+	}
+}
@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -21,6 +23,7 @@ import (
 	"github.com/kayac/Gunfish/apns"
 	"github.com/kayac/Gunfish/config"
 	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/webpush"
 	"github.com/lestrrat-go/server-starter/listener"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/netutil"
@@ -29,11 +32,70 @@ import (
 // Provider defines Gunfish httpHandler and has a state
 // of queue which is shared by the supervisor.
 type Provider struct {
-	Sup Supervisor
+	Sup *Supervisor
+
+	reloadMu sync.Mutex // serializes reloading
+	mu       sync.RWMutex
+	settings providerSettings // replaced on reloading
+	conf     config.Config    // the configuration which the provider runs with
+}
+
+// providerSettings are settings of Provider which are built from the configuration.
+type providerSettings struct {
+	syncTimeout  time.Duration  // max wait time for the synchronous mode
+	auth         *authenticator // authenticates callers. nil means no authentication
+	readiness    config.SectionReadiness
+	apnsApps     *apnsRouter  // resolves the APNs app of notifications. nil when APNs is disabled
+	fcmProjects  *fcmv1Router // resolves the FCM project of notifications. nil when FCM is disabled
+	webpushHosts []string     // hosts of push services which Web Push notifications are sent to
+}
+
+func newProviderSettings(conf config.Config) providerSettings {
+	ps := providerSettings{
+		syncTimeout: conf.Provider.SyncTimeout.Duration,
+		auth:        newAuthenticator(conf.Provider.Auth),
+		readiness:   conf.Provider.Readiness,
+	}
+	if conf.Apns.Enabled {
+		ps.apnsApps = newAPNsRouter(conf.Apns)
+	}
+	if conf.FCMv1.Enabled {
+		ps.fcmProjects = newFCMv1Router(conf.FCMv1)
+	}
+	if conf.WebPush.Enabled {
+		ps.webpushHosts = webpushAllowedHosts(conf.WebPush)
+	}
+	return ps
+}
+
+// NewProvider creates a Provider with the configuration.
+func NewProvider(sup *Supervisor, conf config.Config) *Provider {
+	return &Provider{
+		Sup:      sup,
+		settings: newProviderSettings(conf),
+		conf:     conf,
+	}
+}
+
+// current returns the current settings.
+func (prov *Provider) current() providerSettings {
+	prov.mu.RLock()
+	defer prov.mu.RUnlock()
+	return prov.settings
+}
+
+// SyncResponse is the response body of the synchronous mode.
+type SyncResponse struct {
+	Result   string       `json:"result"`
+	BatchID  string       `json:"batch_id"`
+	Rejected []string     `json:"rejected,omitempty"` // tokens which were rejected by the token registry
+	Results  []BatchEntry `json:"results"`
 }
 
 // ResponseHandler provides you to implement handling on success or on error response from apns.
 // Therefore, you can specifies hook command which is set at toml file.
+// OnResponse receives results as RequestResult, which has metadata of the notification,
+// when the notification has metadata or include_notification is enabled. Otherwise it receives results as is.
 type ResponseHandler interface {
 	OnResponse(Result)
 	HookCmd() string
@@ -48,8 +110,8 @@ type DefaultResponseHandler struct {
 func (rh DefaultResponseHandler) OnResponse(result Result) {
 }
 
-// HookCmd returns hook command to execute after getting response from APNS
-// only when to get error response.
+// HookCmd returns hook command to execute after getting response from APNS.
+// The error handler returns the error hook and the success handler returns the success hook.
 func (rh DefaultResponseHandler) HookCmd() string {
 	return rh.Hook
 }
@@ -57,17 +119,42 @@ func (rh DefaultResponseHandler) HookCmd() string {
 // StartServer starts an apns provider server on http.
 func StartServer(conf config.Config, env Environment) {
 	// Initialize DefaultResponseHandler if response handlers are not defined.
-	if successResponseHandler == nil {
-		InitSuccessResponseHandler(DefaultResponseHandler{})
+	erh, sh := responseHandlers()
+	if sh == nil {
+		InitSuccessResponseHandler(DefaultResponseHandler{Hook: conf.Provider.SuccessHook})
 	}
 
-	if errorResponseHandler == nil {
+	if erh == nil {
 		InitErrorResponseHandler(DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
 	}
 
+	if currentDeadLetterStore() == nil {
+		store, err := newDeadLetterStore(conf.Provider.DeadLetter)
+		if err != nil {
+			LogWithFields(logrus.Fields{
+				"type": "provider",
+			}).Fatalf("Failed to open the dead letter store: %s", err.Error())
+		}
+		if store != nil {
+			InitDeadLetterStore(store)
+		}
+	}
+
+	if currentTokenRegistry() == nil {
+		registry, err := newTokenRegistry(conf.Provider.TokenRegistry)
+		if err != nil {
+			LogWithFields(logrus.Fields{
+				"type": "provider",
+			}).Fatalf("Failed to open the token registry: %s", err.Error())
+		}
+		if registry != nil {
+			InitTokenRegistry(registry)
+		}
+	}
+
 	// Init Provider
 	srvStats = NewStats(conf)
-	prov := &Provider{}
+	setCertificateNotAfter(conf.Apns.CertificateNotAfter)
 
 	srvStats.DebugPort = conf.Provider.DebugPort
 	LogWithFields(logrus.Fields{
@@ -90,7 +177,12 @@ func StartServer(conf config.Config, env Environment) {
 			"type": "provider",
 		}).Fatalf("Failed to start Gunfish: %s", err.Error())
 	}
-	prov.Sup = sup
+	prov := NewProvider(sup, conf)
+	if prov.current().auth != nil {
+		LogWithFields(logrus.Fields{
+			"type": "provider",
+		}).Infof("Enable caller authentication")
+	}
 
 	LogWithFields(logrus.Fields{
 		"type": "supervisor",
@@ -138,25 +230,50 @@ func StartServer(conf config.Config, env Environment) {
 	}).Infof("Starts provider on :%d ...", conf.Provider.Port)
 
 	mux := http.NewServeMux()
-	if conf.Apns.Enabled {
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Infof("Enable endpoint /push/apns")
-		mux.HandleFunc("/push/apns", prov.PushAPNsHandler())
-	}
 	if conf.FCM.Enabled {
 		panic("FCM legacy is not supported")
 	}
-	if conf.FCMv1.Enabled {
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Infof("Enable endpoint /push/fcm/v1")
-		mux.HandleFunc("/push/fcm/v1", prov.PushFCMHandler())
+	for _, p := range PushProviders() {
+		if !p.Enabled(conf) {
+			continue
+		}
+		routes := p.Routes(prov)
+		paths := make([]string, 0, len(routes))
+		for path := range routes {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			LogWithFields(logrus.Fields{
+				"type":     "provider",
+				"provider": p.Name(),
+			}).Infof("Enable endpoint %s", path)
+			mux.HandleFunc(path, prov.AuthHandler(routes[path]))
+		}
 	}
-	mux.HandleFunc("/stats/app", prov.StatsHandler())
-	mux.HandleFunc("/stats/profile", stats_api.Handler)
+	mux.HandleFunc(StatusPathPrefix, prov.AuthHandler(prov.StatusHandler()))
+	mux.HandleFunc("/stats/app", prov.AuthHandler(prov.StatsHandler()))
+	mux.HandleFunc("/stats/profile", prov.AuthHandler(stats_api.Handler))
+	mux.HandleFunc("/metrics", prov.AuthHandler(prov.MetricsHandler()))
+	mux.HandleFunc("/dead-letters", prov.AuthHandler(prov.DeadLettersHandler()))
+	mux.HandleFunc("/invalid-tokens", prov.AuthHandler(prov.InvalidTokensHandler()))
+	mux.HandleFunc("/invalid-tokens/export", prov.AuthHandler(prov.ExportInvalidTokensHandler()))
+	mux.HandleFunc("/events", prov.AuthHandler(prov.EventsHandler()))
+	// endpoints which change the state are available only to authenticated callers
+	if conf.Provider.Auth.Enabled() {
+		mux.HandleFunc("/admin/reload", prov.AdminHandler(prov.ReloadHandler()))
+		mux.HandleFunc("/dead-letters/requeue", prov.AdminHandler(prov.RequeueDeadLettersHandler()))
+		mux.HandleFunc("/invalid-tokens/clear", prov.AdminHandler(prov.ClearInvalidTokensHandler()))
+	} else {
+		LogWithFields(logrus.Fields{"type": "provider"}).
+			Infof("Admin endpoints are disabled because [provider.auth] is not configured")
+	}
+	mux.HandleFunc("/healthz", prov.HealthHandler())
+	mux.HandleFunc("/readyz", prov.ReadinessHandler())
 
 	srv := &http.Server{Handler: mux}
+	// disconnects clients of the event stream, which Shutdown does not wait for
+	srv.RegisterOnShutdown(events.close)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -168,7 +285,7 @@ func StartServer(conf config.Config, env Environment) {
 
 	// signal handling
 	wg.Add(1)
-	go startSignalReciever(&wg, srv)
+	go startSignalReciever(&wg, srv, prov)
 
 	// wait for server shutdown complete
 	wg.Wait()
@@ -200,68 +317,103 @@ func (prov *Provider) PushAPNsHandler() http.HandlerFunc {
 			body := req.FormValue("json")
 			if err := json.Unmarshal([]byte(body), &ps); err != nil {
 				LogWithFields(logrus.Fields{}).Warnf("%s: %s", err, body)
-				res.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(res, `{"reason": "%s"}`, err.Error())
+				writeReason(res, http.StatusBadRequest, err.Error())
 				return
 			}
 		case ApplicationJSON:
 			decoder := json.NewDecoder(req.Body)
 			if err := decoder.Decode(&ps); err != nil {
 				LogWithFields(logrus.Fields{}).Warnf("%s: %v", err, ps)
-				res.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(res, `{"reason": "%s"}`, err.Error())
+				writeReason(res, http.StatusBadRequest, err.Error())
 				return
 			}
 		default:
 			// Unsupported Media Type
 			logrus.Warnf("Unsupported Media Type: %s", c)
-			res.WriteHeader(http.StatusUnsupportedMediaType)
-			fmt.Fprintf(res, `{"reason":"Unsupported Media Type"}`)
+			writeReason(res, http.StatusUnsupportedMediaType, "Unsupported Media Type")
 			return
 		}
 
 		// Validates posted data
 		if err := validatePostedData(ps); err != nil {
-			res.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(res, `{"reason":"%s"}`, err.Error())
+			writeReason(res, http.StatusBadRequest, err.Error())
 			return
 		}
 
 		// Create requests
 		reqs := make([]Request, len(ps))
 		for i, p := range ps {
-			switch t := p.Payload.Alert.(type) {
-			case map[string]interface{}:
-				var alert apns.Alert
-				mapToAlert(t, &alert)
-				p.Payload.Alert = alert
+			no := apns.Notification{
+				Header:  p.Header,
+				Token:   p.Token,
+				Payload: p.Payload,
+				App:     p.App,
 			}
-
-			req := Request{
-				Notification: apns.Notification{
-					Header:  p.Header,
-					Token:   p.Token,
-					Payload: p.Payload,
-				},
-				Tries: 0,
+			// Resolves the app here to reject notifications which no app can send
+			if apps := prov.current().apnsApps; apps != nil {
+				app, err := apps.resolve(no)
+				if err != nil {
+					writeReason(res, http.StatusBadRequest, err.Error())
+					return
+				}
+				no.App = app
+			}
+			metadata, err := compactMetadata(p.Metadata)
+			if err != nil {
+				writeReason(res, http.StatusBadRequest, err.Error())
+				return
+			}
+			reqs[i] = Request{
+				Notification: no,
+				Tries:        0,
+				Metadata:     metadata,
 			}
+		}
+
+		prov.enqueue(res, req, reqs)
+	})
+}
 
-			reqs[i] = req
+func (prov *Provider) PushFCMHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&(srvStats.RequestCount), 1)
+
+		// Method Not Alllowed
+		if err := validateMethod(res, req); err != nil {
+			logrus.Warn(err)
+			return
 		}
 
-		// enqueues one request into supervisor's queue.
-		if err := prov.Sup.EnqueueClientRequest(&reqs); err != nil {
-			setRetryAfter(res, req, err.Error())
+		// only Content-Type application/json
+		c := req.Header.Get("Content-Type")
+		if c != ApplicationJSON {
+			// Unsupported Media Type
+			logrus.Warnf("Unsupported Media Type: %s", c)
+			writeReason(res, http.StatusUnsupportedMediaType, "Unsupported Media Type")
 			return
 		}
 
-		// success
-		res.WriteHeader(http.StatusOK)
-		fmt.Fprint(res, "{\"result\": \"ok\"}")
+		// create request for fcm
+		grs, err := newFCMRequests(req.Body)
+		if err == nil {
+			var project string
+			if strings.HasPrefix(req.URL.Path, fcmv1ProjectPathPrefix) {
+				project = strings.TrimPrefix(req.URL.Path, fcmv1ProjectPathPrefix)
+			}
+			err = prov.resolveFCMProjects(grs, project)
+		}
+		if err != nil {
+			logrus.Warnf("bad request: %s", err)
+			writeReason(res, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		prov.enqueue(res, req, grs)
 	})
 }
 
-func (prov *Provider) PushFCMHandler() http.HandlerFunc {
+// PushWebPushHandler accepts notifications for push subscriptions of browsers.
+func (prov *Provider) PushWebPushHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		atomic.AddInt64(&(srvStats.RequestCount), 1)
 
@@ -276,30 +428,122 @@ func (prov *Provider) PushFCMHandler() http.HandlerFunc {
 		if c != ApplicationJSON {
 			// Unsupported Media Type
 			logrus.Warnf("Unsupported Media Type: %s", c)
-			res.WriteHeader(http.StatusUnsupportedMediaType)
-			fmt.Fprintf(res, `{"reason":"Unsupported Media Type"}`)
+			writeReason(res, http.StatusUnsupportedMediaType, "Unsupported Media Type")
 			return
 		}
 
-		// create request for fcm
-		grs, err := newFCMRequests(req.Body)
+		hosts := prov.current().webpushHosts
+		if hosts == nil {
+			hosts = webpush.DefaultAllowedHosts
+		}
+		reqs, err := newWebPushRequests(req.Body, hosts)
 		if err != nil {
 			logrus.Warnf("bad request: %s", err)
-			res.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(res, "{\"reason\":\"%s\"}", err.Error())
+			writeReason(res, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		// enqueues one request into supervisor's queue.
-		if err := prov.Sup.EnqueueClientRequest(&grs); err != nil {
-			setRetryAfter(res, req, err.Error())
+		prov.enqueue(res, req, reqs)
+	})
+}
+
+// enqueue enqueues reqs into supervisor's queue and writes the response.
+// In the synchronous mode, it waits for the results of all notifications.
+func (prov *Provider) enqueue(res http.ResponseWriter, req *http.Request, reqs []Request) {
+	wait, timeout, err := prov.syncOptions(req)
+	if err != nil {
+		writeReason(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	priority := req.URL.Query().Get("priority")
+	if priority == "" {
+		priority = req.Header.Get(PriorityHeader)
+	}
+
+	// enqueues one request into supervisor's queue.
+	batch, err := prov.Sup.EnqueueBatch(&reqs, BatchOptions{
+		Caller:   CallerName(req.Context()),
+		Priority: priority,
+	})
+	if err != nil {
+		switch err.(type) {
+		case errUnknownPriority:
+			writeReason(res, http.StatusBadRequest, err.Error())
+			return
+		case errQuotaExceeded:
+			// other callers are not affected
+			writeReason(res, http.StatusTooManyRequests, err.Error())
 			return
 		}
+		prov.setRetryAfter(res, req, err.Error())
+		return
+	}
 
+	rejected := batch.Rejected()
+	if !wait {
 		// success
 		res.WriteHeader(http.StatusOK)
-		fmt.Fprint(res, "{\"result\": \"ok\"}")
-	})
+		if len(rejected) > 0 {
+			b, _ := json.Marshal(rejected)
+			fmt.Fprintf(res, `{"result": "ok", "batch_id": "%s", "rejected": %s}`, batch.ID, b)
+			return
+		}
+		fmt.Fprintf(res, `{"result": "ok", "batch_id": "%s"}`, batch.ID)
+		return
+	}
+
+	sr := SyncResponse{Result: "ok", BatchID: batch.ID, Rejected: rejected}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	if !batch.WaitContext(ctx) {
+		if req.Context().Err() != nil {
+			// the client went away. notifications are sent in the background
+			LogWithFields(logrus.Fields{"type": "provider", "batch_id": batch.ID}).
+				Debugf("Stopped waiting for results: %s", req.Context().Err())
+			return
+		}
+		sr.Result = "timeout"
+	}
+	sr.Results = batch.Entries()
+	res.Header().Set("Content-Type", ApplicationJSON)
+	res.WriteHeader(http.StatusOK)
+	json.NewEncoder(res).Encode(sr)
+}
+
+// syncOptions returns whether the request wants the synchronous mode and how long to wait.
+func (prov *Provider) syncOptions(req *http.Request) (bool, time.Duration, error) {
+	v := req.URL.Query().Get("sync")
+	if v == "" {
+		v = req.Header.Get(SyncHeader)
+	}
+	if v == "" {
+		return false, 0, nil
+	}
+	wait, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, 0, fmt.Errorf("invalid sync parameter: %s", v)
+	}
+
+	max := prov.current().syncTimeout
+	if max <= 0 {
+		max = config.DefaultSyncTimeout
+	}
+	t := req.URL.Query().Get("timeout")
+	if t == "" {
+		t = req.Header.Get(SyncTimeoutHeader)
+	}
+	if t == "" {
+		return wait, max, nil
+	}
+	timeout, err := time.ParseDuration(t)
+	if err != nil || timeout <= 0 {
+		return false, 0, fmt.Errorf("invalid timeout parameter: %s", t)
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return wait, timeout, nil
 }
 
 func newFCMRequests(src io.Reader) ([]Request, error) {
@@ -308,7 +552,10 @@ func newFCMRequests(src io.Reader) ([]Request, error) {
 	count := 0
 PAYLOADS:
 	for {
-		var payload fcmv1.Payload
+		var payload struct {
+			fcmv1.Payload
+			Metadata json.RawMessage `json:"metadata,omitempty"`
+		}
 		if err := dec.Decode(&payload); err != nil {
 			if err == io.EOF {
 				break PAYLOADS
@@ -320,28 +567,98 @@ PAYLOADS:
 		if count >= fcmv1.MaxBulkRequests {
 			return nil, errors.New("Too many requests")
 		}
-		reqs = append(reqs, Request{Notification: payload, Tries: 0})
+		metadata, err := compactMetadata(payload.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, Request{Notification: payload.Payload, Tries: 0, Metadata: metadata})
+	}
+	return reqs, nil
+}
+
+// resolveFCMProjects sets the project to the payloads. pathProject is the project in the path. (e.g. /push/fcm/v1/{project})
+func (prov *Provider) resolveFCMProjects(reqs []Request, pathProject string) error {
+	if strings.Contains(pathProject, "/") {
+		return fmt.Errorf("invalid project: %s", pathProject)
+	}
+	projects := prov.current().fcmProjects
+	if projects == nil {
+		return nil
+	}
+	for i, req := range reqs {
+		p := req.Notification.(fcmv1.Payload)
+		if pathProject != "" {
+			if p.Project != "" && p.Project != pathProject {
+				return fmt.Errorf("project %s does not match the path: %s", p.Project, pathProject)
+			}
+			p.Project = pathProject
+		}
+		project, err := projects.resolve(p.Project)
+		if err != nil {
+			return err
+		}
+		p.Project = project
+		reqs[i].Notification = p
+	}
+	return nil
+}
+
+func newWebPushRequests(src io.Reader, hosts []string) ([]Request, error) {
+	var ns []struct {
+		webpush.Notification
+		Metadata json.RawMessage `json:"metadata,omitempty"`
+	}
+	if err := json.NewDecoder(src).Decode(&ns); err != nil {
+		return nil, err
+	}
+	if len(ns) == 0 {
+		return nil, errors.New("notifications must not be empty")
+	}
+	if len(ns) > config.MaxRequestSize {
+		return nil, fmt.Errorf("notifications was too long. Be less than %d: %d", config.MaxRequestSize, len(ns))
+	}
+	reqs := make([]Request, 0, len(ns))
+	for _, n := range ns {
+		if err := n.Validate(); err != nil {
+			return nil, err
+		}
+		if !webpush.AllowedHost(n.Subscription.Endpoint, hosts) {
+			return nil, fmt.Errorf("the host of subscription.endpoint is not a push service: %s", n.Subscription.Endpoint)
+		}
+		metadata, err := compactMetadata(n.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, Request{Notification: n.Notification, Tries: 0, Metadata: metadata})
 	}
 	return reqs, nil
 }
 
 func validateMethod(res http.ResponseWriter, req *http.Request) error {
 	if req.Method != "POST" {
-		res.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Fprintf(res, "{\"reason\":\"Method Not Allowed.\"}")
+		writeReason(res, http.StatusMethodNotAllowed, "Method Not Allowed.")
 		return fmt.Errorf("Method Not Allowed: %s", req.Method)
 	}
 	return nil
 }
 
-func setRetryAfter(res http.ResponseWriter, req *http.Request, reason string) {
-	now := time.Now().Unix()
-	atomic.StoreInt64(&(srvStats.ServiceUnavailableAt), now)
-	updateRetryAfterStat(now - srvStats.ServiceUnavailableAt)
+// setRetryAfter responds 503 with Retry-After which is the time to send the backlog of the queue.
+// writeReason writes the status code and the error body which has the reason as a JSON string.
+func writeReason(res http.ResponseWriter, code int, reason string) {
+	b, _ := json.Marshal(struct {
+		Reason string `json:"reason"`
+	}{reason})
+	res.WriteHeader(code)
+	res.Write(b)
+}
+
+func (prov *Provider) setRetryAfter(res http.ResponseWriter, req *http.Request, reason string) {
+	atomic.StoreInt64(&(srvStats.ServiceUnavailableAt), time.Now().Unix())
+	ra := int64(math.Ceil(prov.Sup.lanes.retryAfter().Seconds()))
+	atomic.StoreInt64(&(srvStats.RetryAfter), ra)
 	// Retry-After is set seconds
-	res.Header().Set("Retry-After", fmt.Sprintf("%d", srvStats.RetryAfter))
-	res.WriteHeader(http.StatusServiceUnavailable)
-	fmt.Fprintf(res, fmt.Sprintf(`{"reason":"%s"}`, reason))
+	res.Header().Set("Retry-After", fmt.Sprintf("%d", ra))
+	writeReason(res, http.StatusServiceUnavailable, reason)
 }
 
 func (prov *Provider) StatsHandler() http.HandlerFunc {
@@ -351,25 +668,46 @@ func (prov *Provider) StatsHandler() http.HandlerFunc {
 		}
 
 		wqs := 0
-		for _, w := range prov.Sup.workers {
-			wqs += len(w.queue)
+		for _, w := range prov.Sup.workerList() {
+			wqs += w.lanes.len()
 		}
 
-		atomic.StoreInt64(&(srvStats.QueueSize), int64(len(prov.Sup.queue)))
+		atomic.StoreInt64(&(srvStats.QueueSize), int64(prov.Sup.lanes.len()))
 		atomic.StoreInt64(&(srvStats.RetryQueueSize), int64(len(prov.Sup.retryq)))
 		atomic.StoreInt64(&(srvStats.WorkersQueueSize), int64(wqs))
 		atomic.StoreInt64(&(srvStats.CommandQueueSize), int64(len(prov.Sup.cmdq)))
 		res.WriteHeader(http.StatusOK)
 		encoder := json.NewEncoder(res)
-		err := encoder.Encode(srvStats.GetStats())
+		st := srvStats.GetStats()
+		st.Priorities = prov.Sup.priorityStats()
+		err := encoder.Encode(st)
 		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, `{"reason":"Internal Server Error"}`)
+			writeReason(res, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
 	})
 }
 
+// StatusHandler returns results of notifications in the batch at /push/status/{id}.
+func (prov *Provider) StatusHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ok := validateStatsHandler(res, req); ok != true {
+			return
+		}
+
+		id := strings.TrimPrefix(req.URL.Path, StatusPathPrefix)
+		batch, ok := prov.Sup.Batch(id)
+		if !ok {
+			writeReason(res, http.StatusNotFound, "batch is not found: "+id)
+			return
+		}
+
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		json.NewEncoder(res).Encode(batch.Status())
+	})
+}
+
 func validatePostedData(ps []PostedData) error {
 	if len(ps) == 0 {
 		return fmt.Errorf("PostedData must not be empty: %v", ps)
@@ -383,6 +721,12 @@ func validatePostedData(ps []PostedData) error {
 		if p.Payload.APS == nil || p.Token == "" {
 			return fmt.Errorf("Payload format was malformed: %v", p.Payload)
 		}
+		if err := p.Header.Validate(); err != nil {
+			return err
+		}
+		if err := p.Payload.Validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -390,8 +734,7 @@ func validatePostedData(ps []PostedData) error {
 func validateStatsHandler(res http.ResponseWriter, req *http.Request) bool {
 	// Method Not Alllowed
 	if req.Method != "GET" {
-		res.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Fprintf(res, `{"reason":"Method Not Allowed."}`)
+		writeReason(res, http.StatusMethodNotAllowed, "Method Not Allowed.")
 		logrus.Warnf("Method Not Allowed: %s", req.Method)
 		return false
 	}
@@ -399,55 +742,43 @@ func validateStatsHandler(res http.ResponseWriter, req *http.Request) bool {
 	return true
 }
 
-func mapToAlert(mapVal map[string]interface{}, alert *apns.Alert) {
-	a := reflect.ValueOf(alert).Elem()
-	for k, v := range mapVal {
-		newk, ok := AlertKeyToField[k]
-		if ok == true {
-			a.FieldByName(newk).Set(reflect.ValueOf(v))
-		} else {
-			logrus.Warnf("\"%s\" is not supported key for Alert struct.", k)
-		}
-	}
-}
-
-func startSignalReciever(wg *sync.WaitGroup, srv *http.Server) {
+func startSignalReciever(wg *sync.WaitGroup, srv *http.Server, prov *Provider) {
 	defer wg.Done()
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
-	s := <-sigChan
-	switch s {
-	case syscall.SIGHUP:
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Info("Gunfish recieved SIGHUP signal.")
-		srv.Shutdown(context.Background())
-	case syscall.SIGTERM:
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Info("Gunfish recieved SIGTERM signal.")
-		srv.Shutdown(context.Background())
-	case syscall.SIGINT:
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Info("Gunfish recieved SIGINT signal. Stopping server now...")
-		srv.Shutdown(context.Background())
-	}
-}
-
-func updateRetryAfterStat(x int64) {
-	var nxtRA int64
-	if x > int64(ResetRetryAfterSecond/time.Second) {
-		nxtRA = int64(RetryAfterSecond / time.Second)
-	} else {
-		a := int64(math.Log(float64(10/(x+1) + 1)))
-		if srvStats.RetryAfter+2*a < int64(ResetRetryAfterSecond/time.Second) {
-			nxtRA = srvStats.RetryAfter + 2*a
-		} else {
-			nxtRA = int64(ResetRetryAfterSecond / time.Second)
+	for s := range sigChan {
+		switch s {
+		case syscall.SIGHUP:
+			LogWithFields(logrus.Fields{
+				"type": "provider",
+			}).Info("Gunfish recieved SIGHUP signal. Reloading configuration...")
+			if err := prov.ReloadConfigFile(); err != nil {
+				LogWithFields(logrus.Fields{
+					"type": "provider",
+				}).Errorf("Failed to reload configuration: %s", err)
+			}
+		case syscall.SIGTERM:
+			LogWithFields(logrus.Fields{
+				"type": "provider",
+			}).Info("Gunfish recieved SIGTERM signal.")
+			prov.Sup.StartDraining()
+			if d := prov.current().readiness.DrainGracePeriod.Duration; d > 0 {
+				// load balancers observe /readyz and stop sending requests
+				LogWithFields(logrus.Fields{
+					"type": "provider",
+				}).Infof("Waiting %s for load balancers to stop sending requests...", d)
+				time.Sleep(d)
+			}
+			srv.Shutdown(context.Background())
+			return
+		case syscall.SIGINT:
+			LogWithFields(logrus.Fields{
+				"type": "provider",
+			}).Info("Gunfish recieved SIGINT signal. Stopping server now...")
+			prov.Sup.StartDraining()
+			srv.Shutdown(context.Background())
+			return
 		}
 	}
-
-	atomic.StoreInt64(&(srvStats.RetryAfter), nxtRA)
 }
@@ -2,6 +2,7 @@ package gunfish_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,7 +10,10 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	gunfish "github.com/kayac/Gunfish"
 	"github.com/kayac/Gunfish/apns"
@@ -93,6 +97,104 @@ func TestSuccessToPostJson(t *testing.T) {
 	sup.Shutdown()
 }
 
+func TestSyncPostJson(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushAPNsHandler()
+
+	jsons := createJSONPostedData(3)
+	w := httptest.NewRecorder()
+	r, err := newRequest(jsons, "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	r.URL.RawQuery = "sync=true&timeout=5s"
+
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+
+	var sr gunfish.SyncResponse
+	if err := json.NewDecoder(w.Body).Decode(&sr); err != nil {
+		t.Error(err)
+	}
+	if sr.Result != "ok" {
+		t.Errorf("unexpected result: %s", sr.Result)
+	}
+	if len(sr.Results) != 3 {
+		t.Fatalf("unexpected results length: %d", len(sr.Results))
+	}
+	for _, e := range sr.Results {
+		if !e.Done || e.Status != http.StatusOK || e.APNsID != "apns-id" || e.Provider != apns.Provider {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+	}
+
+	sup.Shutdown()
+}
+
+func TestBatchStatus(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	prov := &gunfish.Provider{Sup: sup}
+	pushh := prov.PushAPNsHandler()
+	statush := prov.StatusHandler()
+
+	r, err := newRequest(createJSONPostedData(2), "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	w := httptest.NewRecorder()
+	pushh.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+	var pr struct {
+		BatchID string `json:"batch_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&pr); err != nil {
+		t.Error(err)
+	}
+	if pr.BatchID == "" {
+		t.Fatal("batch_id is empty")
+	}
+
+	var st gunfish.BatchStatus
+	for i := 0; i < 50; i++ {
+		r, _ := http.NewRequest("GET", gunfish.StatusPathPrefix+pr.BatchID, nil)
+		w := httptest.NewRecorder()
+		statush.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code is 200 but got %d", w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		if st.FinishedAt != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if st.FinishedAt == nil || len(st.Results) != 2 {
+		t.Fatalf("batch is not finished: %#v", st)
+	}
+	for _, e := range st.Results {
+		if e.State != gunfish.StateDelivered {
+			t.Errorf("unexpected state: %#v", e)
+		}
+	}
+
+	// unknown batch
+	r, _ = http.NewRequest("GET", gunfish.StatusPathPrefix+"unknown", nil)
+	w = httptest.NewRecorder()
+	statush.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code is 404 but got %d", w.Code)
+	}
+
+	sup.Shutdown()
+}
+
 func TestFailedToPostInvalidJson(t *testing.T) {
 	sup, _ := gunfish.StartSupervisor(&conf)
 	prov := &gunfish.Provider{Sup: sup}
@@ -117,6 +219,144 @@ func TestFailedToPostInvalidJson(t *testing.T) {
 	sup.Shutdown()
 }
 
+func TestPushFCMProjects(t *testing.T) {
+	c := conf
+	c.FCMv1.Projects = []config.SectionFCMv1Project{
+		{Name: "second", ProjectID: "second"},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	handler := gunfish.NewProvider(sup, c).PushFCMHandler()
+
+	testCases := []struct {
+		path string
+		body string
+		code int
+	}{
+		{path: "/push/fcm/v1", body: `{"message":{"token":"xxx"}}`, code: http.StatusOK},
+		{path: "/push/fcm/v1", body: `{"message":{"token":"xxx"},"project":"second"}`, code: http.StatusOK},
+		{path: "/push/fcm/v1", body: `{"message":{"token":"xxx"},"project":"unknown"}`, code: http.StatusBadRequest},
+		{path: "/push/fcm/v1/second", body: `{"message":{"token":"xxx"}}`, code: http.StatusOK},
+		{path: "/push/fcm/v1/unknown", body: `{"message":{"token":"xxx"}}`, code: http.StatusBadRequest},
+		{path: "/push/fcm/v1/second", body: `{"message":{"token":"xxx"},"project":"default"}`, code: http.StatusBadRequest},
+		{path: "/push/fcm/v1/a%22b", body: `{"message":{"token":"xxx"}}`, code: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		r, _ := http.NewRequest("POST", tc.path, bytes.NewBufferString(tc.body))
+		r.Header.Set("Content-Type", gunfish.ApplicationJSON)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: expected status code is %d but got %d", tc.path, tc.body, tc.code, w.Code)
+		}
+		if w.Code != http.StatusOK && !json.Valid(w.Body.Bytes()) {
+			t.Errorf("%s %s: invalid error body: %s", tc.path, tc.body, w.Body.String())
+		}
+	}
+}
+
+func TestPushWebPush(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushWebPushHandler()
+
+	testTable := []struct {
+		body string
+		code int
+	}{
+		{
+			body: `[{"subscription":{"endpoint":"https://fcm.googleapis.com/fcm/send/xxx","keys":{"p256dh":"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4","auth":"BTBZMqHH6r4Tts7J_aSIgg"}},"payload":{"title":"hello"},"urgency":"high"}]`,
+			code: http.StatusOK,
+		},
+		{
+			body: `[{"subscription":{"endpoint":"https://fcm.googleapis.com/fcm/send/xxx","keys":{"p256dh":"invalid","auth":"BTBZMqHH6r4Tts7J_aSIgg"}}}]`,
+			code: http.StatusBadRequest,
+		},
+		{
+			body: `[{"subscription":{"endpoint":"https://169.254.169.254/latest/meta-data/","keys":{"p256dh":"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4","auth":"BTBZMqHH6r4Tts7J_aSIgg"}}}]`,
+			code: http.StatusBadRequest,
+		},
+		{
+			body: `[]`,
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range testTable {
+		r, err := newRequest([]byte(tt.body), "POST", gunfish.ApplicationJSON)
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("Expected status code is %d but got %d: %s", tt.code, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusOK && !json.Valid(w.Body.Bytes()) {
+			t.Errorf("invalid error body: %s", w.Body.String())
+		}
+	}
+
+	sup.Shutdown()
+}
+
+func TestSyncPostCanceled(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushAPNsHandler()
+
+	r, err := newRequest(createJSONPostedData(1), "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.URL.RawQuery = "sync=true&timeout=10s"
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	// the mock server responds after 100ms at least
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited for results after the client went away: %s", d)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestErrorReasonIsJSON(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushAPNsHandler()
+
+	r, err := newRequest(createJSONPostedData(1), "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Go string syntax escapes the control character as \x01, which is invalid in JSON
+	r.Header.Set(gunfish.PriorityHeader, "\"quoted\"\x01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code is 400 but got %d", w.Code)
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Reason != "unknown priority: \"quoted\"\x01" {
+		t.Errorf("unexpected reason: %s", body.Reason)
+	}
+}
+
 func TestFailedToPostMalformedJson(t *testing.T) {
 	sup, _ := gunfish.StartSupervisor(&conf)
 	prov := &gunfish.Provider{Sup: sup}
@@ -331,6 +571,238 @@ func TestStats(t *testing.T) {
 	sup.Shutdown()
 }
 
+func TestPushAPNsApps(t *testing.T) {
+	c := conf
+	c.Apns.Apps = []config.SectionApnsApp{
+		{
+			Name:     "second",
+			CertFile: conf.Apns.CertFile,
+			KeyFile:  conf.Apns.KeyFile,
+			Topics:   []string{"com.example.second"},
+		},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := gunfish.NewProvider(sup, c)
+	pushh := prov.PushAPNsHandler()
+	statsh := prov.StatsHandler()
+
+	post := func(p gunfish.PostedData) int {
+		b, _ := json.Marshal([]gunfish.PostedData{p})
+		r, _ := newRequest(b, "POST", gunfish.ApplicationJSON)
+		w := httptest.NewRecorder()
+		pushh.ServeHTTP(w, r)
+		return w.Code
+	}
+	var pds []gunfish.PostedData
+	json.Unmarshal(createPostedData(1), &pds)
+
+	unknown := pds[0]
+	unknown.App = "unknown"
+	if code := post(unknown); code != http.StatusBadRequest {
+		t.Errorf("unknown app must be rejected: %d", code)
+	}
+
+	// routed by apns-topic
+	byTopic := pds[0]
+	byTopic.Header.ApnsTopic = "com.example.second"
+	if code := post(byTopic); code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", code)
+	}
+
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		r, _ := newRequest(nil, "GET", gunfish.ApplicationJSON)
+		w := httptest.NewRecorder()
+		statsh.ServeHTTP(w, r)
+		var stats gunfish.Stats
+		json.NewDecoder(w.Body).Decode(&stats)
+		if stats.Apps["apns/second"].SentCount > 0 {
+			return
+		}
+	}
+	t.Error("notification was not sent by the app second")
+}
+
+func TestMetrics(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	prov := &gunfish.Provider{Sup: sup}
+	pushh := prov.PushAPNsHandler()
+	metricsh := prov.MetricsHandler()
+
+	r, err := newRequest(createJSONPostedData(1), "POST", gunfish.ApplicationJSON)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	r.URL.RawQuery = "sync=true"
+	pushh.ServeHTTP(httptest.NewRecorder(), r)
+
+	r, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsh.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != gunfish.PrometheusContentType {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	body := w.Body.String()
+	for _, s := range []string{
+		`gunfish_notifications_delivered_total{provider="apns",app="",topic=""} `,
+		`gunfish_send_duration_seconds_bucket{provider="apns",le="+Inf"} `,
+		`gunfish_queue_duration_seconds_count{provider="apns"} `,
+		`gunfish_queue_capacity{queue="supervisor",worker=""} 200`,
+		`gunfish_queue_length{queue="worker",worker="0"} `,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("metrics does not contain %s", s)
+		}
+	}
+
+	sup.Shutdown()
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	sup, _ := gunfish.StartSupervisor(&conf)
+	prov := gunfish.NewProvider(sup, conf)
+	healthh := prov.HealthHandler()
+	readyh := prov.ReadinessHandler()
+
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	healthh.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+
+	r, _ = http.NewRequest("GET", "/readyz", nil)
+	w = httptest.NewRecorder()
+	readyh.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	// draining starts on the signal before the server stops accepting requests
+	sup.StartDraining()
+	defer sup.Shutdown()
+
+	w = httptest.NewRecorder()
+	readyh.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code is 503 but got %d", w.Code)
+	}
+	var rr gunfish.ReadinessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rr); err != nil {
+		t.Error(err)
+	}
+	if rr.Status != "unavailable" || len(rr.Reasons) == 0 || rr.Reasons[0] != "supervisor is draining" {
+		t.Errorf("unexpected readiness response: %#v", rr)
+	}
+
+	w = httptest.NewRecorder()
+	healthh.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d", w.Code)
+	}
+}
+
+func TestReload(t *testing.T) {
+	src, err := os.ReadFile("./test/gunfish_test.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "gunfish.toml")
+	writeConf := func(workerNum string) {
+		b := bytes.Replace(src, []byte("worker_num = 8"), []byte("worker_num = "+workerNum), 1)
+		if err := os.WriteFile(fn, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConf("4")
+	c, err := config.LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Apns.Host = conf.Apns.Host
+
+	sup, _ := gunfish.StartSupervisor(&c)
+	defer sup.Shutdown()
+	prov := gunfish.NewProvider(sup, c)
+	reloadh := prov.ReloadHandler()
+	metricsh := prov.MetricsHandler()
+
+	workers := func() int {
+		r, _ := http.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		metricsh.ServeHTTP(w, r)
+		return strings.Count(w.Body.String(), `gunfish_queue_length{queue="worker"`)
+	}
+	reload := func() int {
+		r, _ := http.NewRequest("POST", "/admin/reload", nil)
+		w := httptest.NewRecorder()
+		reloadh.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if n := workers(); n != 4 {
+		t.Fatalf("unexpected number of workers: %d", n)
+	}
+
+	writeConf("6")
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", code)
+	}
+	if n := workers(); n != 6 {
+		t.Errorf("workers must be added: %d", n)
+	}
+
+	writeConf("2")
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", code)
+	}
+	for i := 0; i < 50 && workers() != 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := workers(); n != 2 {
+		t.Errorf("workers must be removed: %d", n)
+	}
+
+	// notifications are sent by reloaded workers
+	jsons := createJSONPostedData(1)
+	r, _ := newRequest(jsons, "POST", gunfish.ApplicationJSON)
+	r.Header.Set(gunfish.SyncHeader, "true")
+	w := httptest.NewRecorder()
+	prov.PushAPNsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code is 200 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	// invalid configuration is not applied
+	if err := os.WriteFile(fn, []byte("[provider]\nworker_num = 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload(); code != http.StatusInternalServerError {
+		t.Errorf("Expected status code is 500 but got %d", code)
+	}
+	if n := workers(); n != 2 {
+		t.Errorf("workers must not be changed: %d", n)
+	}
+
+	// no parts are applied when a part of the configuration fails
+	bad := c
+	bad.Provider.WorkerNum = 6
+	bad.Provider.ErrorWebhook = config.SectionWebhook{URL: "http://%zz"}
+	if err := prov.Reload(bad); err == nil {
+		t.Error("reloading an invalid webhook must fail")
+	}
+	if n := workers(); n != 2 {
+		t.Errorf("workers must not be changed: %d", n)
+	}
+}
+
 func newRequest(data []byte, method string, c string) (*http.Request, error) {
 	req, err := http.NewRequest(
 		method,
@@ -2,6 +2,8 @@ package gunfish
 
 import (
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kayac/Gunfish/config"
@@ -9,24 +11,127 @@ import (
 
 // Stats stores metrics
 type Stats struct {
-	Pid                    int       `json:"pid"`
-	DebugPort              int       `json:"debug_port"`
-	Uptime                 int64     `json:"uptime"`
-	StartAt                int64     `json:"start_at"`
-	ServiceUnavailableAt   int64     `json:"su_at"`
-	Period                 int64     `json:"period"`
-	RetryAfter             int64     `json:"retry_after"`
-	Workers                int64     `json:"workers"`
-	QueueSize              int64     `json:"queue_size"`
-	RetryQueueSize         int64     `json:"retry_queue_size"`
-	WorkersQueueSize       int64     `json:"workers_queue_size"`
-	CommandQueueSize       int64     `json:"cmdq_queue_size"`
-	RetryCount             int64     `json:"retry_count"`
-	RequestCount           int64     `json:"req_count"`
-	SentCount              int64     `json:"sent_count"`
-	ErrCount               int64     `json:"err_count"`
-	CertificateNotAfter    time.Time `json:"certificate_not_after"`
-	CertificateExpireUntil int64     `json:"certificate_expire_until"`
+	Pid                    int                      `json:"pid"`
+	DebugPort              int                      `json:"debug_port"`
+	Uptime                 int64                    `json:"uptime"`
+	StartAt                int64                    `json:"start_at"`
+	ServiceUnavailableAt   int64                    `json:"su_at"`
+	Period                 int64                    `json:"period"`
+	RetryAfter             int64                    `json:"retry_after"`
+	Workers                int64                    `json:"workers"`
+	QueueSize              int64                    `json:"queue_size"`
+	RetryQueueSize         int64                    `json:"retry_queue_size"`
+	WorkersQueueSize       int64                    `json:"workers_queue_size"`
+	CommandQueueSize       int64                    `json:"cmdq_queue_size"`
+	RetryCount             int64                    `json:"retry_count"`
+	RequestCount           int64                    `json:"req_count"`
+	SentCount              int64                    `json:"sent_count"`
+	ErrCount               int64                    `json:"err_count"`
+	AuthFailureCount       int64                    `json:"auth_failure_count"`
+	DeadLetterCount        int64                    `json:"dead_letter_count"`
+	CertificateNotAfter    time.Time                `json:"certificate_not_after"`
+	CertificateExpireUntil int64                    `json:"certificate_expire_until"`
+	Callers                map[string]CallerStats   `json:"callers,omitempty"`
+	Apps                   map[string]AppStats      `json:"apps,omitempty"`
+	Paused                 []string                 `json:"paused,omitempty"`
+	Priorities             map[string]PriorityStats `json:"priorities,omitempty"`
+}
+
+// PriorityStats stores metrics of a priority class
+type PriorityStats struct {
+	QueueSize        int64 `json:"queue_size"`
+	QueueCapacity    int64 `json:"queue_capacity"`
+	WorkersQueueSize int64 `json:"workers_queue_size"`
+	EnqueuedCount    int64 `json:"enqueued_count"`
+}
+
+// CallerStats stores metrics of an authenticated caller
+type CallerStats struct {
+	RequestCount      int64 `json:"req_count"`
+	NotificationCount int64 `json:"notification_count"`
+	QueuedCount       int64 `json:"queued_count"`   // notifications in queues which have no final results
+	RejectedCount     int64 `json:"rejected_count"` // notifications rejected by the quota
+}
+
+// callerStatsMap holds CallerStats by key name
+type callerStatsMap struct {
+	mu sync.Mutex
+	m  map[string]*CallerStats
+}
+
+func (cs *callerStatsMap) get(name string) *CallerStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.m == nil {
+		cs.m = make(map[string]*CallerStats)
+	}
+	st, ok := cs.m[name]
+	if !ok {
+		st = &CallerStats{}
+		cs.m[name] = st
+	}
+	return st
+}
+
+func (cs *callerStatsMap) snapshot() map[string]CallerStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.m) == 0 {
+		return nil
+	}
+	m := make(map[string]CallerStats, len(cs.m))
+	for name, st := range cs.m {
+		m[name] = CallerStats{
+			RequestCount:      atomic.LoadInt64(&st.RequestCount),
+			NotificationCount: atomic.LoadInt64(&st.NotificationCount),
+			QueuedCount:       atomic.LoadInt64(&st.QueuedCount),
+			RejectedCount:     atomic.LoadInt64(&st.RejectedCount),
+		}
+	}
+	return m
+}
+
+// AppStats stores metrics of an app, keyed by "provider/app"
+type AppStats struct {
+	SentCount int64 `json:"sent_count"`
+	ErrCount  int64 `json:"err_count"`
+}
+
+// appStatsMap holds AppStats by provider and app name
+type appStatsMap struct {
+	mu sync.Mutex
+	m  map[string]*AppStats
+}
+
+func (as *appStatsMap) get(provider, app string) *AppStats {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.m == nil {
+		as.m = make(map[string]*AppStats)
+	}
+	key := provider + "/" + app
+	st, ok := as.m[key]
+	if !ok {
+		st = &AppStats{}
+		as.m[key] = st
+	}
+	return st
+}
+
+func (as *appStatsMap) snapshot() map[string]AppStats {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if len(as.m) == 0 {
+		return nil
+	}
+	m := make(map[string]AppStats, len(as.m))
+	for key, st := range as.m {
+		m[key] = AppStats{
+			SentCount: atomic.LoadInt64(&st.SentCount),
+			ErrCount:  atomic.LoadInt64(&st.ErrCount),
+		}
+	}
+	return m
 }
 
 // NewStats initialize Stats
@@ -39,13 +144,37 @@ func NewStats(conf config.Config) Stats {
 	}
 }
 
+// setCertificateNotAfter sets the expiration of the APNs certificate.
+func setCertificateNotAfter(t time.Time) {
+	var n int64
+	if !t.IsZero() {
+		n = t.UnixNano()
+	}
+	atomic.StoreInt64(&certificateNotAfter, n)
+}
+
+// loadCertificateNotAfter returns the expiration of the APNs certificate, or zero time if unknown.
+func loadCertificateNotAfter() time.Time {
+	n := atomic.LoadInt64(&certificateNotAfter)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
 // GetStats returns MemdStats of app
 func (st *Stats) GetStats() *Stats {
 	preUptime := st.Uptime
 	st.Uptime = time.Now().Unix() - st.StartAt
 	st.Period = st.Uptime - preUptime
+	if na := loadCertificateNotAfter(); !na.IsZero() {
+		st.CertificateNotAfter = na
+	}
 	if !st.CertificateNotAfter.IsZero() {
 		st.CertificateExpireUntil = int64(st.CertificateNotAfter.Sub(time.Now()).Seconds())
 	}
+	st.Callers = callerStats.snapshot()
+	st.Apps = appStats.snapshot()
+	st.Paused = pauses.paused()
 	return st
 }
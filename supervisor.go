@@ -2,44 +2,102 @@ package gunfish
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"os/exec"
+	"reflect"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
-	"github.com/kayac/Gunfish/apns"
 	"github.com/kayac/Gunfish/config"
-	"github.com/kayac/Gunfish/fcmv1"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// Errors for notifications which could not be sent
+var (
+	errSupervisorQueueFull = errors.New("supervisor queue is full")
+	errResponseQueueFull   = errors.New("response queue is full")
+	errUnknownRequest      = errors.New("unknown request data type")
+	errWALClosed           = errors.New("write-ahead log is closed")
+	errSupervisorStopped   = errors.New("supervisor was stopped")
+)
+
+// reasonLabel returns a reason of the failure for metrics labels.
+func reasonLabel(result Result, err error) string {
+	if result != nil {
+		if rerr := result.Err(); rerr != nil {
+			return rerr.Error()
+		}
+	}
+	switch err.(type) {
+	case nil:
+		return ""
+	case errNoClient:
+		return err.Error()
+	}
+	switch err {
+	case errSupervisorQueueFull, errResponseQueueFull, errUnknownRequest:
+		return err.Error()
+	}
+	return "connection error"
+}
+
 // Supervisor monitor mutiple http2 clients.
 type Supervisor struct {
-	queue   chan *[]Request // supervisor's queue that recieves POST requests.
+	lanes   *requestLanes   // supervisor's queues of priority classes that recieve POST requests.
 	retryq  chan Request    // enqueues this retry queue when to failed to send notification on the http layer.
-	cmdq    chan Command    // enqueues this command queue when to get error response from apns.
+	delayed *delayedRetries // requests which wait for delays before entering the retry queue
+	cmdq    chan Command    // enqueues this command queue when to get a result for hooks.
 	exit    chan struct{}   // exit channel is used to stop the supervisor.
 	ticker  *time.Ticker    // ticker checks retry queue that has notifications to resend periodically.
 	wgrp    *sync.WaitGroup
-	workers []*Worker
+	batches *batchStore    // batches holds results of accepted batches for the status API.
+	wal     *writeAheadLog // wal records accepted notifications durably. nil means disabled
+
+	workersMu    sync.Mutex
+	workers      []*Worker
+	nextWorkerID int
+	wqSize       int // size of each worker's queue
+
+	enqueueTimeout int64 // time.Duration to wait for free space of the queue. it is replaced on reloading
+	draining       int32 // draining is set to 1 when the supervisor begins to shut down.
 }
 
-// Worker sends notification to apns.
+// Worker sends notification to push services.
 type Worker struct {
-	ac    *apns.Client
-	fcv1  *fcmv1.Client
-	queue chan Request
-	respq chan SenderResponse
-	wgrp  *sync.WaitGroup
-	sn    int
-	id    int
+	clients *clientSet   // clients of enabled providers. they are replaced on reloading
+	lanes   *workerLanes // queues of priority classes which senders take requests from
+	pending [][]Request  // requests which wait for free space of lanes, for each priority class
+	npend   int64        // number of pending requests
+	respq   chan SenderResponse
+	wgrp    *sync.WaitGroup
+	stop    chan struct{} // stop channel is closed to remove the worker on reloading
+	sn      int
+	id      int
+}
+
+// clientSet holds clients of enabled providers keyed by the provider name.
+type clientSet struct {
+	mu sync.RWMutex
+	m  map[string]Client
+}
+
+func (cs *clientSet) get(name string) (Client, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	c, ok := cs.m[name]
+	return c, ok
+}
+
+func (cs *clientSet) set(m map[string]Client) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.m = m
 }
 
 // SenderResponse is responses to worker from sender.
@@ -55,30 +113,106 @@ type SenderResponse struct {
 type Command struct {
 	command string
 	input   []byte
+	kind    string  // error or success hook
+	req     Request // the request of the result, to store a dead letter
+}
+
+// BatchOptions are options for a batch of requests.
+type BatchOptions struct {
+	Caller   string // name of the authenticated caller
+	Priority string // name of the priority class. empty means to derive it from each request
+}
+
+// EnqueueClientRequest enqueues request to supervisor's queue from external application service.
+// It returns the batch which tracks results of the requests.
+func (s *Supervisor) EnqueueClientRequest(reqs *[]Request) (*Batch, error) {
+	return s.EnqueueBatch(reqs, BatchOptions{})
 }
 
-// EnqueueClientRequest enqueues request to supervisor's queue from external application service
-func (s *Supervisor) EnqueueClientRequest(reqs *[]Request) error {
+// EnqueueBatch enqueues request to supervisor's queue with options.
+func (s *Supervisor) EnqueueBatch(reqs *[]Request, opts BatchOptions) (*Batch, error) {
+	batch := NewBatch(*reqs)
+	batch.Caller = opts.Caller
 	logf := logrus.Fields{
 		"type":             "supervisor",
+		"batch_id":         batch.ID,
+		"caller":           batch.Caller,
 		"request_size":     len(*reqs),
-		"queue_size":       len(s.queue),
+		"queue_size":       s.lanes.len(),
 		"retry_queue_size": len(s.retryq),
 	}
 
-	select {
-	case s.queue <- reqs:
-		LogWithFields(logf).Debugf("Enqueued request from provider.")
-	default:
+	for i := range *reqs {
+		if err := s.lanes.assign(&(*reqs)[i], opts.Priority); err != nil {
+			return nil, err
+		}
+	}
+
+	// rejects notifications to tokens which push services reported as invalid
+	accepted := make([]Request, 0, len(*reqs))
+	for _, req := range *reqs {
+		if it, ok := invalidToken(req); ok {
+			batch.reject(req.index, ReasonInvalidToken)
+			metrics.invalidTokens.add(1, it.Provider, "rejected")
+			continue
+		}
+		accepted = append(accepted, req)
+	}
+	if len(accepted) < len(*reqs) {
+		LogWithFields(logf).Infof("Rejected %d notifications to invalid tokens.", len(*reqs)-len(accepted))
+		reqs = &accepted
+	}
+
+	if err := quotas.acquire(batch.Caller, len(*reqs)); err != nil {
+		LogWithFields(logf).Warnf("Rejected requests: %s", err)
+		return nil, err
+	}
+	batch.quota = true
+
+	now := time.Now()
+	for i := range *reqs {
+		(*reqs)[i].enqueuedAt = now
+	}
+
+	// records notifications before accepting them
+	if s.wal != nil {
+		if err := s.wal.append(*reqs, batch.Caller); err != nil {
+			LogWithFields(logf).Errorf("Failed to write the write-ahead log: %s", err)
+			quotas.release(batch.Caller, len(*reqs))
+			return nil, fmt.Errorf("Failed to write the write-ahead log: %s", err)
+		}
+	}
+
+	timeout := time.Duration(atomic.LoadInt64(&s.enqueueTimeout))
+	if !s.lanes.pushWait(reqs, timeout, s.exit) {
 		LogWithFields(logf).Warnf("Supervisor's queue is full.")
-		return fmt.Errorf("Supervisor's queue is full")
+		for _, req := range *reqs {
+			if req.wal != nil {
+				req.wal.done(req.walID)
+			}
+		}
+		quotas.release(batch.Caller, len(*reqs))
+		return nil, fmt.Errorf("Supervisor's queue is full")
+	}
+	LogWithFields(logf).Debugf("Enqueued request from provider.")
+	s.batches.add(batch)
+	for _, req := range *reqs {
+		s.lanes.enqueued(req)
+	}
+	if batch.Caller != "" {
+		atomic.AddInt64(&(callerStats.get(batch.Caller).NotificationCount), int64(len(*reqs)))
 	}
 
-	return nil
+	return batch, nil
+}
+
+// Batch returns the batch which has the id.
+func (s *Supervisor) Batch(id string) (*Batch, bool) {
+	return s.batches.get(id)
 }
 
 // StartSupervisor starts supervisor
-func StartSupervisor(conf *config.Config) (Supervisor, error) {
+func StartSupervisor(conf *config.Config) (*Supervisor, error) {
 	// Calculates each worker queue size to accept requests with a given parameter of requests per sec as flow rate.
 	var wqSize int
 	tp := ((conf.Provider.RequestQueueSize * int(AverageResponseTime/time.Millisecond)) / 1000) / SenderNum
@@ -91,16 +225,34 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 
 	// Initialize Supervisor
 	swgrp := &sync.WaitGroup{}
-	s := Supervisor{
-		queue:  make(chan *[]Request, conf.Provider.QueueSize),
+	s := &Supervisor{
+		lanes:  newRequestLanes(newPriorityClasses(*conf)),
 		retryq: make(chan Request, conf.Provider.RequestQueueSize*conf.Provider.WorkerNum),
 		cmdq:   make(chan Command, wqSize*conf.Provider.WorkerNum),
 		exit:   make(chan struct{}, 1),
 		ticker: time.NewTicker(RetryWaitTime),
 		wgrp:   swgrp,
 	}
+	s.delayed = newDelayedRetries(s.retryq)
+	retention := conf.Provider.StatusRetention.Duration
+	if retention == 0 {
+		retention = config.DefaultStatusRetention
+	}
+	maxAge := conf.Provider.StatusMaxAge.Duration
+	if maxAge == 0 {
+		maxAge = config.DefaultStatusMaxAge
+	}
+	s.batches = newBatchStore(retention, maxAge)
+	retryPolicies.set(conf.Retry)
+	rateLimits.set(conf.RateLimit)
+	quotas.set(conf.Provider.Quota)
+	s.enqueueTimeout = int64(conf.Provider.EnqueueTimeout.Duration)
+	setIncludeNotification(conf.Provider.IncludeNotification)
+	if err := webhooks.set(conf.Provider.ErrorWebhook, conf.Provider.SuccessWebhook); err != nil {
+		return nil, err
+	}
 	LogWithFields(logrus.Fields{}).Infof("Retry queue size: %d", cap(s.retryq))
-	LogWithFields(logrus.Fields{}).Infof("Queue size: %d", cap(s.queue))
+	LogWithFields(logrus.Fields{}).Infof("Queue size: %d", s.lanes.cap())
 
 	// Time ticker to retry to send
 	go func() {
@@ -111,21 +263,16 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 				for cnt := 0; cnt < RetryOnceCount; cnt++ {
 					select {
 					case req := <-s.retryq:
-						var delay time.Duration
-						if RetryBackoff {
-							delay = time.Duration(math.Pow(float64(req.Tries), 2)) * 100 * time.Millisecond
+						req.enqueuedAt = time.Now()
+						if s.lanes.push(&[]Request{req}) {
+							LogWithFields(logrus.Fields{"type": "retry", "resend_cnt": req.Tries}).
+								Debugf("Enqueue to retry to send notification.")
+						} else {
+							LogWithFields(logrus.Fields{"type": "retry"}).
+								Infof("Could not retry to enqueue because the supervisor queue is full.")
+							putDeadLetter(req, nil, errSupervisorQueueFull, DeadLetterSupervisorQueueFull)
+							req.finish(nil, errSupervisorQueueFull)
 						}
-						time.AfterFunc(delay, func() {
-							reqs := &[]Request{req}
-							select {
-							case s.queue <- reqs:
-								LogWithFields(logrus.Fields{"delay": delay, "type": "retry", "resend_cnt": req.Tries}).
-									Debugf("Enqueue to retry to send notification.")
-							default:
-								LogWithFields(logrus.Fields{"delay": delay, "type": "retry"}).
-									Infof("Could not retry to enqueue because the supervisor queue is full.")
-							}
-						})
 					default:
 					}
 				}
@@ -136,80 +283,298 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 		}
 	}()
 
+	// Expires finished batches periodically
+	go func() {
+		ticker := time.NewTicker(BatchExpireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if n := s.batches.expire(now); n > 0 {
+					LogWithFields(logrus.Fields{"type": "supervisor"}).Debugf("Expired %d batches.", n)
+				}
+			case <-s.exit:
+				return
+			}
+		}
+	}()
+
 	// spawn command
+	hookConf := conf.Provider.Hook.WithDefaults()
+	batchq := make(chan []Command, conf.Provider.WorkerNum)
+	s.wgrp.Add(1)
+	go func() {
+		batchCommands(hookConf, s.cmdq, batchq)
+		s.wgrp.Done()
+	}()
 	for i := 0; i < conf.Provider.WorkerNum; i++ {
 		s.wgrp.Add(1)
 		go func() {
-			logf := logrus.Fields{"type": "cmd_worker"}
-			for c := range s.cmdq {
-				LogWithFields(logf).Debugf("invoking command: %s %s", c.command, string(c.input))
-				src := bytes.NewBuffer(c.input)
-				out, err := InvokePipe(c.command, src)
-				if err != nil {
-					LogWithFields(logf).Errorf("(%s) %s", err.Error(), string(out))
-				} else {
-					LogWithFields(logf).Debugf("Success to execute command")
-				}
+			for cmds := range batchq {
+				invokeHook(hookConf, cmds)
 			}
 			s.wgrp.Done()
 		}()
 	}
 
 	// Spawn workers
-	var err error
+	if conf.FCM.Enabled {
+		return nil, errors.New("FCM legacy is not supported")
+	}
+	s.wqSize = wqSize
 	for i := 0; i < conf.Provider.WorkerNum; i++ {
-		var (
-			ac   *apns.Client
-			fcv1 *fcmv1.Client
-		)
-		if conf.Apns.Enabled {
-			ac, err = apns.NewClient(conf.Apns)
-			if err != nil {
-				LogWithFields(logrus.Fields{
-					"type": "supervisor",
-				}).Errorf("faile to new client for apns: %s", err.Error())
-				break
-			}
+		clients, err := newClients(conf)
+		if err != nil {
+			return nil, err
 		}
-		if conf.FCM.Enabled {
-			return Supervisor{}, errors.New("FCM legacy is not supported")
+		s.addWorker(clients)
+	}
+
+	if dir := conf.Provider.WAL.Dir; dir != "" {
+		wal, err := openWAL(dir)
+		if err != nil {
+			return nil, err
 		}
-		if conf.FCMv1.Enabled {
-			fcv1, err = fcmv1.NewClient(conf.FCMv1.TokenSource, conf.FCMv1.ProjectID, conf.FCMv1.Endpoint, fcmv1.ClientTimeout)
-			if err != nil {
-				LogWithFields(logrus.Fields{
-					"type": "supervisor",
-				}).Errorf("failed to new client for fcmv1: %s", err.Error())
-				break
+		s.wal = wal
+		LogWithFields(logrus.Fields{"type": "supervisor", "file": wal.name}).Infof("Write-ahead log is enabled")
+
+		// Replays notifications left by stopped processes periodically
+		s.adoptWAL()
+		go func() {
+			ticker := time.NewTicker(WALAdoptInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.adoptWAL()
+				case <-s.exit:
+					return
+				}
 			}
+		}()
+	}
+
+	return s, nil
+}
+
+// adoptWAL replays notifications in write-ahead logs which stopped processes left.
+func (s *Supervisor) adoptWAL() {
+	logf := logrus.Fields{"type": "supervisor"}
+	recs, err := s.wal.adoptOrphans()
+	if err != nil {
+		LogWithFields(logf).Errorf("Failed to adopt write-ahead logs: %s", err)
+	}
+	if len(recs) == 0 {
+		return
+	}
+
+	// notifications are replayed as batches of each caller
+	batches := make(map[string][]Request)
+	var callers []string
+	for _, rec := range recs {
+		req, err := decodeWALRecord(rec)
+		if err != nil {
+			LogWithFields(logf).Errorf("Failed to replay a notification: %s", err)
+			s.wal.done(rec.ID)
+			continue
 		}
-		worker := Worker{
-			id:    i,
-			queue: make(chan Request, wqSize),
-			respq: make(chan SenderResponse, wqSize*100),
-			wgrp:  &sync.WaitGroup{},
-			sn:    SenderNum,
-			ac:    ac,
-			fcv1:  fcv1,
+		req.wal, req.walID = s.wal, rec.ID
+		s.lanes.assign(&req, "")
+		if _, ok := batches[rec.Caller]; !ok {
+			callers = append(callers, rec.Caller)
 		}
+		batches[rec.Caller] = append(batches[rec.Caller], req)
+	}
+	for _, caller := range callers {
+		reqs := batches[caller]
+		batch := NewBatch(reqs)
+		batch.Caller = caller
+		// adopted notifications were accepted already
+		quotas.force(caller, len(reqs))
+		batch.quota = true
+		s.batches.add(batch)
+		LogWithFields(logrus.Fields{
+			"type":         "supervisor",
+			"batch_id":     batch.ID,
+			"caller":       caller,
+			"request_size": len(reqs),
+		}).Infof("Replaying notifications from the write-ahead log")
 
-		s.workers = append(s.workers, &worker)
+		now := time.Now()
+		for i := range reqs {
+			reqs[i].enqueuedAt = now
+		}
+		// waits for free space of the queue to replay all of notifications
 		s.wgrp.Add(1)
-		go s.spawnWorker(worker)
-		LogWithFields(logrus.Fields{
-			"type":      "worker",
-			"worker_id": i,
-		}).Debugf("Spawned worker-%d.", i)
+		go func(reqs []Request) {
+			defer s.wgrp.Done()
+			for len(reqs) > 0 {
+				n := len(reqs)
+				if n > config.MaxRequestSize {
+					n = config.MaxRequestSize
+				}
+				chunk := reqs[:n]
+				for !s.lanes.push(&chunk) {
+					select {
+					case <-time.After(RetryWaitTime):
+					case <-s.exit:
+						return
+					}
+				}
+				reqs = reqs[n:]
+			}
+		}(reqs)
 	}
+}
+
+// newClients creates clients of enabled providers.
+func newClients(conf *config.Config) (map[string]Client, error) {
+	clients := make(map[string]Client)
+	for _, p := range PushProviders() {
+		if !p.Enabled(*conf) {
+			continue
+		}
+		c, err := p.NewClient(*conf)
+		if err != nil {
+			LogWithFields(logrus.Fields{
+				"type":     "supervisor",
+				"provider": p.Name(),
+			}).Errorf("failed to new client for %s: %s", p.Name(), err.Error())
+			return nil, err
+		}
+		clients[p.Name()] = c
+	}
+	return clients, nil
+}
+
+// addWorker spawns a worker which sends notifications by the clients.
+func (s *Supervisor) addWorker(clients map[string]Client) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	worker := &Worker{
+		id:      s.nextWorkerID,
+		lanes:   newWorkerLanes(s.lanes.priorityClasses, s.wqSize),
+		pending: make([][]Request, len(s.lanes.classes)),
+		respq:   make(chan SenderResponse, s.wqSize*100),
+		wgrp:    &sync.WaitGroup{},
+		stop:    make(chan struct{}),
+		sn:      SenderNum,
+		clients: &clientSet{m: clients},
+	}
+	s.nextWorkerID++
+
+	s.workers = append(s.workers, worker)
+	s.wgrp.Add(1)
+	go s.spawnWorker(worker)
+	LogWithFields(logrus.Fields{
+		"type":      "worker",
+		"worker_id": worker.id,
+	}).Debugf("Spawned worker-%d.", worker.id)
+}
+
+// workerList returns the running workers, including workers which are stopping.
+func (s *Supervisor) workerList() []*Worker {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	return append([]*Worker(nil), s.workers...)
+}
+
+// activeWorkers returns the workers which are not stopping.
+func (s *Supervisor) activeWorkers() []*Worker {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	var ws []*Worker
+	for _, w := range s.workers {
+		select {
+		case <-w.stop:
+		default:
+			ws = append(ws, w)
+		}
+	}
+	return ws
+}
 
+// removeWorker removes the stopped worker.
+func (s *Supervisor) removeWorker(w *Worker) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	for i, v := range s.workers {
+		if v == w {
+			s.workers = append(s.workers[:i], s.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reload replaces clients of workers by the configuration and adjusts the number of workers.
+// Queued notifications are kept. Queue sizes are not changed.
+func (s *Supervisor) Reload(conf *config.Config) error {
+	if conf.FCM.Enabled {
+		return errors.New("FCM legacy is not supported")
+	}
+	if s.Draining() {
+		return errors.New("supervisor is shutting down")
+	}
+	workers := s.activeWorkers()
+
+	// creates all clients and webhooks at first not to apply the configuration partially
+	clientsList := make([]map[string]Client, conf.Provider.WorkerNum)
+	for i := range clientsList {
+		clients, err := newClients(conf)
+		if err != nil {
+			return err
+		}
+		clientsList[i] = clients
+	}
+	webhookUpdate, err := webhooks.prepare(conf.Provider.ErrorWebhook, conf.Provider.SuccessWebhook)
 	if err != nil {
-		return Supervisor{}, err
+		return err
+	}
+
+	for i, clients := range clientsList {
+		if i < len(workers) {
+			workers[i].clients.set(clients)
+		} else {
+			s.addWorker(clients)
+		}
+	}
+	if n := conf.Provider.WorkerNum; n < len(workers) {
+		s.workersMu.Lock()
+		for _, w := range workers[n:] {
+			close(w.stop)
+		}
+		s.workersMu.Unlock()
+	}
+	webhookUpdate.apply()
+	retryPolicies.set(conf.Retry)
+	rateLimits.set(conf.RateLimit)
+	quotas.set(conf.Provider.Quota)
+	atomic.StoreInt64(&s.enqueueTimeout, int64(conf.Provider.EnqueueTimeout.Duration))
+	setIncludeNotification(conf.Provider.IncludeNotification)
+	if !reflect.DeepEqual(newPriorityClasses(*conf), s.lanes.priorityClasses) {
+		LogWithFields(logrus.Fields{"type": "supervisor"}).
+			Warnf("Priority classes are not reloaded. They are applied after restarting.")
+	}
+	LogWithFields(logrus.Fields{
+		"type":    "supervisor",
+		"workers": conf.Provider.WorkerNum,
+	}).Infof("Reloaded supervisor.")
+	return nil
+}
+
+// enqueueCommand enqueues the command into the command queue. It returns false when the queue is full.
+func (s *Supervisor) enqueueCommand(cmd Command) bool {
+	select {
+	case s.cmdq <- cmd:
+		return true
+	default:
+		return false
 	}
-	return s, nil
 }
 
 // Shutdown supervisor
 func (s *Supervisor) Shutdown() {
+	s.StartDraining()
 	LogWithFields(logrus.Fields{
 		"type": "supervisor",
 	}).Infoln("Waiting for stopping supervisor...")
@@ -219,7 +584,7 @@ func (s *Supervisor) Shutdown() {
 	tryCnt := 0
 	for zeroCnt < RestartWaitCount {
 		// if 's.counter' is not 0 potentially, here loop should not cancel to wait.
-		if len(s.queue)+len(s.cmdq)+len(s.retryq)+s.workersAllQueueLength() > 0 {
+		if s.lanes.len()+len(s.cmdq)+len(s.retryq)+s.delayed.len()+s.workersAllQueueLength() > 0 {
 			zeroCnt = 0
 			tryCnt++
 		} else {
@@ -240,15 +605,24 @@ func (s *Supervisor) Shutdown() {
 	close(s.exit)
 	close(s.cmdq)
 	s.wgrp.Wait()
-	close(s.queue)
+	if n := s.delayed.stop(); n > 0 {
+		LogWithFields(logrus.Fields{
+			"type": "supervisor",
+		}).Warnf("Gave up %d notifications which were waiting to retry.", n)
+	}
 	close(s.retryq)
+	webhooks.close()
+	if s.wal != nil {
+		// notifications which were not sent are left to the next process
+		s.wal.close()
+	}
 
 	LogWithFields(logrus.Fields{
 		"type": "supervisor",
 	}).Infoln("Stoped supervisor.")
 }
 
-func (s *Supervisor) spawnWorker(w Worker) {
+func (s *Supervisor) spawnWorker(w *Worker) {
 	atomic.AddInt64(&(srvStats.Workers), 1)
 	defer func() {
 		atomic.AddInt64(&(srvStats.Workers), -1)
@@ -265,138 +639,173 @@ func (s *Supervisor) spawnWorker(w Worker) {
 		}).Debugf("Spawned a sender-%d-%d.", w.id, i)
 
 		// spawnSender
-		go spawnSender(w.queue, w.respq, w.wgrp, w.ac, w.fcv1)
+		go spawnSender(w.lanes, w.respq, w.wgrp, w.clients, s.exit)
 	}
 
-	func() {
+	flush := time.NewTicker(WorkerFlushInterval)
+	defer flush.Stop()
+	stopped := func() bool {
+		waiting := false // waits for free space of lanes to take requests from the supervisor
 		for {
+			ready := s.lanes.ready
+			if waiting {
+				ready = nil
+			}
 			select {
-			case reqs := <-s.queue:
+			case <-ready:
+				reqs, ok := s.lanes.pop(w.accepts)
+				if !ok {
+					waiting = true
+					continue
+				}
 				w.receiveRequests(reqs)
 			case resp := <-w.respq:
-				w.receiveResponse(resp, s.retryq, s.cmdq)
+				w.receiveResponse(resp, s.delayed, s.cmdq)
+			case <-flush.C:
+				w.flush()
+				waiting = false
 			case <-s.exit:
-				return
+				return false
+			case <-w.stop:
+				return true
 			}
 		}
 	}()
 
-	close(w.queue)
-	w.wgrp.Wait()
+	if !stopped {
+		close(w.lanes.ready)
+		w.wgrp.Wait()
+		return
+	}
+
+	// The worker was removed on reloading. Hands pending requests to senders.
+	for atomic.LoadInt64(&w.npend) > 0 {
+		select {
+		case resp := <-w.respq:
+			w.receiveResponse(resp, s.delayed, s.cmdq)
+		case <-flush.C:
+			w.flush()
+		}
+	}
+	close(w.lanes.ready)
+
+	// The worker was removed on reloading. Handles responses until senders finish queued requests.
+	done := make(chan struct{})
+	go func() {
+		w.wgrp.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case resp := <-w.respq:
+			w.receiveResponse(resp, s.delayed, s.cmdq)
+		case <-done:
+			for len(w.respq) > 0 {
+				w.receiveResponse(<-w.respq, s.delayed, s.cmdq)
+			}
+			s.removeWorker(w)
+			LogWithFields(logrus.Fields{
+				"type":      "worker",
+				"worker_id": w.id,
+			}).Debugf("Stopped worker-%d.", w.id)
+			return
+		}
+	}
 }
 
-func (w *Worker) receiveResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command) {
+func (w *Worker) receiveResponse(resp SenderResponse, delayed *delayedRetries, cmdq chan Command) {
 	req := resp.Req
-
-	switch t := req.Notification.(type) {
-	case apns.Notification:
-		no := req.Notification.(apns.Notification)
-		logf := logrus.Fields{
-			"type":           "worker",
-			"status":         "-",
-			"apns_id":        "-",
-			"token":          no.Token,
-			"payload":        no.Payload,
-			"worker_id":      w.id,
-			"res_queue_size": len(w.respq),
-			"resend_cnt":     req.Tries,
-			"response_time":  resp.RespTime,
-			"resp_uid":       resp.UID,
-		}
-		handleAPNsResponse(resp, retryq, cmdq, logf)
-	case fcmv1.Payload:
-		p := req.Notification.(fcmv1.Payload)
-		logf := logrus.Fields{
-			"type":           "worker",
-			"token":          p.Message.Token,
-			"worker_id":      w.id,
-			"res_queue_size": len(w.respq),
-			"resend_cnt":     req.Tries,
-			"response_time":  resp.RespTime,
-			"resp_uid":       resp.UID,
-		}
-		handleFCMResponse(resp, retryq, cmdq, logf)
-	default:
-		LogWithFields(logrus.Fields{"type": "worker"}).Infof("Unknown response type:%s", t)
+	p := pushProviderOf(req.Notification)
+	if p == nil {
+		LogWithFields(logrus.Fields{"type": "worker"}).Infof("Unknown response type:%T", req.Notification)
+		return
 	}
 
+	logf := logrus.Fields{
+		"type":           "worker",
+		"provider":       p.Name(),
+		"token":          p.Target(req.Notification).Token,
+		"worker_id":      w.id,
+		"res_queue_size": len(w.respq),
+		"resend_cnt":     req.Tries,
+		"response_time":  resp.RespTime,
+		"resp_uid":       resp.UID,
+		"batch_id":       req.BatchID(),
+		"caller":         req.Caller(),
+	}
+	handleResponse(p, resp, delayed, cmdq, logf)
 }
 
-func handleAPNsResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, logf logrus.Fields) {
+// handleResponse handles results from a push service as the provider classifies.
+func handleResponse(p PushProvider, resp SenderResponse, delayed *delayedRetries, cmdq chan Command, logf logrus.Fields) {
 	req := resp.Req
+	app := p.Target(req.Notification).App
 
-	// Response handling
-	if resp.Err != nil {
+	if len(resp.Results) == 0 {
+		// if 'result' is nil, HTTP connection error with the push service.
 		atomic.AddInt64(&(srvStats.ErrCount), 1)
-		if len(resp.Results) > 0 {
-			result := resp.Results[0]
-			for _, key := range result.ExtraKeys() {
-				logf[key] = result.ExtraValue(key)
-			}
-			logf["status"] = result.Status()
-			LogWithFields(logf).Errorf("%s", resp.Err)
-			// Error handling
-			onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-		} else {
-			// if 'result' is nil, HTTP connection error with APNS.
-			retry(retryq, req, errors.New("http connection error between APNs"), logf)
+		act := p.Classify(nil, resp.Err)
+		health.observe(p.Name(), act, false)
+		LogWithFields(logf).Warnf("response is nil. reason: %s", resp.Err)
+		fail := func() { req.finish(nil, resp.Err) }
+		if !retryAfter(p, act, delayed, req, nil, resp.Err, logf, fail) {
+			fail()
 		}
-	} else {
-		atomic.AddInt64(&(srvStats.SentCount), 1)
-		if len(resp.Results) > 0 {
-			result := resp.Results[0]
-			for _, key := range result.ExtraKeys() {
-				logf[key] = result.ExtraValue(key)
-			}
-			if err := result.Err(); err != nil {
-				atomic.AddInt64(&(srvStats.ErrCount), 1)
-
-				// retry when provider auhentication token is expired
-				if err.Error() == apns.ExpiredProviderToken.String() {
-					retry(retryq, req, err, logf)
-				}
-
-				onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-				LogWithFields(logf).Errorf("%s", err)
-			} else {
-				onResponse(result, "", cmdq)
-				LogWithFields(logf).Info("Succeeded to send a notification")
-			}
-		}
-	}
-}
-
-func handleFCMResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, logf logrus.Fields) {
-	if resp.Err != nil {
-		req := resp.Req
-		LogWithFields(logf).Warnf("response is nil. reason: %s", resp.Err.Error())
-		retry(retryq, req, resp.Err, logf)
 		return
 	}
 
 	for _, result := range resp.Results {
-		// success when Error is nothing
+		result := result
+		logf := copyFields(logf)
+		for _, key := range result.ExtraKeys() {
+			logf[key] = result.ExtraValue(key)
+		}
+		logf["status"] = result.Status()
+
 		err := result.Err()
 		if err == nil {
 			atomic.AddInt64(&(srvStats.SentCount), 1)
+			if app != "" {
+				atomic.AddInt64(&(appStats.get(p.Name(), app).SentCount), 1)
+			}
+			health.observe(p.Name(), Action{}, true)
+			_, sh := responseHandlers()
+			onResponse(req, result, sh.HookCmd(), cmdq)
 			LogWithFields(logf).Info("Succeeded to send a notification")
+			req.finish(result, nil)
 			continue
 		}
-		switch err.Error() {
-		case fcmv1.Internal, fcmv1.Unavailable:
-			LogWithFields(logf).Warn("retrying:", err)
-			retry(retryq, resp.Req, err, logf)
-		case fcmv1.QuotaExceeded:
-			LogWithFields(logf).Warn("retrying after 1 min:", err)
-			time.AfterFunc(time.Minute, func() { retry(retryq, resp.Req, err, logf) })
-		case fcmv1.Unregistered, fcmv1.InvalidArgument, fcmv1.NotFound:
-			LogWithFields(logf).Errorf("calling error hook: %s", err)
-			atomic.AddInt64(&(srvStats.ErrCount), 1)
-			onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-		default:
-			atomic.AddInt64(&(srvStats.ErrCount), 1)
-			LogWithFields(logf).Errorf("Unknown error message: %s", err)
+
+		atomic.AddInt64(&(srvStats.ErrCount), 1)
+		if app != "" {
+			atomic.AddInt64(&(appStats.get(p.Name(), app).ErrCount), 1)
+		}
+		act := p.Classify(result, err)
+		health.observe(p.Name(), act, false)
+		if d := backoffOf(result); d > 0 {
+			pauses.pause(p.Name(), app, d)
+			if act.Delay < d {
+				act.Delay = d
+			}
+		}
+		if act.InvalidToken {
+			recordInvalidToken(p, req, result)
+		}
+		// handlers, hooks and webhooks get the final result only. attempts to be retried are reported
+		// by the state of the batch and metrics
+		fail := func() {
+			if act.Hook {
+				erh, _ := responseHandlers()
+				onResponse(req, result, erh.HookCmd(), cmdq)
+			}
+			req.finish(result, nil)
 		}
+		if retryAfter(p, act, delayed, req, result, err, logf, fail) {
+			LogWithFields(logf).Warnf("retrying: %s", err)
+			continue
+		}
+		LogWithFields(logf).Errorf("%s", err)
+		fail()
 	}
 }
 
@@ -404,72 +813,88 @@ func (w *Worker) receiveRequests(reqs *[]Request) {
 	logf := logrus.Fields{
 		"type":              "worker",
 		"worker_id":         w.id,
-		"worker_queue_size": len(w.queue),
+		"worker_queue_size": w.lanes.len(),
 		"request_size":      len(*reqs),
 	}
 
 	for _, req := range *reqs {
-		select {
-		case w.queue <- req:
-			LogWithFields(logf).
-				Debugf("Enqueue request into worker's queue")
+		i := w.lanes.lane(req)
+		if len(w.pending[i]) == 0 && w.lanes.push(req) {
+			continue
+		}
+		w.pending[i] = append(w.pending[i], req)
+		atomic.AddInt64(&w.npend, 1)
+	}
+	LogWithFields(logf).Debugf("Enqueue requests into worker's queue")
+}
+
+// accepts reports whether the worker can take requests of the priority class from the supervisor.
+func (w *Worker) accepts(i int) bool {
+	return len(w.pending[i]) == 0
+}
+
+// flush enqueues pending requests into free space of lanes.
+func (w *Worker) flush() {
+	for i, reqs := range w.pending {
+		n := 0
+		for n < len(reqs) && w.lanes.push(reqs[n]) {
+			n++
+		}
+		if n == 0 {
+			continue
 		}
+		w.pending[i] = reqs[n:]
+		if len(w.pending[i]) == 0 {
+			w.pending[i] = nil
+		}
+		atomic.AddInt64(&w.npend, -int64(n))
 	}
 }
 
-func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.WaitGroup, ac *apns.Client, fcv1 *fcmv1.Client) {
+func spawnSender(lanes *workerLanes, respq chan<- SenderResponse, wgrp *sync.WaitGroup, clients *clientSet, exit <-chan struct{}) {
 	defer wgrp.Done()
-	for req := range wq {
-		var sres SenderResponse
-		switch t := req.Notification.(type) {
-		case apns.Notification:
-			if ac == nil {
-				LogWithFields(logrus.Fields{"type": "sender"}).
-					Errorf("apns client is not present")
-				continue
-			}
-			no := req.Notification.(apns.Notification)
-			start := time.Now()
-			results, err := ac.Send(no)
-			respTime := time.Since(start).Seconds()
-			rs := make([]Result, 0, len(results))
-			for _, v := range results {
-				rs = append(rs, v)
-			}
-			sres = SenderResponse{
-				Results:  rs,
-				RespTime: respTime,
-				Req:      req, // Must copy
-				Err:      err,
-				UID:      uuid.NewV4().String(),
-			}
-		case fcmv1.Payload:
-			if fcv1 == nil {
-				LogWithFields(logrus.Fields{"type": "sender"}).
-					Errorf("fcmv1 client is not present")
-				continue
-			}
-			p := req.Notification.(fcmv1.Payload)
-			start := time.Now()
-			results, err := fcv1.Send(p)
-			respTime := time.Since(start).Seconds()
-			rs := make([]Result, 0, len(results))
-			for _, v := range results {
-				rs = append(rs, v)
-			}
-			sres = SenderResponse{
-				Results:  rs,
-				RespTime: respTime,
-				Req:      req,
-				Err:      err,
-				UID:      uuid.NewV4().String(),
-			}
-		default:
+	for range lanes.ready {
+		req := lanes.pop()
+		p := pushProviderOf(req.Notification)
+		if p == nil {
 			LogWithFields(logrus.Fields{"type": "sender"}).
-				Errorf("Unknown request data type: %s", t)
+				Errorf("Unknown request data type: %T", req.Notification)
+			req.finish(nil, errUnknownRequest)
+			continue
+		}
+		c, ok := clients.get(p.Name())
+		if !ok {
+			err := errNoClient(p.Name())
+			LogWithFields(logrus.Fields{"type": "sender"}).Errorf("%s", err)
+			req.finish(nil, err)
 			continue
 		}
 
+		// the sender holds the notification while the push service requested to wait or rate limits are exceeded,
+		// so that following ones stay in the queues and callers are asked to slow down when the queues are full
+		t := p.Target(req.Notification)
+		if !pauses.wait(p.Name(), t.App, exit) || !waitRateLimits(t, exit) {
+			LogWithFields(logrus.Fields{"type": "sender"}).Warnf("Stopped waiting to send on shutdown.")
+			giveUpRetry(delayedRetry{req: req, err: errSupervisorStopped})
+			continue
+		}
+
+		req.setState(StateInFlight)
+		if !req.enqueuedAt.IsZero() {
+			metrics.queueDuration.observe(time.Since(req.enqueuedAt).Seconds(), p.Name())
+		}
+		start := time.Now()
+		results, err := c.Send(req.Notification)
+		respTime := time.Since(start).Seconds()
+		metrics.sendDuration.observe(respTime, p.Name())
+		sres := SenderResponse{
+			Results:  results,
+			RespTime: respTime,
+			Req:      req, // Must copy
+			Err:      err,
+			UID:      uuid.NewV4().String(),
+		}
+
 		select {
 		case respq <- sres:
 			LogWithFields(logrus.Fields{"type": "sender", "resp_queue_size": len(respq)}).
@@ -477,19 +902,43 @@ func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.Wait
 		default:
 			LogWithFields(logrus.Fields{"type": "sender", "resp_queue_size": len(respq)}).
 				Warnf("Response queue is full.")
+			var result Result
+			if len(sres.Results) > 0 {
+				result = sres.Results[0]
+			}
+			putDeadLetter(req, result, errResponseQueueFull, DeadLetterResponseQueueFull)
+			req.finish(result, errResponseQueueFull)
 		}
 	}
 }
 
-func (s Supervisor) workersAllQueueLength() int {
+// priorityStats returns metrics of each priority class.
+func (s *Supervisor) priorityStats() map[string]PriorityStats {
+	stats := make(map[string]PriorityStats, len(s.lanes.classes))
+	workers := s.workerList()
+	for i, class := range s.lanes.classes {
+		st := PriorityStats{
+			QueueSize:     int64(s.lanes.queues[i].len()),
+			QueueCapacity: int64(s.lanes.queues[i].cap()),
+			EnqueuedCount: atomic.LoadInt64(&s.lanes.counts[i]),
+		}
+		for _, w := range workers {
+			st.WorkersQueueSize += int64(len(w.lanes.queues[i]))
+		}
+		stats[class.Name] = st
+	}
+	return stats
+}
+
+func (s *Supervisor) workersAllQueueLength() int {
 	sum := 0
-	for _, w := range s.workers {
-		sum += len(w.queue) + len(w.respq)
+	for _, w := range s.workerList() {
+		sum += w.lanes.len() + int(atomic.LoadInt64(&w.npend)) + len(w.respq)
 	}
 	return sum
 }
 
-func onResponse(result Result, cmd string, cmdq chan<- Command) {
+func onResponse(req Request, result Result, cmd string, cmdq chan<- Command) {
 	logf := logrus.Fields{
 		"provider": result.Provider(),
 		"type":     "on_response",
@@ -498,12 +947,16 @@ func onResponse(result Result, cmd string, cmdq chan<- Command) {
 	for _, key := range result.ExtraKeys() {
 		logf[key] = result.ExtraValue(key)
 	}
+	result = requestResult(req, result)
 	// on error handler
+	erh, sh := responseHandlers()
 	if err := result.Err(); err != nil {
-		errorResponseHandler.OnResponse(result)
+		erh.OnResponse(result)
 	} else {
-		successResponseHandler.OnResponse(result)
+		sh.OnResponse(result)
 	}
+	webhooks.put(req, result)
+	events.publish(req, result)
 
 	if cmd == "" {
 		return
@@ -513,23 +966,41 @@ func onResponse(result Result, cmd string, cmdq chan<- Command) {
 	command := Command{
 		command: cmd,
 		input:   b,
+		kind:    resultSuccess,
+		req:     req,
+	}
+	if result.Err() != nil {
+		command.kind = resultError
 	}
 	select {
 	case cmdq <- command:
 		LogWithFields(logf).Debugf("Enqueue command: %s < %s", command.command, string(b))
 	default:
-		LogWithFields(logf).Warnf("Command queue is full, so could not execute commnad: %v", command)
+		LogWithFields(logf).Warnf("Command queue is full, so could not execute commnad: %s", command.command)
+		metrics.hooks.add(1, command.kind, "dropped")
+		if command.kind == resultError {
+			putDeadHook(command, nil, DeadLetterCommandQueueFull)
+		}
 	}
 }
 
+// InvokePipe invokes the hook command with src as STDIN, and returns its output.
 func InvokePipe(hook string, src io.Reader) ([]byte, error) {
-	logf := logrus.Fields{"type": "invoke_pipe"}
-	cmd := exec.Command("sh", "-c", hook)
+	return invokePipe(hook, src, 0)
+}
 
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed: %v %s", cmd, err.Error())
+// invokePipe invokes the hook command. The command is killed after the timeout. 0 means no timeout.
+func invokePipe(hook string, src io.Reader, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Stdin = src
+	// does not wait for processes which the hook left with its output
+	cmd.WaitDelay = HookWaitDelay
 
 	var b bytes.Buffer
 	// merge std(out|err) of command to gunfish
@@ -544,35 +1015,86 @@ func InvokePipe(hook string, src io.Reader) ([]byte, error) {
 		cmd.Stderr = &b
 	}
 
-	// src copy to cmd.stdin
-	_, err = io.Copy(stdin, src)
-	if e, ok := err.(*os.PathError); ok && e.Err == syscall.EPIPE {
-		LogWithFields(logf).Errorf(e.Error())
-	} else if err != nil {
-		LogWithFields(logf).Errorf("failed to write STDIN: cmd( %s ), error( %s )", hook, err.Error())
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s: %s", timeout, err)
 	}
-	stdin.Close()
-
-	err = cmd.Run()
 	return b.Bytes(), err
 }
 
-func retry(retryq chan<- Request, req Request, err error, logf logrus.Fields) {
-	if req.Tries < SendRetryCount {
-		req.Tries++
-		atomic.AddInt64(&(srvStats.RetryCount), 1)
-		logf["resend_cnt"] = req.Tries
+// retryAfter enqueues req into the retry queue after the delay of the retry policy.
+// It returns true when req will be retried. fail is called when req could not be retried after the delay.
+func retryAfter(p PushProvider, act Action, delayed *delayedRetries, req Request, result Result, err error, logf logrus.Fields, fail func()) bool {
+	reason := reasonLabel(result, err)
+	policy := retryPolicies.policy(p.Name(), reason)
+	if !policy.shouldRetry(act) {
+		return false
+	}
+	if policy.exhausted(req) {
+		LogWithFields(logf).
+			Warnf("Sent %d times. Could not deliver notification.", policy.maxAttempts)
+		putDeadLetter(req, result, err, DeadLetterRetryExhausted)
+		return false
+	}
 
-		select {
-		case retryq <- req:
-			LogWithFields(logf).
-				Debugf("%s: Retry to enqueue into retryq.", err.Error())
-		default:
-			LogWithFields(logf).
-				Warnf("Supervisor retry queue is full.")
+	delay := policy.delay(req.Tries + 1)
+	if delay < act.Delay {
+		delay = act.Delay
+	}
+	if delay <= 0 {
+		return retry(delayed.retryq, req, result, err, logf)
+	}
+	logf = copyFields(logf)
+	logf["delay"] = delay
+	LogWithFields(logf).Debugf("retrying after %s: %s", delay, err)
+	req.setState(StateRetrying)
+	delayed.after(delay, delayedRetry{req: req, result: result, err: err}, func(retryq chan<- Request) {
+		if !retry(retryq, req, result, err, logf) {
+			fail()
 		}
-	} else {
+	})
+	return true
+}
+
+// sleep waits for d. It returns false when exit is closed before d passes.
+func sleep(d time.Duration, exit <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-exit:
+		return false
+	}
+}
+
+func copyFields(f logrus.Fields) logrus.Fields {
+	c := make(logrus.Fields, len(f))
+	for k, v := range f {
+		c[k] = v
+	}
+	return c
+}
+
+// retry enqueues req into the retry queue. It returns false when the retry queue is full.
+func retry(retryq chan<- Request, req Request, result Result, err error, logf logrus.Fields) bool {
+	req.Tries++
+	atomic.AddInt64(&(srvStats.RetryCount), 1)
+	t := targetOf(req.Notification)
+	metrics.retried.add(1, t.Provider, t.App, t.Topic, reasonLabel(result, err))
+	logf = copyFields(logf)
+	logf["resend_cnt"] = req.Tries
+	req.setState(StateRetrying)
+
+	select {
+	case retryq <- req:
+		LogWithFields(logf).
+			Debugf("%s: Retry to enqueue into retryq.", err.Error())
+		return true
+	default:
 		LogWithFields(logf).
-			Warnf("Retry count is over than %d. Could not deliver notification.", SendRetryCount)
+			Warnf("Supervisor retry queue is full.")
+		putDeadLetter(req, result, err, DeadLetterRetryQueueFull)
+		return false
 	}
 }
@@ -140,7 +140,7 @@ func TestEnqueuRequestToSupervisor(t *testing.T) {
 			num:      1,
 			msleep:   5000,
 			errCode:  apns.ExpiredProviderToken,
-			expect:   1 * gunfish.SendRetryCount,
+			expect:   1, // handlers get the final result only after retries
 		},
 	}
 
@@ -193,7 +193,7 @@ func TestSuccessOrFailureInvoke(t *testing.T) {
 			Title: "test",
 			Body:  "hoge message",
 		},
-		Badge: 1,
+		Badge: apns.Badge(1),
 		Sound: "default",
 	}
 	payload := apns.Payload{}
@@ -0,0 +1,406 @@
+package gunfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ReasonInvalidToken is the reason of notifications which were rejected by the token registry.
+const ReasonInvalidToken = "invalid token"
+
+// InvalidToken is a token which a push service reported as no longer valid.
+type InvalidToken struct {
+	Provider      string    `json:"provider"`
+	Token         string    `json:"token"`
+	App           string    `json:"app,omitempty"`
+	Reason        string    `json:"reason"`
+	InvalidatedAt time.Time `json:"invalidated_at"` // the time the push service confirmed, or the time it was recorded
+	RecordedAt    time.Time `json:"recorded_at"`
+}
+
+// TokenRegistry records invalid tokens, and Gunfish rejects notifications to them.
+type TokenRegistry interface {
+	// Put records the invalid token. It replaces the record of the same token.
+	Put(InvalidToken) error
+	// Get returns the record of the token.
+	Get(provider, token string) (InvalidToken, bool)
+	// List returns records of the provider from the oldest. empty provider means all of providers.
+	List(provider string) ([]InvalidToken, error)
+	// Remove removes records of the tokens and returns the number of removed records.
+	// empty provider means all of providers, and empty tokens means all of tokens.
+	Remove(provider string, tokens []string) (int, error)
+}
+
+// InvalidTokenResult is implemented by results which have the time the push service confirmed
+// that the token was no longer valid. (e.g. timestamp of APNs)
+type InvalidTokenResult interface {
+	InvalidatedAt() time.Time
+}
+
+// InitTokenRegistry sets the registry of invalid tokens.
+func InitTokenRegistry(registry TokenRegistry) error {
+	if registry == nil {
+		return fmt.Errorf("Invalid token registry: %v", registry)
+	}
+	tokenRegistryMu.Lock()
+	defer tokenRegistryMu.Unlock()
+	tokenRegistry = registry
+	return nil
+}
+
+func currentTokenRegistry() TokenRegistry {
+	tokenRegistryMu.RLock()
+	defer tokenRegistryMu.RUnlock()
+	return tokenRegistry
+}
+
+// newTokenRegistry creates the registry by the configuration. It returns nil when the registry is not configured.
+func newTokenRegistry(conf config.SectionTokenRegistry) (TokenRegistry, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	return NewFileTokenRegistry(conf.File, conf.TTL.Duration)
+}
+
+// invalidToken returns the record of the token of the request, if it is invalid.
+func invalidToken(req Request) (InvalidToken, bool) {
+	registry := currentTokenRegistry()
+	if registry == nil {
+		return InvalidToken{}, false
+	}
+	t := targetOf(req.Notification)
+	if t.Token == "" {
+		return InvalidToken{}, false
+	}
+	return registry.Get(t.Provider, t.Token)
+}
+
+// recordInvalidToken records the token of the request which the push service reported as invalid.
+func recordInvalidToken(p PushProvider, req Request, result Result) {
+	registry := currentTokenRegistry()
+	if registry == nil {
+		return
+	}
+	t := p.Target(req.Notification)
+	if t.Token == "" {
+		return
+	}
+	now := time.Now()
+	it := InvalidToken{
+		Provider:      t.Provider,
+		Token:         t.Token,
+		App:           t.App,
+		Reason:        result.Err().Error(),
+		InvalidatedAt: now,
+		RecordedAt:    now,
+	}
+	if r, ok := result.(InvalidTokenResult); ok && !r.InvalidatedAt().IsZero() {
+		it.InvalidatedAt = r.InvalidatedAt()
+	}
+	logf := logrus.Fields{"type": "token_registry", "provider": t.Provider, "token": t.Token}
+	if err := registry.Put(it); err != nil {
+		LogWithFields(logf).Errorf("failed to record the invalid token: %s", err)
+		return
+	}
+	metrics.invalidTokens.add(1, t.Provider, "recorded")
+	LogWithFields(logf).Debugf("Recorded the invalid token")
+}
+
+type tokenKey struct {
+	provider string
+	token    string
+}
+
+// fileTokenRegistry keeps invalid tokens in memory, and writes them to a JSON lines file.
+type fileTokenRegistry struct {
+	mu     sync.RWMutex
+	name   string
+	ttl    time.Duration
+	tokens map[tokenKey]InvalidToken
+	puts   int // records appended since the last compaction
+}
+
+// NewFileTokenRegistry creates a registry which records invalid tokens in the JSON lines file.
+// Tokens are valid again when ttl passed since they were invalidated, because apps may register them again.
+// 0 ttl keeps tokens invalid until they are removed.
+func NewFileTokenRegistry(name string, ttl time.Duration) (TokenRegistry, error) {
+	r := &fileTokenRegistry{name: name, ttl: ttl, tokens: make(map[tokenKey]InvalidToken)}
+	f, err := os.OpenFile(name, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var it InvalidToken
+		if err := json.Unmarshal(scanner.Bytes(), &it); err != nil {
+			LogWithFields(logrus.Fields{"type": "token_registry", "file": name}).Warnf("skipped a broken record: %s", err)
+			continue
+		}
+		lines++
+		if r.expired(it, time.Now()) {
+			continue
+		}
+		r.tokens[tokenKey{it.Provider, it.Token}] = it
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// removes replaced and expired records
+	if lines > len(r.tokens) {
+		if err := r.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *fileTokenRegistry) Put(it InvalidToken) error {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	r.tokens[tokenKey{it.Provider, it.Token}] = it
+	r.puts++
+	if r.puts >= TokenRegistryCompactThreshold {
+		if err := r.compact(); err != nil {
+			LogWithFields(logrus.Fields{"type": "token_registry", "file": r.name}).Errorf("failed to compact: %s", err)
+		}
+	}
+	return nil
+}
+
+func (r *fileTokenRegistry) Get(provider, token string) (InvalidToken, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	it, ok := r.tokens[tokenKey{provider, token}]
+	if !ok || r.expired(it, time.Now()) {
+		return InvalidToken{}, false
+	}
+	return it, true
+}
+
+// expired reports whether the ttl passed since the token was invalidated.
+func (r *fileTokenRegistry) expired(it InvalidToken, now time.Time) bool {
+	return r.ttl > 0 && now.Sub(it.InvalidatedAt) > r.ttl
+}
+
+func (r *fileTokenRegistry) List(provider string) ([]InvalidToken, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.list(provider), nil
+}
+
+func (r *fileTokenRegistry) list(provider string) []InvalidToken {
+	now := time.Now()
+	tokens := make([]InvalidToken, 0, len(r.tokens))
+	for _, it := range r.tokens {
+		if r.expired(it, now) {
+			continue
+		}
+		if provider == "" || it.Provider == provider {
+			tokens = append(tokens, it)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].RecordedAt.Before(tokens[j].RecordedAt)
+	})
+	return tokens
+}
+
+func (r *fileTokenRegistry) Remove(provider string, tokens []string) (int, error) {
+	remove := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		remove[token] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for key, it := range r.tokens {
+		if r.expired(it, now) {
+			continue
+		}
+		if (provider == "" || key.provider == provider) && (len(tokens) == 0 || remove[key.token]) {
+			delete(r.tokens, key)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.compact()
+}
+
+// compact writes the file again with current records, and forgets expired records.
+func (r *fileTokenRegistry) compact() error {
+	now := time.Now()
+	for key, it := range r.tokens {
+		if r.expired(it, now) {
+			delete(r.tokens, key)
+		}
+	}
+	tmp := r.name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, it := range r.list("") {
+		if err := enc.Encode(it); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.name); err != nil {
+		return err
+	}
+	r.puts = 0
+	return nil
+}
+
+// InvalidTokensResponse is the response body of GET /invalid-tokens.
+type InvalidTokensResponse struct {
+	InvalidTokens []InvalidToken `json:"invalid_tokens"`
+}
+
+// ClearTokensRequest is the request body of POST /invalid-tokens/clear.
+type ClearTokensRequest struct {
+	Provider string   `json:"provider"` // empty means all of providers
+	Tokens   []string `json:"tokens"`   // empty means all of tokens of the provider, if All is true
+	All      bool     `json:"all"`      // must be true to remove all of tokens
+}
+
+// ClearTokensResponse is the response body of POST /invalid-tokens/clear.
+type ClearTokensResponse struct {
+	Result  string `json:"result"`
+	Cleared int    `json:"cleared"`
+}
+
+// listInvalidTokens responds an error and returns false when tokens can not be listed.
+func listInvalidTokens(res http.ResponseWriter, req *http.Request) ([]InvalidToken, bool) {
+	if ok := validateStatsHandler(res, req); ok != true {
+		return nil, false
+	}
+	registry := currentTokenRegistry()
+	if registry == nil {
+		writeReason(res, http.StatusNotFound, "token registry is not configured")
+		return nil, false
+	}
+	tokens, err := registry.List(req.URL.Query().Get("provider"))
+	if err != nil {
+		writeReason(res, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return tokens, true
+}
+
+// InvalidTokensHandler returns recorded invalid tokens at GET /invalid-tokens.
+func (prov *Provider) InvalidTokensHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		tokens, ok := listInvalidTokens(res, req)
+		if !ok {
+			return
+		}
+		limit := 0
+		if v := req.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeReason(res, http.StatusBadRequest, "invalid limit: "+v)
+				return
+			}
+			limit = n
+		}
+		if limit > 0 && len(tokens) > limit {
+			tokens = tokens[:limit]
+		}
+		if tokens == nil {
+			tokens = []InvalidToken{}
+		}
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		json.NewEncoder(res).Encode(InvalidTokensResponse{InvalidTokens: tokens})
+	})
+}
+
+// ExportInvalidTokensHandler returns all of invalid tokens as JSON lines at GET /invalid-tokens/export.
+func (prov *Provider) ExportInvalidTokensHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		tokens, ok := listInvalidTokens(res, req)
+		if !ok {
+			return
+		}
+		res.Header().Set("Content-Type", ApplicationJSONLines)
+		res.Header().Set("Content-Disposition", `attachment; filename="invalid_tokens.jsonl"`)
+		res.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(res)
+		for _, it := range tokens {
+			enc.Encode(it)
+		}
+	})
+}
+
+// ClearInvalidTokensHandler removes invalid tokens at POST /invalid-tokens/clear.
+func (prov *Provider) ClearInvalidTokensHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := validateMethod(res, req); err != nil {
+			logrus.Warn(err)
+			return
+		}
+		registry := currentTokenRegistry()
+		if registry == nil {
+			writeReason(res, http.StatusNotFound, "token registry is not configured")
+			return
+		}
+		var cr ClearTokensRequest
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&cr); err != nil {
+				writeReason(res, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if len(cr.Tokens) == 0 && !cr.All {
+			writeReason(res, http.StatusBadRequest, "tokens are required, or all must be true to remove all of tokens")
+			return
+		}
+		n, err := registry.Remove(cr.Provider, cr.Tokens)
+		if err != nil {
+			writeReason(res, http.StatusInternalServerError, err.Error())
+			return
+		}
+		LogWithFields(logrus.Fields{"type": "token_registry", "provider": cr.Provider, "caller": CallerName(req.Context())}).
+			Infof("Cleared %d invalid tokens", n)
+		res.Header().Set("Content-Type", ApplicationJSON)
+		res.WriteHeader(http.StatusOK)
+		json.NewEncoder(res).Encode(ClearTokensResponse{Result: "ok", Cleared: n})
+	})
+}
@@ -0,0 +1,178 @@
+package gunfish_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+// nopTokenRegistry disables the registry for other tests.
+type nopTokenRegistry struct{}
+
+func (nopTokenRegistry) Put(gunfish.InvalidToken) error { return nil }
+func (nopTokenRegistry) Get(provider, token string) (gunfish.InvalidToken, bool) {
+	return gunfish.InvalidToken{}, false
+}
+func (nopTokenRegistry) List(provider string) ([]gunfish.InvalidToken, error) { return nil, nil }
+func (nopTokenRegistry) Remove(provider string, tokens []string) (int, error) { return 0, nil }
+
+func TestTokenRegistry(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "invalid_tokens.json")
+	registry, err := gunfish.NewFileTokenRegistry(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gunfish.InitTokenRegistry(registry)
+	defer gunfish.InitTokenRegistry(nopTokenRegistry{})
+
+	sup, err := gunfish.StartSupervisor(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	// the first notification records the token
+	start := time.Now()
+	reqs := repeatRequestData("unregistered", 1)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	it, ok := registry.Get("apns", "unregistered")
+	if !ok {
+		t.Fatal("invalid token was not recorded")
+	}
+	if it.Reason != "Unregistered" || it.InvalidatedAt.Before(start.Truncate(time.Millisecond)) || it.InvalidatedAt.After(it.RecordedAt) {
+		t.Errorf("unexpected record: %#v", it)
+	}
+
+	// later notifications to the token are rejected
+	reqs = append(repeatRequestData("unregistered", 1), repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 1)...)
+	batch, err = sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := batch.Rejected(); len(r) != 1 || r[0] != "unregistered" {
+		t.Errorf("unexpected rejected tokens: %v", r)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+	entries := batch.Entries()
+	if entries[0].State != gunfish.StateRejected || entries[0].Reason != gunfish.ReasonInvalidToken {
+		t.Errorf("unexpected entry: %#v", entries[0])
+	}
+	if entries[1].State != gunfish.StateDelivered {
+		t.Errorf("unexpected entry: %#v", entries[1])
+	}
+
+	// records are loaded from the file
+	reopened, err := gunfish.NewFileTokenRegistry(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get("apns", "unregistered"); !ok {
+		t.Error("invalid token was not loaded")
+	}
+
+	prov := &gunfish.Provider{Sup: sup}
+	r, _ := http.NewRequest("GET", "/invalid-tokens/export?provider=apns", nil)
+	w := httptest.NewRecorder()
+	prov.ExportInvalidTokensHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", w.Code)
+	}
+	var exported gunfish.InvalidToken
+	if err := json.NewDecoder(w.Body).Decode(&exported); err != nil || exported.Token != "unregistered" {
+		t.Errorf("unexpected export: %#v %s", exported, err)
+	}
+
+	// clearing all tokens must be explicit
+	r, _ = http.NewRequest("POST", "/invalid-tokens/clear", nil)
+	w = httptest.NewRecorder()
+	prov.ClearInvalidTokensHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code is 400 but got %d", w.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "/invalid-tokens/clear", bytes.NewBufferString(`{"provider":"apns","tokens":["unregistered"]}`))
+	w = httptest.NewRecorder()
+	prov.ClearInvalidTokensHandler().ServeHTTP(w, r)
+	var cr gunfish.ClearTokensResponse
+	if err := json.NewDecoder(w.Body).Decode(&cr); err != nil || cr.Cleared != 1 {
+		t.Errorf("unexpected response: %#v %s", cr, err)
+	}
+
+	r, _ = http.NewRequest("GET", "/invalid-tokens", nil)
+	w = httptest.NewRecorder()
+	prov.InvalidTokensHandler().ServeHTTP(w, r)
+	var list gunfish.InvalidTokensResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list.InvalidTokens) != 0 {
+		t.Errorf("tokens must be cleared: %#v %s", list, err)
+	}
+	reopened, _ = gunfish.NewFileTokenRegistry(name, 0)
+	if _, ok := reopened.Get("apns", "unregistered"); ok {
+		t.Error("cleared token was loaded")
+	}
+}
+
+func TestTokenRegistryTTL(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "invalid_tokens.json")
+	registry, err := gunfish.NewFileTokenRegistry(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	registry.Put(gunfish.InvalidToken{Provider: "apns", Token: "old", InvalidatedAt: now.Add(-2 * time.Hour), RecordedAt: now})
+	registry.Put(gunfish.InvalidToken{Provider: "apns", Token: "new", InvalidatedAt: now, RecordedAt: now})
+
+	// the token may be registered again after the ttl
+	if _, ok := registry.Get("apns", "old"); ok {
+		t.Error("expired token must be valid")
+	}
+	if _, ok := registry.Get("apns", "new"); !ok {
+		t.Error("token must be invalid")
+	}
+	if l, _ := registry.List(""); len(l) != 1 || l[0].Token != "new" {
+		t.Errorf("unexpected tokens: %#v", l)
+	}
+
+	reopened, err := gunfish.NewFileTokenRegistry(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := reopened.List(""); len(l) != 1 || l[0].Token != "new" {
+		t.Errorf("unexpected tokens: %#v", l)
+	}
+}
+
+func TestTokenRegistryCompaction(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "invalid_tokens.json")
+	registry, err := gunfish.NewFileTokenRegistry(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < gunfish.TokenRegistryCompactThreshold; i++ {
+		if err := registry.Put(gunfish.InvalidToken{Provider: "apns", Token: "xxx", InvalidatedAt: now, RecordedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 1 {
+		t.Errorf("replaced records must be compacted: %d lines", n)
+	}
+}
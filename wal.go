@@ -0,0 +1,378 @@
+package gunfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations of write-ahead log records
+const (
+	walOpAdd  = "add"
+	walOpDone = "done"
+)
+
+const walExt = ".wal"
+
+// walRecord is a line of the write-ahead log.
+type walRecord struct {
+	Op           string          `json:"op"`
+	ID           string          `json:"id"`
+	Provider     string          `json:"provider,omitempty"`
+	Caller       string          `json:"caller,omitempty"`
+	Priority     string          `json:"priority,omitempty"`
+	Notification json.RawMessage `json:"notification,omitempty"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+}
+
+type walEntry struct {
+	seq int64
+	rec walRecord
+}
+
+// writeAheadLog records accepted notifications until they have final results.
+// Each process appends to its own log file which is locked while the process is alive.
+// Log files which are not locked were left by stopped processes. A running process adopts them.
+type writeAheadLog struct {
+	dir  string
+	name string
+
+	mu      sync.Mutex
+	file    *os.File
+	pending map[string]walEntry
+	seq     int64
+	dones   int // done records since the last compaction
+	closed  bool
+}
+
+// openWAL creates a log file of this process in dir.
+func openWAL(dir string) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{
+		dir:     dir,
+		name:    filepath.Join(dir, fmt.Sprintf("%d-%d%s", os.Getpid(), time.Now().UnixNano(), walExt)),
+		pending: make(map[string]walEntry),
+	}
+	// locks the file before it is visible as a log file not to be adopted by other processes
+	f, err := createLocked(w.name + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), w.name); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.file = f
+	return w, nil
+}
+
+func createLocked(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// append records reqs durably, and sets the record IDs to reqs.
+func (w *writeAheadLog) append(reqs []Request, caller string) error {
+	recs := make([]walRecord, len(reqs))
+	for i, req := range reqs {
+		p := pushProviderOf(req.Notification)
+		if p == nil {
+			return errUnknownRequest
+		}
+		if _, ok := p.(NotificationDecoder); !ok {
+			return fmt.Errorf("%s does not support the write-ahead log", p.Name())
+		}
+		b, err := json.Marshal(req.Notification)
+		if err != nil {
+			return err
+		}
+		recs[i] = walRecord{
+			Op:           walOpAdd,
+			ID:           uuid.NewV4().String(),
+			Provider:     p.Name(),
+			Caller:       caller,
+			Priority:     req.priority,
+			Notification: b,
+			Metadata:     req.Metadata,
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+	if err := w.write(recs, true); err != nil {
+		return err
+	}
+	for i, rec := range recs {
+		w.seq++
+		w.pending[rec.ID] = walEntry{seq: w.seq, rec: rec}
+		reqs[i].wal, reqs[i].walID = w, rec.ID
+	}
+	return nil
+}
+
+// adopt records which were already recorded in another log.
+func (w *writeAheadLog) adopt(recs []walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+	if err := w.write(recs, true); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		w.seq++
+		w.pending[rec.ID] = walEntry{seq: w.seq, rec: rec}
+	}
+	return nil
+}
+
+// done records that the notification has the final result.
+func (w *writeAheadLog) done(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[id]; !ok || w.closed {
+		return
+	}
+	delete(w.pending, id)
+	// a lost done record only causes sending the notification again, so it is not synced
+	if err := w.write([]walRecord{{Op: walOpDone, ID: id}}, false); err != nil {
+		LogWithFields(logrus.Fields{"type": "wal"}).Errorf("failed to write: %s", err)
+		return
+	}
+	w.dones++
+	if w.dones >= WALCompactThreshold {
+		if err := w.compact(); err != nil {
+			LogWithFields(logrus.Fields{"type": "wal"}).Errorf("failed to compact: %s", err)
+		}
+	}
+}
+
+func (w *writeAheadLog) write(recs []walRecord, sync bool) error {
+	var b []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if _, err := w.file.Write(b); err != nil {
+		return err
+	}
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// compact rewrites the log file with pending records only.
+func (w *writeAheadLog) compact() error {
+	f, err := createLocked(w.name + ".tmp")
+	if err != nil {
+		return err
+	}
+	old := w.file
+	w.file = f
+	if err := w.write(w.pendingRecords(), true); err != nil {
+		w.file = old
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), w.name); err != nil {
+		w.file = old
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	old.Close()
+	w.dones = 0
+	return nil
+}
+
+func (w *writeAheadLog) pendingRecords() []walRecord {
+	entries := make([]walEntry, 0, len(w.pending))
+	for _, e := range w.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	recs := make([]walRecord, len(entries))
+	for i, e := range entries {
+		recs[i] = e.rec
+	}
+	return recs
+}
+
+// pendingCount returns the number of notifications which do not have final results.
+func (w *writeAheadLog) pendingCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// close closes the log file. The file is removed when all notifications have final results,
+// otherwise it is left to be adopted by another process.
+func (w *writeAheadLog) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.pending) == 0 {
+		os.Remove(w.name)
+	} else {
+		LogWithFields(logrus.Fields{"type": "wal", "file": w.name}).
+			Warnf("%d notifications are left in the write-ahead log", len(w.pending))
+	}
+	return w.file.Close()
+}
+
+// adoptOrphans moves pending records in log files of stopped processes into this log, and returns them.
+func (w *writeAheadLog) adoptOrphans() ([]walRecord, error) {
+	names, err := filepath.Glob(filepath.Join(w.dir, "*"+walExt))
+	if err != nil {
+		return nil, err
+	}
+	removeStaleTemporaries(w.dir)
+
+	var adopted []walRecord
+	for _, name := range names {
+		if name == w.name {
+			continue
+		}
+		recs, err := w.adoptFile(name)
+		if err != nil {
+			return adopted, err
+		}
+		adopted = append(adopted, recs...)
+	}
+	return adopted, nil
+}
+
+func (w *writeAheadLog) adoptFile(name string) ([]walRecord, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		// the process is alive
+		return nil, nil
+	}
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		// adopted by another process just now
+		return nil, nil
+	}
+
+	recs := readWAL(f, name)
+	if len(recs) > 0 {
+		if err := w.adopt(recs); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Remove(name); err != nil {
+		return recs, err
+	}
+	LogWithFields(logrus.Fields{"type": "wal", "file": name}).
+		Infof("Adopted %d notifications from the write-ahead log", len(recs))
+	return recs, nil
+}
+
+// removeStaleTemporaries removes temporary files which processes left on crash.
+func removeStaleTemporaries(dir string) {
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+walExt+".tmp"))
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			os.Remove(name)
+		}
+		f.Close()
+	}
+}
+
+// readWAL returns pending records in the log.
+func readWAL(r io.Reader, name string) []walRecord {
+	var recs []walRecord
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			// the last line may be broken by a crash
+			LogWithFields(logrus.Fields{"type": "wal", "file": name}).Warnf("skipped a broken record: %s", err)
+			continue
+		}
+		switch rec.Op {
+		case walOpAdd:
+			index[rec.ID] = len(recs)
+			recs = append(recs, rec)
+		case walOpDone:
+			if i, ok := index[rec.ID]; ok {
+				recs[i].Op = walOpDone
+				delete(index, rec.ID)
+			}
+		}
+	}
+	pending := recs[:0]
+	for _, rec := range recs {
+		if rec.Op == walOpAdd {
+			pending = append(pending, rec)
+		}
+	}
+	return pending
+}
+
+// decodeWALRecord restores the request from the record.
+func decodeWALRecord(rec walRecord) (Request, error) {
+	for _, p := range PushProviders() {
+		if p.Name() != rec.Provider {
+			continue
+		}
+		d, ok := p.(NotificationDecoder)
+		if !ok {
+			break
+		}
+		n, err := d.DecodeNotification(rec.Notification)
+		if err != nil {
+			return Request{}, err
+		}
+		return Request{Notification: n, Metadata: rec.Metadata, priority: rec.Priority}, nil
+	}
+	return Request{}, fmt.Errorf("%s does not support the write-ahead log", rec.Provider)
+}
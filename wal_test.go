@@ -0,0 +1,59 @@
+package gunfish_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+
+	// a log which a crashed process left
+	orphan := filepath.Join(dir, "1-1.wal")
+	records := `{"op":"add","id":"a","provider":"apns","notification":{"token":"1122334455667788112233445566778811223344556677881122334455667788","payload":{"aps":{"alert":"replayed"}}}}
+{"op":"add","id":"b","provider":"apns","notification":{"token":"1122334455667788112233445566778811223344556677881122334455667788","payload":{"aps":{"alert":"done"}}}}
+{"op":"done","id":"b"}
+{"op":"add","id":"c","provider":"unknown","notification":{}}
+{"op":"add","id":"d","provi`
+	if err := os.WriteFile(orphan, []byte(records), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := conf
+	c.Provider.WAL.Dir = dir
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan log must be adopted: %v", err)
+	}
+
+	reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 3)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Error("batch was not finished")
+	}
+	for _, e := range batch.Entries() {
+		if e.State != gunfish.StateDelivered {
+			t.Errorf("unexpected state: %#v", e)
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond) // waits for the replayed notification
+	sup.Shutdown()
+
+	// all of notifications have final results, so no logs are left
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 0 {
+		t.Errorf("logs are left: %v", names)
+	}
+}
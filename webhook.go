@@ -0,0 +1,316 @@
+package gunfish
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+	"github.com/sirupsen/logrus"
+)
+
+// webhookItem is a result which waits to be posted to a webhook.
+type webhookItem struct {
+	req  Request
+	body json.RawMessage
+}
+
+// webhook posts results of notifications to a URL in batches.
+type webhook struct {
+	kind   string // error or success
+	conf   config.SectionWebhook
+	uri    string // request URI to sign
+	secret []byte
+	client *http.Client
+	queue  chan webhookItem
+	sem    chan struct{} // limits concurrent requests
+	wg     sync.WaitGroup
+}
+
+func newWebhook(kind string, conf config.SectionWebhook) (*webhook, error) {
+	conf = conf.WithDefaults()
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	w := &webhook{
+		kind:   kind,
+		conf:   conf,
+		uri:    u.RequestURI(),
+		client: &http.Client{Timeout: conf.Timeout.Duration},
+		queue:  make(chan webhookItem, conf.QueueSize),
+		sem:    make(chan struct{}, conf.Concurrency),
+	}
+	if conf.Secret != "" {
+		w.secret = []byte(conf.Secret)
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// put enqueues the result to be posted. It returns false when the queue is full.
+func (w *webhook) put(req Request, result Result) bool {
+	b, err := result.MarshalJSON()
+	if err != nil {
+		LogWithFields(logrus.Fields{"type": "webhook", "webhook": w.kind}).
+			Errorf("failed to encode the result: %s", err)
+		return true
+	}
+	select {
+	case w.queue <- webhookItem{req: req, body: b}:
+		return true
+	default:
+		return false
+	}
+}
+
+// close posts queued results and waits for all requests to finish.
+func (w *webhook) close() {
+	close(w.queue)
+	w.wg.Wait()
+}
+
+func (w *webhook) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.conf.FlushInterval.Duration)
+	defer ticker.Stop()
+
+	items := make([]webhookItem, 0, w.conf.BatchSize)
+	flush := func() {
+		if len(items) == 0 {
+			return
+		}
+		batch := items
+		items = make([]webhookItem, 0, w.conf.BatchSize)
+		w.sem <- struct{}{}
+		w.wg.Add(1)
+		go func() {
+			defer func() {
+				<-w.sem
+				w.wg.Done()
+			}()
+			w.post(batch)
+		}()
+	}
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			items = append(items, item)
+			if len(items) >= w.conf.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// post sends results as a JSON array with retries.
+func (w *webhook) post(items []webhookItem) {
+	logf := logrus.Fields{"type": "webhook", "webhook": w.kind, "url": w.conf.URL, "size": len(items)}
+	bodies := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		bodies[i] = item.body
+	}
+	body, _ := json.Marshal(bodies)
+
+	var err error
+	for i := 0; i <= w.conf.MaxRetries; i++ {
+		if i > 0 {
+			time.Sleep(WebhookRetryWaitTime * time.Duration(1<<uint(i-1)))
+		}
+		if err = w.send(body); err == nil {
+			metrics.webhooks.add(1, w.kind, "ok")
+			LogWithFields(logf).Debugf("Posted results to the webhook")
+			return
+		}
+		LogWithFields(logf).Warnf("Failed to post results to the webhook: %s", err)
+	}
+	metrics.webhooks.add(1, w.kind, "failed")
+	LogWithFields(logf).Errorf("Gave up posting results to the webhook: %s", err)
+	if w.kind == resultError {
+		for _, item := range items {
+			putDeadWebhook(item, err, DeadLetterWebhookFailed, w.conf.URL)
+		}
+	}
+}
+
+func (w *webhook) send(body []byte) error {
+	req, err := http.NewRequest("POST", w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ApplicationJSON)
+	if w.secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(SignRequest(w.secret, ts, "POST", w.uri, body)))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Kinds of hooks and webhooks
+const (
+	resultError   = "error"
+	resultSuccess = "success"
+)
+
+// webhookSet holds webhooks of the configuration.
+type webhookSet struct {
+	mu      sync.RWMutex
+	conf    [2]config.SectionWebhook
+	error   *webhook
+	success *webhook
+}
+
+func newWebhookSet() *webhookSet {
+	return &webhookSet{}
+}
+
+// webhookUpdate holds webhooks of a new configuration which are not applied yet.
+type webhookUpdate struct {
+	set     *webhookSet
+	conf    [2]config.SectionWebhook
+	error   *webhook
+	success *webhook
+}
+
+// set replaces webhooks by the configuration. Replaced webhooks post queued results in background.
+func (s *webhookSet) set(errConf, successConf config.SectionWebhook) error {
+	u, err := s.prepare(errConf, successConf)
+	if err != nil {
+		return err
+	}
+	u.apply()
+	return nil
+}
+
+// prepare creates webhooks of the configuration. They are applied by apply, so that
+// a configuration which fails in other parts does not replace webhooks.
+// It returns nil when the configuration is not changed.
+func (s *webhookSet) prepare(errConf, successConf config.SectionWebhook) (*webhookUpdate, error) {
+	conf := [2]config.SectionWebhook{errConf, successConf}
+	s.mu.RLock()
+	unchanged := s.conf == conf
+	s.mu.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+	u := &webhookUpdate{set: s, conf: conf}
+	var err error
+	if errConf.URL != "" {
+		if u.error, err = newWebhook(resultError, errConf); err != nil {
+			return nil, err
+		}
+	}
+	if successConf.URL != "" {
+		if u.success, err = newWebhook(resultSuccess, successConf); err != nil {
+			u.discard()
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// apply replaces webhooks by the update. A nil update does nothing.
+func (u *webhookUpdate) apply() {
+	if u == nil {
+		return
+	}
+	s := u.set
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, old := range []*webhook{s.error, s.success} {
+		if old != nil {
+			go old.close()
+		}
+	}
+	s.conf = u.conf
+	s.error, s.success = u.error, u.success
+}
+
+// discard stops webhooks of the update which is not applied.
+func (u *webhookUpdate) discard() {
+	if u == nil {
+		return
+	}
+	for _, w := range []*webhook{u.error, u.success} {
+		if w != nil {
+			w.close()
+		}
+	}
+}
+
+// put enqueues the result to the error or success webhook.
+func (s *webhookSet) put(req Request, result Result) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w := s.success
+	if result.Err() != nil {
+		w = s.error
+	}
+	if w == nil {
+		return
+	}
+	if w.put(req, result) {
+		return
+	}
+	metrics.webhooks.add(1, w.kind, "dropped")
+	LogWithFields(logrus.Fields{"type": "webhook", "webhook": w.kind}).
+		Warnf("Webhook queue is full, so could not post the result.")
+	if w.kind == resultError {
+		b, _ := result.MarshalJSON()
+		putDeadWebhook(webhookItem{req: req, body: b}, nil, DeadLetterWebhookQueueFull, w.conf.URL)
+	}
+}
+
+// requeue enqueues the result of a dead letter to the error webhook again.
+func (s *webhookSet) requeue(item webhookItem) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.error == nil {
+		return errors.New("error webhook is not configured")
+	}
+	select {
+	case s.error.queue <- item:
+		return nil
+	default:
+		return errors.New("webhook queue is full")
+	}
+}
+
+// close posts queued results of webhooks and waits for them.
+func (s *webhookSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range []*webhook{s.error, s.success} {
+		if w != nil {
+			w.close()
+		}
+	}
+	s.conf = [2]config.SectionWebhook{}
+	s.error, s.success = nil, nil
+}
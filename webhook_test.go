@@ -0,0 +1,107 @@
+package gunfish_test
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+)
+
+type webhookReceiver struct {
+	mu      sync.Mutex
+	secret  []byte
+	results map[string][]map[string]interface{} // keyed by path
+	errors  []string
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sig, _ := hex.DecodeString(req.Header.Get(gunfish.SignatureHeader))
+	ts := req.Header.Get(gunfish.TimestampHeader)
+	if !hmac.Equal(sig, gunfish.SignRequest(r.secret, ts, req.Method, req.URL.RequestURI(), body)) {
+		r.errors = append(r.errors, "signature mismatch")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var results []map[string]interface{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		r.errors = append(r.errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.results[req.URL.Path] = append(r.results[req.URL.Path], results...)
+}
+
+func (r *webhookReceiver) count(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.results[path])
+}
+
+func TestWebhook(t *testing.T) {
+	recv := &webhookReceiver{
+		secret:  []byte("webhook-secret"),
+		results: make(map[string][]map[string]interface{}),
+	}
+	ts := httptest.NewServer(recv)
+	defer ts.Close()
+
+	c := conf
+	c.Provider.SuccessWebhook = config.SectionWebhook{
+		URL:           ts.URL + "/success",
+		Secret:        "webhook-secret",
+		BatchSize:     2,
+		FlushInterval: config.Duration{Duration: 100 * time.Millisecond},
+	}
+	c.Provider.ErrorWebhook = config.SectionWebhook{
+		URL:           ts.URL + "/error?source=gunfish",
+		Secret:        "webhook-secret",
+		FlushInterval: config.Duration{Duration: 100 * time.Millisecond},
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+
+	reqs := repeatRequestData("1122334455667788112233445566778811223344556677881122334455667788", 3)
+	reqs = append(reqs, repeatRequestData("unregistered", 1)...)
+	batch, err := sup.EnqueueClientRequest(&reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !batch.Wait(5 * time.Second) {
+		t.Fatal("batch was not finished")
+	}
+
+	for i := 0; i < 50; i++ {
+		if recv.count("/success") == 3 && recv.count("/error") == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if len(recv.errors) > 0 {
+		t.Errorf("invalid webhook requests: %v", recv.errors)
+	}
+	if n := len(recv.results["/success"]); n != 3 {
+		t.Errorf("unexpected number of success results: %d", n)
+	}
+	if n := len(recv.results["/error"]); n != 1 {
+		t.Fatalf("unexpected number of error results: %d", n)
+	}
+	if r := recv.results["/error"][0]; r["reason"] != "Unregistered" {
+		t.Errorf("unexpected error result: %v", r)
+	}
+}
@@ -0,0 +1,231 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+)
+
+// Web Push client const variables
+const (
+	ClientTimeout = time.Second * 10
+	// DefaultTTL is TTL of notifications which have no ttl.
+	DefaultTTL = 60 * 60 * 24 * 28
+	// VAPIDExpiration is the lifetime of VAPID JWTs. RFC 8292 requires less than 24 hours.
+	VAPIDExpiration = time.Hour * 12
+	// MaxResponseMessageSize is the max size of a response body kept in results.
+	MaxResponseMessageSize = 512
+)
+
+// DefaultAllowedHosts are the hosts of the push services of major browsers.
+var DefaultAllowedHosts = []string{
+	"fcm.googleapis.com",        // Chrome, Edge
+	"android.googleapis.com",    // Chrome (legacy)
+	"push.services.mozilla.com", // Firefox
+	"web.push.apple.com",        // Safari
+	"notify.windows.com",        // Windows (legacy Edge)
+}
+
+type vapidToken struct {
+	jwt       string
+	expiresAt time.Time
+}
+
+type vapidHeader struct {
+	Typ string `json:"typ"`
+	Alg string `json:"alg"`
+}
+
+type vapidClaim struct {
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Sub string `json:"sub"`
+}
+
+// Client is Web Push client
+type Client struct {
+	Client       *http.Client
+	AllowedHosts []string // hosts of push services which the client sends to. Subdomains of them are allowed too.
+
+	key       *ecdsa.PrivateKey
+	publicKey string // application server key in base64url
+	subject   string
+
+	mu     sync.Mutex
+	tokens map[string]vapidToken // VAPID JWTs keyed by the origin of push services
+}
+
+// NewClient creates a Web Push client which identifies itself by the VAPID key.
+func NewClient(key *ecdsa.PrivateKey, subject string, timeout time.Duration) (*Client, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("VAPID key must be a P-256 private key")
+	}
+	ek, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+		AllowedHosts: DefaultAllowedHosts,
+		key:          key,
+		publicKey:    base64.RawURLEncoding.EncodeToString(ek.PublicKey().Bytes()),
+		subject:      subject,
+		tokens:       make(map[string]vapidToken),
+	}, nil
+}
+
+// PublicKey returns the application server key which browsers subscribe with.
+func (c *Client) PublicKey() string {
+	return c.publicKey
+}
+
+// Send sends a notification to the push service of the subscription
+func (c *Client) Send(n Notification) ([]Result, error) {
+	if !AllowedHost(n.Subscription.Endpoint, c.AllowedHosts) {
+		// never connect to hosts other than push services
+		return []Result{
+			{
+				Token:   n.Subscription.Endpoint,
+				Reason:  BadRequest,
+				Message: "the host of the endpoint is not allowed",
+			},
+		}, nil
+	}
+	req, err := c.NewRequest(n)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, MaxResponseMessageSize))
+
+	return []Result{
+		{
+			StatusCode: res.StatusCode,
+			Token:      n.Subscription.Endpoint,
+			Reason:     reasonOf(res.StatusCode),
+			Message:    string(bytes.TrimSpace(body)),
+		},
+	}, nil
+}
+
+// AllowedHost reports whether the host of the endpoint is one of hosts or their subdomains.
+func AllowedHost(endpoint string, hosts []string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func reasonOf(status int) string {
+	switch {
+	case status >= 200 && status < 300:
+		return ""
+	case status == http.StatusNotFound, status == http.StatusGone:
+		return Unregistered
+	case status == http.StatusRequestEntityTooLarge:
+		return PayloadTooLarge
+	case status == http.StatusTooManyRequests:
+		return TooManyRequests
+	case status == http.StatusUnauthorized:
+		return Unauthorized
+	case status == http.StatusForbidden:
+		return Forbidden
+	case status >= 500:
+		return ServerError
+	}
+	return BadRequest
+}
+
+// NewRequest creates an encrypted request for the push service
+func (c *Client) NewRequest(n Notification) (*http.Request, error) {
+	u, err := url.Parse(n.Subscription.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := n.Data()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if len(data) > 0 {
+		if body, err = Encrypt(data, n.Subscription.Keys); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ttl := DefaultTTL
+	if n.TTL != nil {
+		ttl = *n.TTL
+	}
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	if n.Urgency != "" {
+		req.Header.Set("Urgency", n.Urgency)
+	}
+	if n.Topic != "" {
+		req.Header.Set("Topic", n.Topic)
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Encoding", ContentEncoding)
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	token, err := c.vapidToken(u.Scheme+"://"+u.Host, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "vapid t="+token+", k="+c.publicKey)
+
+	return req, nil
+}
+
+// vapidToken returns a VAPID JWT for the audience. It is reused until a half of the lifetime passes.
+func (c *Client) vapidToken(aud string, now time.Time) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[aud]; ok && now.Add(VAPIDExpiration/2).Before(t.expiresAt) {
+		return t.jwt, nil
+	}
+
+	exp := now.Add(VAPIDExpiration)
+	jwt, err := apns.SignES256(c.key, vapidHeader{Typ: "JWT", Alg: "ES256"}, vapidClaim{
+		Aud: aud,
+		Exp: exp.Unix(),
+		Sub: c.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	c.tokens[aud] = vapidToken{jwt: jwt, expiresAt: exp}
+	return jwt, nil
+}
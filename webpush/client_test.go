@@ -0,0 +1,186 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (*Client, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(key, "mailto:push@example.com", ClientTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AllowedHosts = []string{"127.0.0.1"} // httptest servers
+	return c, key
+}
+
+func TestSend(t *testing.T) {
+	c, key := newTestClient(t)
+
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		case "/toolarge":
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer ts.Close()
+
+	ttl := 60
+	n := Notification{
+		Subscription: Subscription{
+			Endpoint: ts.URL + "/ok",
+			Keys:     Keys{P256dh: rfcUAPublic, Auth: rfcAuthSecret},
+		},
+		Payload: json.RawMessage(`"hello"`),
+		TTL:     &ttl,
+		Urgency: UrgencyHigh,
+		Topic:   "score",
+	}
+	results, err := c.Send(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Err() != nil || r.StatusCode != http.StatusCreated || r.Token != n.Subscription.Endpoint {
+		t.Errorf("unexpected result: %#v", r)
+	}
+	for k, v := range map[string]string{
+		"TTL":              "60",
+		"Urgency":          UrgencyHigh,
+		"Topic":            "score",
+		"Content-Encoding": ContentEncoding,
+	} {
+		if g := header.Get(k); g != v {
+			t.Errorf("unexpected %s header: %s", k, g)
+		}
+	}
+	verifyVAPID(t, header.Get("Authorization"), key, ts.URL)
+
+	for path, reason := range map[string]string{
+		"/gone":     Unregistered,
+		"/notfound": Unregistered,
+		"/toolarge": PayloadTooLarge,
+	} {
+		n.Subscription.Endpoint = ts.URL + path
+		results, err := c.Send(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := results[0].Err(); err == nil || err.Error() != reason {
+			t.Errorf("%s: expected %s but got %v", path, reason, err)
+		}
+	}
+
+	header = nil
+	c.AllowedHosts = DefaultAllowedHosts
+	n.Subscription.Endpoint = ts.URL + "/ok"
+	results, err = c.Send(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; header != nil || r.Err() == nil || r.Err().Error() != BadRequest {
+		t.Errorf("sent to the host which is not allowed: %#v", r)
+	}
+}
+
+func TestAllowedHost(t *testing.T) {
+	for endpoint, allowed := range map[string]bool{
+		"https://fcm.googleapis.com/fcm/send/xxx":               true,
+		"https://updates.push.services.mozilla.com/wpush/v2/xx": true,
+		"https://wns2-pn1p.notify.windows.com/w/?token=xxx":     true,
+		"https://WEB.PUSH.APPLE.COM:443/xxx":                    true,
+		"https://push.example.com/send/xxx":                     false,
+		"https://fcm.googleapis.com.example.com/fcm/send/xxx":   false,
+		"https://evilfcm.googleapis.com/fcm/send/xxx":           false,
+		"https://127.0.0.1/":                                    false,
+		"https://[::1]/":                                        false,
+		"https://169.254.169.254/latest/meta-data/":             false,
+	} {
+		if g := AllowedHost(endpoint, DefaultAllowedHosts); g != allowed {
+			t.Errorf("%s: expected %v but got %v", endpoint, allowed, g)
+		}
+	}
+}
+
+func verifyVAPID(t *testing.T, auth string, key *ecdsa.PrivateKey, aud string) {
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "vapid "), ", ") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			token = part[2:]
+		case strings.HasPrefix(part, "k="):
+			k = part[2:]
+		}
+	}
+	pub, _ := decodeBase64(k)
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil || x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+		t.Fatalf("unexpected public key: %s", k)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("invalid JWT: %s", token)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatal("invalid JWT signature")
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claim vapidClaim
+	json.Unmarshal(b, &claim)
+	if claim.Aud != aud || claim.Sub != "mailto:push@example.com" || claim.Exp > time.Now().Add(24*time.Hour).Unix() {
+		t.Errorf("unexpected claim: %#v", claim)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Notification{
+		Subscription: Subscription{
+			Endpoint: "https://push.example.com/send/xxx",
+			Keys:     Keys{P256dh: rfcUAPublic, Auth: rfcAuthSecret},
+		},
+		Payload: json.RawMessage(`{"title":"hello"}`),
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for name, f := range map[string]func(n *Notification){
+		"http endpoint": func(n *Notification) { n.Subscription.Endpoint = "http://push.example.com/" },
+		"short p256dh":  func(n *Notification) { n.Subscription.Keys.P256dh = "BCVxsr7N" },
+		"no auth":       func(n *Notification) { n.Subscription.Keys.Auth = "" },
+		"large payload": func(n *Notification) { n.Payload = json.RawMessage(`"` + strings.Repeat("x", MaxPayloadSize+1) + `"`) },
+		"urgency":       func(n *Notification) { n.Urgency = "urgent" },
+		"long topic":    func(n *Notification) { n.Topic = strings.Repeat("x", MaxTopicSize+1) },
+		"invalid topic": func(n *Notification) { n.Topic = "score/1" },
+	} {
+		n := valid
+		f(&n)
+		if err := n.Validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// https://www.rfc-editor.org/rfc/rfc8291 and https://www.rfc-editor.org/rfc/rfc8188
+
+// ContentEncoding is the content coding of encrypted payloads.
+const ContentEncoding = "aes128gcm"
+
+const (
+	recordSize = 4096
+	saltSize   = 16
+	tagSize    = 16
+	// header: salt(16) || rs(4) || idlen(1) || keyid(65)
+	headerSize = saltSize + 4 + 1 + P256dhSize
+)
+
+// MaxPayloadSize is the max size of a payload which fits in a single record.
+// One byte is used by the padding delimiter.
+const MaxPayloadSize = recordSize - headerSize - tagSize - 1
+
+// Encrypt encrypts the plaintext for the subscription as RFC 8291 defines.
+func Encrypt(plaintext []byte, keys Keys) ([]byte, error) {
+	k, err := keys.decode()
+	if err != nil {
+		return nil, err
+	}
+	return encrypt(plaintext, k.p256dh, k.auth)
+}
+
+func encrypt(plaintext, uaPublic, authSecret []byte) ([]byte, error) {
+	curve := ecdh.P256()
+	uaKey, err := curve.NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return encryptWith(plaintext, uaKey, authSecret, asKey, salt)
+}
+
+// encryptWith encrypts the plaintext by the ephemeral key and the salt of the application server.
+func encryptWith(plaintext []byte, uaKey *ecdh.PublicKey, authSecret []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublic := uaKey.Bytes()
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single record which ends with the padding delimiter 0x02
+	record := append(append([]byte{}, plaintext...), 0x02)
+
+	out := make([]byte, 0, headerSize+len(record)+tagSize)
+	out = append(out, salt...)
+	out = binary.BigEndian.AppendUint32(out, recordSize)
+	out = append(out, byte(len(asPublic)))
+	out = append(out, asPublic...)
+	return gcm.Seal(out, nonce, record, nil), nil
+}
+
+// hkdf derives a key which has the length (up to 32) by HKDF-SHA256.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}
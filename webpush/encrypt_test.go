@@ -0,0 +1,84 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+// https://www.rfc-editor.org/rfc/rfc8291#appendix-A
+var (
+	rfcPlaintext  = "V2hlbiBJIGdyb3cgdXAsIEkgd2FudCB0byBiZSBhIHdhdGVybWVsb24"
+	rfcASPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcUAPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcUAPrivate  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcSalt       = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcCiphertext = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := decodeBase64(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptRFC8291(t *testing.T) {
+	uaKey, err := ecdh.P256().NewPublicKey(mustDecode(t, rfcUAPublic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asKey, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfcASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := encryptWith(mustDecode(t, rfcPlaintext), uaKey, mustDecode(t, rfcAuthSecret), asKey, mustDecode(t, rfcSalt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 8291 uses the record size 4096 as well
+	if g := base64.RawURLEncoding.EncodeToString(out); g != rfcCiphertext {
+		t.Errorf("unexpected ciphertext\ngot  %s\nwant %s", g, rfcCiphertext)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	plaintext := []byte(`{"title":"hello"}`)
+	keys := Keys{P256dh: rfcUAPublic, Auth: rfcAuthSecret}
+	out, err := Encrypt(plaintext, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decrypt as a user agent
+	salt, rs, idlen := out[:16], binary.BigEndian.Uint32(out[16:20]), int(out[20])
+	if rs != recordSize || idlen != P256dhSize {
+		t.Fatalf("unexpected header rs=%d idlen=%d", rs, idlen)
+	}
+	asKey, err := ecdh.P256().NewPublicKey(out[21 : 21+idlen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaKey, _ := ecdh.P256().NewPrivateKey(mustDecode(t, rfcUAPrivate))
+	secret, err := uaKey.ECDH(asKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaKey.PublicKey().Bytes()...), asKey.Bytes()...)
+	ikm := hkdf(mustDecode(t, rfcAuthSecret), secret, keyInfo, 32)
+	block, _ := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), out[21+idlen:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(record, append(plaintext, 0x02)) {
+		t.Errorf("unexpected plaintext: %q", record)
+	}
+}
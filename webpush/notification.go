@@ -0,0 +1,119 @@
+package webpush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// Lengths of subscription keys
+const (
+	P256dhSize = 65 // uncompressed P-256 public key
+	AuthSize   = 16
+)
+
+// MaxTopicSize is the max length of the Topic header.
+const MaxTopicSize = 32
+
+// Urgency values
+const (
+	UrgencyVeryLow = "very-low"
+	UrgencyLow     = "low"
+	UrgencyNormal  = "normal"
+	UrgencyHigh    = "high"
+)
+
+var topicRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// Notification is a push message for a push subscription of a browser.
+type Notification struct {
+	Subscription Subscription    `json:"subscription"`
+	Payload      json.RawMessage `json:"payload,omitempty"` // a string is sent as is, others are sent as JSON
+	TTL          *int            `json:"ttl,omitempty"`     // seconds. DefaultTTL is used when it is not set.
+	Urgency      string          `json:"urgency,omitempty"`
+	Topic        string          `json:"topic,omitempty"`
+}
+
+// Subscription is a PushSubscription of the Push API.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     Keys   `json:"keys"`
+}
+
+// Keys are keys of a PushSubscription to encrypt payloads.
+type Keys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// Data returns the payload to be encrypted.
+func (n Notification) Data() ([]byte, error) {
+	p := bytes.TrimSpace(n.Payload)
+	if len(p) == 0 || bytes.Equal(p, []byte("null")) {
+		return nil, nil
+	}
+	if p[0] == '"' {
+		var s string
+		if err := json.Unmarshal(p, &s); err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	}
+	return p, nil
+}
+
+// Validate validates the notification.
+func (n Notification) Validate() error {
+	u, err := url.Parse(n.Subscription.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("subscription.endpoint must be a https URL: %s", n.Subscription.Endpoint)
+	}
+	if _, err := n.Subscription.Keys.decode(); err != nil {
+		return err
+	}
+	data, err := n.Data()
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxPayloadSize {
+		return fmt.Errorf("payload must not exceed %d bytes", MaxPayloadSize)
+	}
+	if n.TTL != nil && *n.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative: %d", *n.TTL)
+	}
+	switch n.Urgency {
+	case "", UrgencyVeryLow, UrgencyLow, UrgencyNormal, UrgencyHigh:
+	default:
+		return fmt.Errorf("urgency is invalid: %s", n.Urgency)
+	}
+	if len(n.Topic) > MaxTopicSize || !topicRegexp.MatchString(n.Topic) {
+		return fmt.Errorf("topic must be up to %d characters of the URL-safe base64 alphabet: %s", MaxTopicSize, n.Topic)
+	}
+	return nil
+}
+
+type decodedKeys struct {
+	p256dh []byte
+	auth   []byte
+}
+
+func (k Keys) decode() (decodedKeys, error) {
+	var d decodedKeys
+	var err error
+	if d.p256dh, err = decodeBase64(k.P256dh); err != nil || len(d.p256dh) != P256dhSize {
+		return d, fmt.Errorf("subscription.keys.p256dh must be a %d bytes key encoded in base64url", P256dhSize)
+	}
+	if d.auth, err = decodeBase64(k.Auth); err != nil || len(d.auth) != AuthSize {
+		return d, fmt.Errorf("subscription.keys.auth must be a %d bytes secret encoded in base64url", AuthSize)
+	}
+	return d, nil
+}
+
+// decodeBase64 decodes base64url with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = string(bytes.TrimRight([]byte(s), "="))
+	return base64.RawURLEncoding.DecodeString(s)
+}
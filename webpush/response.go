@@ -0,0 +1,69 @@
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const Provider = "webpush"
+
+// Error reasons
+const (
+	Unregistered    = "Unregistered"
+	PayloadTooLarge = "PayloadTooLarge"
+	TooManyRequests = "TooManyRequests"
+	BadRequest      = "BadRequest"
+	Unauthorized    = "Unauthorized"
+	Forbidden       = "Forbidden"
+	ServerError     = "ServerError"
+)
+
+// Result is the response from a push service
+type Result struct {
+	StatusCode int    `json:"status"`
+	Token      string `json:"token"` // endpoint of the subscription
+	Reason     string `json:"reason,omitempty"`
+	Message    string `json:"message,omitempty"` // response body from the push service
+}
+
+func (r Result) Err() error {
+	if r.Reason == "" {
+		return nil
+	}
+	return errors.New(r.Reason)
+}
+
+func (r Result) Status() int {
+	return r.StatusCode
+}
+
+func (r Result) RecipientIdentifier() string {
+	return r.Token
+}
+
+func (r Result) ExtraKeys() []string {
+	return []string{"message"}
+}
+
+func (r Result) ExtraValue(key string) string {
+	switch key {
+	case "message":
+		return r.Message
+	}
+	return ""
+}
+
+func (r Result) Provider() string {
+	return Provider
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	type Alias Result
+	return json.Marshal(struct {
+		Provider string `json:"provider"`
+		Alias
+	}{
+		Provider: Provider,
+		Alias:    (Alias)(r),
+	})
+}